@@ -21,21 +21,80 @@ type Config struct {
 	Dispatcher struct {
 		Middleware []string
 	}
+	Gzip struct {
+		Encodings    []string `gcfg:"encoding"`
+		Level        int
+		MinSize      int      `gcfg:"min-size"`
+		ContentTypes []string `gcfg:"content-type"`
+	}
 	Static struct {
-		Dir      string
-		Expires  string
-		Prefix   string
-		Index    string
-		FileList bool `gcfg:"file-list"`
+		Dir              string
+		Expires          string
+		Prefix           string
+		Index            string
+		FileList         bool   `gcfg:"file-list"`
+		FileListTemplate string `gcfg:"file-list-template"`
+		Fingerprint      bool
+		Manifest         string
+		ContentETag      bool `gcfg:"content-etag"`
+	}
+	ETag struct {
+		MaxSize int `gcfg:"max-size"`
+	}
+	Cache struct {
+		TTL                  string
+		StaleWhileRevalidate string   `gcfg:"stale-while-revalidate"`
+		MaxSize              int64    `gcfg:"max-size"`
+		VaryHeaders          []string `gcfg:"vary-header"`
+		Language             bool
 	}
 	Session struct {
 		Dir             string
 		Secret          string
 		Cipher          string   // optional: 16, 24 or 32 bytes, base64 encoded
+		OldSecrets      []string `gcfg:"old-secret"`
+		OldCiphers      []string `gcfg:"old-cipher"`
 		MaxAge          string   `gcfg:"max-age"`
+		RefreshInterval string   `gcfg:"refresh-interval"`
+		IdleTimeout     string   `gcfg:"idle-timeout"`
+		AbsoluteTimeout string   `gcfg:"absolute-timeout"`
+		LockTimeout     string   `gcfg:"lock-timeout"`
 		CleanupInterval string   `gcfg:"cleanup-interval"`
 		CleanupMaxAge   string   `gcfg:"cleanup-max-age"`
 		IgnoreURLPrefix []string `gcfg:"ignore-url-prefix"`
+		CookieName      string   `gcfg:"cookie-name"`
+		CookieVersion   int      `gcfg:"cookie-version"`
+		Domain          string
+		Path            string
+		Secure          string // true, false or auto
+		HttpOnly        bool   `gcfg:"http-only"`
+		SameSite        string `gcfg:"same-site"` // lax, strict or none
+		Store           string // file, redis or cookie
+		Codec           string // gob, json or msgpack
+		RedisNetwork    string `gcfg:"redis-network"`
+		RedisAddress    string `gcfg:"redis-address"`
+		RedisPassword   string `gcfg:"redis-password"`
+		RedisDB         int    `gcfg:"redis-db"`
+		RedisPrefix     string `gcfg:"redis-prefix"`
+		RedisMaxIdle    int    `gcfg:"redis-max-idle"`
+	}
+	CORS struct {
+		AllowedOrigins   []string `gcfg:"origin"`
+		AllowedMethods   []string `gcfg:"method"`
+		AllowedHeaders   []string `gcfg:"header"`
+		ExposedHeaders   []string `gcfg:"exposed-header"`
+		AllowCredentials bool     `gcfg:"credentials"`
+		MaxAge           string   `gcfg:"max-age"`
+	}
+	CSRF struct {
+		FieldName       string `gcfg:"field-name"`
+		HeaderName      string `gcfg:"header-name"`
+		CookieName      string `gcfg:"cookie-name"`
+		Domain          string
+		Path            string
+		Secure          string   // true, false or auto
+		ExemptRoutes    []string `gcfg:"exempt-route"`
+		ExemptURLPrefix []string `gcfg:"exempt-url-prefix"`
 	}
 	I18n struct {
 		Dir              string
@@ -105,6 +164,19 @@ func ParseConfig(cfg ...string) (Config, error) {
 	return c, nil
 }
 
+// UsesDefaultSessionSecret returns true if the session secret is the one
+// provided by the default configuration. Such a secret is public, and
+// should never be used in production.
+func (c Config) UsesDefaultSessionSecret() bool {
+	def, err := defaultConfig()
+
+	if err != nil {
+		return false
+	}
+
+	return c.Session.Secret == def.Session.Secret
+}
+
 func defaultConfig() (Config, error) {
 	var def Config
 
@@ -139,16 +211,46 @@ var DefaultCfg string = `
 	middleware = Context
 	middleware = Error # should always be the last one wrapping middleware
 
+[gzip]
+	level = 0 # the default level of each encoding
+	min-size = 1024
+
 [static]
 	dir = static
 	expires = 5m # 5 minutes
 
 [session]
+	store = file
+	codec = gob
 	dir = session
 	secret = ___aVerySecr3tK3y&*7h4t5h0u1dR34l1yChaNg3!_=-
 	max-age = 360h # 15 days
+	refresh-interval = 1h # 1 hour
+	idle-timeout = # defaults to max-age
+	absolute-timeout = # unlimited
+	lock-timeout = # no locking
 	cleanup-interval = 1h # 1 hour
 	cleanup-max-age = 360h # 15 days
+	cookie-name = session
+	cookie-version = 1 # 2 encrypts the whole cookie with AES-GCM
+	secure = auto
+	http-only = true
+	same-site = lax
+	redis-address = 127.0.0.1:6379
+	redis-prefix = session:
+	redis-max-idle = 10
+
+[cache]
+	ttl = 0 # only responses with an explicit max-age are cached
+
+[cors]
+	max-age = 10m # 10 minutes
+
+[csrf]
+	field-name = csrf_token
+	header-name = X-CSRF-Token
+	cookie-name = csrf_token # used when there is no session
+	secure = auto
 
 [i18n]
 	dir = locale
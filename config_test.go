@@ -120,3 +120,23 @@ var conf = `
     language = fr
     language = de
 `
+
+func TestConfigDefaultSessionSecret(t *testing.T) {
+	c, err := ParseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.UsesDefaultSessionSecret() {
+		t.Fatalf("Expected the default session secret to be detected\n")
+	}
+
+	c, err = ParseConfig("[session]\nsecret = changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.UsesDefaultSessionSecret() {
+		t.Fatalf("Expected the session secret to be changed\n")
+	}
+}
@@ -0,0 +1,399 @@
+package context
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// A Codec serializes the session values. Each codec has a unique ID, which
+// is stored along with the encoded data, so that the data may be decoded
+// even after the session codec has been changed.
+type Codec interface {
+	ID() byte
+	Marshal(values SessionValues) ([]byte, error)
+	Unmarshal(data []byte) (SessionValues, error)
+}
+
+// GobCodec encodes the session values using encoding/gob. All custom value
+// types have to be registered, either using RegisterType, or gob.Register.
+// It is the default session codec.
+type GobCodec struct{}
+
+/*
+JSONCodec encodes the session values as JSON. Since JSON is unable to
+represent most Go types, each value that isn't a string, bool or float64 is
+stored along with the name of its type. Custom types have to be registered
+using RegisterType, and are encoded using encoding/json. Maps with
+interface keys, such as the FlashValues, are stored as a list of key-value
+pairs.
+*/
+type JSONCodec struct{}
+
+// ErrUnknownCodec is returned when the session data has been encoded with
+// a codec that hasn't been registered.
+var ErrUnknownCodec = errors.New("Unknown session codec")
+
+// The header of the session data, followed by the codec ID. Data without
+// it has been written before codecs were introduced, and is always gob.
+var codecHeader = []byte{0, 'w', 'f'}
+
+var (
+	codecMutex  sync.RWMutex
+	codecNames  = map[string]Codec{}
+	codecIDs    = map[byte]Codec{}
+	typeMutex   sync.RWMutex
+	typesByName = map[string]reflect.Type{}
+	namesByType = map[reflect.Type]string{}
+)
+
+type codecData struct {
+	Name       string
+	MaxAge     time.Duration
+	CookieName string
+	Created    time.Time
+	LastSeen   time.Time
+	User       string
+	IP         string
+	UserAgent  string
+	Values     []byte
+}
+
+type jsonValue struct {
+	Type  string          `json:"t,omitempty"`
+	Value json.RawMessage `json:"v"`
+}
+
+type jsonPair struct {
+	Key   jsonValue `json:"k"`
+	Value jsonValue `json:"v"`
+}
+
+func init() {
+	RegisterCodec("gob", GobCodec{})
+	RegisterCodec("json", JSONCodec{})
+	RegisterCodec("msgpack", MsgpackCodec{})
+
+	for _, v := range []interface{}{
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0), "", false, []byte(nil),
+		time.Time{}, time.Duration(0),
+		[]interface{}(nil), []string(nil), []int(nil),
+		map[string]interface{}(nil), map[string]string(nil),
+		map[interface{}]interface{}(nil),
+	} {
+		RegisterType(reflect.TypeOf(v).String(), v)
+	}
+
+	RegisterType("webfw.SessionValues", SessionValues{})
+	RegisterType("webfw.FlashValues", FlashValues{})
+	RegisterType("webfw.contextKey", contextKey(""))
+}
+
+// RegisterCodec makes a codec available under the given name, so that it
+// may be selected using the session configuration.
+func RegisterCodec(name string, codec Codec) {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+
+	if c, ok := codecIDs[codec.ID()]; ok && c != codec {
+		panic(fmt.Sprintf("Duplicate session codec ID %d", codec.ID()))
+	}
+
+	codecNames[name] = codec
+	codecIDs[codec.ID()] = codec
+}
+
+// GetCodec returns the codec registered under the given name.
+func GetCodec(name string) (Codec, bool) {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+
+	codec, ok := codecNames[name]
+
+	return codec, ok
+}
+
+// RegisterType records the type of the value under the given name, so that
+// session values of that type may be encoded and decoded by the codecs. The
+// type is registered with encoding/gob as well.
+func RegisterType(name string, value interface{}) {
+	registerType(name, value)
+	gob.Register(value)
+}
+
+func registerType(name string, value interface{}) {
+	typeMutex.Lock()
+	defer typeMutex.Unlock()
+
+	t := reflect.TypeOf(value)
+	if other, ok := typesByName[name]; ok && other != t {
+		panic(fmt.Sprintf("Session value type name '%s' is already registered for %s", name, other))
+	}
+
+	typesByName[name] = t
+	namesByType[t] = name
+}
+
+func typeName(t reflect.Type) (string, error) {
+	typeMutex.RLock()
+	defer typeMutex.RUnlock()
+
+	if name, ok := namesByType[t]; ok {
+		return name, nil
+	}
+
+	return "", fmt.Errorf("Session value type %s is not registered", t)
+}
+
+func typeByName(name string) (reflect.Type, error) {
+	typeMutex.RLock()
+	defer typeMutex.RUnlock()
+
+	if t, ok := typesByName[name]; ok {
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("Session value type '%s' is not registered", name)
+}
+
+// encodeData serializes the session data with the given codec, prefixed
+// by the codec header.
+func encodeData(codec Codec, data *fileData) ([]byte, error) {
+	values, err := codec.Marshal(data.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(append(append([]byte{}, codecHeader...), codec.ID()))
+	if err := gob.NewEncoder(buf).Encode(codecData{
+		Name:       data.Name,
+		MaxAge:     data.MaxAge,
+		CookieName: data.CookieName,
+		Created:    data.Created,
+		LastSeen:   data.LastSeen,
+		User:       data.User,
+		IP:         data.IP,
+		UserAgent:  data.UserAgent,
+		Values:     values,
+	}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeData deserializes the session data, returning the codec it has
+// been encoded with. Data without the codec header is decoded as gob. If
+// values is false, only the session metadata is decoded, when possible.
+func decodeData(b []byte, values bool) (*fileData, Codec, error) {
+	data := &fileData{}
+
+	if !bytes.HasPrefix(b, codecHeader) || len(b) == len(codecHeader) {
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(data); err != nil {
+			return nil, nil, err
+		}
+
+		return data, nil, nil
+	}
+
+	codecMutex.RLock()
+	codec, ok := codecIDs[b[len(codecHeader)]]
+	codecMutex.RUnlock()
+
+	if !ok {
+		return nil, nil, ErrUnknownCodec
+	}
+
+	cd := codecData{}
+	if err := gob.NewDecoder(bytes.NewReader(b[len(codecHeader)+1:])).Decode(&cd); err != nil {
+		return nil, nil, err
+	}
+
+	if values {
+		var err error
+		if data.Values, err = codec.Unmarshal(cd.Values); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	data.Name = cd.Name
+	data.MaxAge = cd.MaxAge
+	data.CookieName = cd.CookieName
+	data.Created = cd.Created
+	data.LastSeen = cd.LastSeen
+	data.User = cd.User
+	data.IP = cd.IP
+	data.UserAgent = cd.UserAgent
+
+	return data, codec, nil
+}
+
+func (c GobCodec) ID() byte {
+	return 1
+}
+
+func (c GobCodec) Marshal(values SessionValues) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := gob.NewEncoder(buf).Encode(values); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c GobCodec) Unmarshal(data []byte) (SessionValues, error) {
+	values := SessionValues{}
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (c JSONCodec) ID() byte {
+	return 2
+}
+
+func (c JSONCodec) Marshal(values SessionValues) ([]byte, error) {
+	v, err := jsonEncodeValue(reflect.ValueOf(values))
+	if err != nil {
+		return nil, err
+	}
+
+	return v.Value, nil
+}
+
+func (c JSONCodec) Unmarshal(data []byte) (SessionValues, error) {
+	v, err := jsonDecodeValue(reflect.TypeOf(SessionValues{}), data)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.Interface().(SessionValues), nil
+}
+
+func jsonEncodeInterface(v interface{}) (jsonValue, error) {
+	switch v.(type) {
+	case nil, string, bool, float64:
+		b, err := json.Marshal(v)
+
+		return jsonValue{Value: b}, err
+	}
+
+	rv := reflect.ValueOf(v)
+
+	name, err := typeName(rv.Type())
+	if err != nil {
+		return jsonValue{}, err
+	}
+
+	jv, err := jsonEncodeValue(rv)
+	jv.Type = name
+
+	return jv, err
+}
+
+func jsonEncodeValue(rv reflect.Value) (jsonValue, error) {
+	if isInterfaceMap(rv.Type()) {
+		pairs := make([]jsonPair, 0, rv.Len())
+
+		for _, k := range rv.MapKeys() {
+			key, err := jsonEncodeInterface(k.Interface())
+			if err != nil {
+				return jsonValue{}, err
+			}
+
+			value, err := jsonEncodeInterface(rv.MapIndex(k).Interface())
+			if err != nil {
+				return jsonValue{}, err
+			}
+
+			pairs = append(pairs, jsonPair{Key: key, Value: value})
+		}
+
+		b, err := json.Marshal(pairs)
+
+		return jsonValue{Value: b}, err
+	}
+
+	b, err := json.Marshal(rv.Interface())
+
+	return jsonValue{Value: b}, err
+}
+
+func jsonDecodeInterface(jv jsonValue) (interface{}, error) {
+	if jv.Type == "" {
+		var v interface{}
+		err := json.Unmarshal(jv.Value, &v)
+
+		return v, err
+	}
+
+	t, err := typeByName(jv.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	rv, err := jsonDecodeValue(t, jv.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv.Interface(), nil
+}
+
+func jsonDecodeValue(t reflect.Type, data []byte) (reflect.Value, error) {
+	if isInterfaceMap(t) {
+		var pairs []jsonPair
+		if err := json.Unmarshal(data, &pairs); err != nil {
+			return reflect.Value{}, err
+		}
+
+		m := reflect.MakeMap(t)
+		for _, p := range pairs {
+			key, err := jsonDecodeInterface(p.Key)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+
+			value, err := jsonDecodeInterface(p.Value)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+
+			m.SetMapIndex(reflect.ValueOf(key), interfaceValue(value, t.Elem()))
+		}
+
+		return m, nil
+	}
+
+	rv := reflect.New(t)
+	if err := json.Unmarshal(data, rv.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+
+	return rv.Elem(), nil
+}
+
+func isInterfaceMap(t reflect.Type) bool {
+	return t.Kind() == reflect.Map && t.Key().Kind() == reflect.Interface
+}
+
+// interfaceValue returns a reflect.Value for v, which may be stored in a
+// map with elements of type t, even if v is nil.
+func interfaceValue(v interface{}, t reflect.Type) reflect.Value {
+	if v == nil {
+		return reflect.Zero(t)
+	}
+
+	return reflect.ValueOf(v)
+}
@@ -0,0 +1,203 @@
+package context
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type codecUser struct {
+	Name   string
+	Age    int
+	Tags   []string
+	Joined time.Time
+	Extra  interface{}
+}
+
+func init() {
+	RegisterType("context.codecUser", codecUser{})
+}
+
+func TestCodecs(t *testing.T) {
+	joined := time.Date(2014, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	values := SessionValues{
+		"string":                  "foo",
+		"int":                     42,
+		"int64":                   int64(-1 << 40),
+		"uint8":                   uint8(200),
+		"float":                   3.5,
+		"float32":                 float32(1.25),
+		"bool":                    true,
+		"bytes":                   []byte("raw"),
+		"nil":                     nil,
+		"time":                    joined,
+		"duration":                time.Minute,
+		"strings":                 []string{"a", "b"},
+		"user":                    codecUser{Name: "John", Age: 30, Tags: []string{"admin"}, Joined: joined, Extra: 5},
+		7:                         "int key",
+		contextKey("flashValues"): FlashValues{"notice": "saved"},
+	}
+
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}, MsgpackCodec{}} {
+		b, err := codec.Marshal(values)
+		if err != nil {
+			t.Fatalf("%T: %v\n", codec, err)
+		}
+
+		decoded, err := codec.Unmarshal(b)
+		if err != nil {
+			t.Fatalf("%T: %v\n", codec, err)
+		}
+
+		for k, v := range values {
+			d, ok := decoded[k]
+			if !ok {
+				t.Fatalf("%T: Expected key '%v' to be decoded\n", codec, k)
+			}
+
+			if tm, ok := v.(time.Time); ok {
+				if !tm.Equal(d.(time.Time)) {
+					t.Fatalf("%T: Expected '%v', got '%v'\n", codec, v, d)
+				}
+				continue
+			}
+
+			if u, ok := v.(codecUser); ok {
+				du := d.(codecUser)
+				if !u.Joined.Equal(du.Joined) {
+					t.Fatalf("%T: Expected '%v', got '%v'\n", codec, u.Joined, du.Joined)
+				}
+				u.Joined, du.Joined = time.Time{}, time.Time{}
+
+				if _, ok := codec.(JSONCodec); ok {
+					// The interface fields of structs are decoded as
+					// generic JSON values
+					u.Extra = float64(5)
+				}
+
+				v, d = u, du
+			}
+
+			if !reflect.DeepEqual(v, d) {
+				t.Fatalf("%T: Expected '%#v' for '%v', got '%#v'\n", codec, v, k, d)
+			}
+		}
+	}
+
+	type unregistered struct{}
+
+	for _, codec := range []Codec{JSONCodec{}, MsgpackCodec{}} {
+		if _, err := codec.Marshal(SessionValues{"foo": unregistered{}}); err == nil {
+			t.Fatalf("%T: Expected an error for an unregistered type\n", codec)
+		}
+	}
+
+	if _, err := (MsgpackCodec{}).Unmarshal([]byte{0x81, 0xa1}); err == nil {
+		t.Fatalf("Expected an error for truncated data\n")
+	}
+
+	if c, ok := GetCodec("msgpack"); !ok || c.ID() != (MsgpackCodec{}).ID() {
+		t.Fatalf("Expected the msgpack codec to be registered, got %v\n", c)
+	}
+}
+
+func TestSessionCodecMigration(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "/sessions/")
+
+	// Data written before the codecs were introduced
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(&fileData{
+		Name:   "test10",
+		MaxAge: time.Hour,
+		Values: SessionValues{"foo": "bar"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewFileStore(root)
+	if err := store.Set("test10", buf.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSession(secret, nil, root)
+	s.SetName("test10")
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := rec.Header().Get("Set-Cookie")
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+	// Restore the legacy data, since the Write above overwrote it
+	if err := store.Set("test10", buf.Bytes(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewSession(secret, nil, root)
+	s.(StoreSession).SetCodec(JSONCodec{})
+	s.(StoreSession).SetRefreshThreshold(time.Hour)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+		t.Fatalf("Expected value for `foo` to be 'bar', got '%v'\n", v)
+	}
+
+	if !s.(StoreSession).Modified() {
+		t.Fatalf("Expected legacy session data to be rewritten\n")
+	}
+
+	if err := s.Write(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := store.Get("test10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(b, append(codecHeader, JSONCodec{}.ID())) {
+		t.Fatalf("Expected the data to be written using the JSON codec, got %q\n", b)
+	}
+
+	s = NewSession(secret, nil, root)
+	s.(StoreSession).SetCodec(JSONCodec{})
+	s.(StoreSession).SetRefreshThreshold(time.Hour)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.(StoreSession).Modified() {
+		t.Fatalf("Expected the migrated session to not be modified\n")
+	}
+
+	s = NewSession(secret, nil, root)
+	s.(StoreSession).SetCodec(MsgpackCodec{})
+	s.(StoreSession).SetRefreshThreshold(time.Hour)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+		t.Fatalf("Expected value for `foo` to be 'bar', got '%v'\n", v)
+	}
+
+	if !s.(StoreSession).Modified() {
+		t.Fatalf("Expected the session to be rewritten with the new codec\n")
+	}
+}
@@ -0,0 +1,239 @@
+package context
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/urandom/webfw/util"
+)
+
+var (
+	ErrCookieTooLarge = errors.New("Session data is too large to be stored in cookies")
+)
+
+const (
+	// The maximum length of a single cookie value. Browsers limit a
+	// cookie, including its attributes, to around 4KB.
+	cookieChunkSize = 3800
+	// The maximum number of cookies a session may be split into.
+	maxCookieChunks = 5
+)
+
+/*
+The cookieSession is a session which doesn't keep its data on the server.
+Instead, the session data, along with its name and the date of the last
+write, is serialized using encoding/gob, encrypted and authenticated using
+AES-GCM, and stored directly in the session cookie. If the encoded data is
+larger than what a single cookie can hold, it will be split into
+multiple cookies, named after the session cookie and a numeric suffix. If
+the data doesn't fit in the maximum number of allowed cookies, Write will
+return ErrCookieTooLarge.
+
+The encryption key is the session cipher, if given. Otherwise, a key is
+derived from the session secret. Any old ciphers or secrets are used when
+decrypting the cookies.
+*/
+type cookieSession struct {
+	*session
+
+	chunks int
+}
+
+// The session data is stored in the Encoded field, using the session
+// codec. The Data field is only read, when decoding cookies written before
+// codecs were introduced.
+type cookieData struct {
+	Date    int64
+	Data    fileData
+	Encoded []byte
+}
+
+// NewCookieSession creates a new session object, whose data is stored in
+// the cookie itself. The path is ignored, it is only present so that the
+// function may be used as a SessionGenerator.
+func NewCookieSession(secret, cipherKey []byte, path string) Session {
+	return &cookieSession{session: NewSession(secret, cipherKey, path).(*session)}
+}
+
+// Read decrypts the session data from the session cookies. It may return
+// a generic error if the cookies have been tampered with, or one of the
+// following:
+//  - ErrExpired - if it has exceeded its idle or absolute timeout
+//  - ErrCookieNotExist - if a session cookie doesn't exist
+func (s *cookieSession) Read(r *http.Request, c Context) error {
+	s.setClient(r)
+
+	buf := util.BufferPool.GetBuffer()
+	defer util.BufferPool.Put(buf)
+
+	s.chunks = 0
+	for i := 0; i < maxCookieChunks; i++ {
+		cookie, err := r.Cookie(s.chunkName(i))
+		if err != nil {
+			break
+		}
+
+		buf.WriteString(cookie.Value)
+		s.chunks++
+	}
+
+	if s.chunks == 0 {
+		return ErrCookieNotExist
+	}
+
+	encrypted, err := base64.URLEncoding.DecodeString(buf.String())
+	if err != nil {
+		return err
+	}
+
+	var plain []byte
+	for i, aead := range s.aeads {
+		size := aead.NonceSize()
+		if len(encrypted) < size {
+			return errors.New("Invalid session cookie data")
+		}
+
+		if plain, err = aead.Open(nil, encrypted[:size], encrypted[size:], []byte(s.cookieName)); err == nil {
+			s.stale = i > 0
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	data := cookieData{}
+	if err := gob.NewDecoder(bytes.NewReader(plain)).Decode(&data); err != nil {
+		return err
+	}
+
+	if len(data.Encoded) > 0 {
+		d, err := s.decodeData(data.Encoded)
+		if err != nil {
+			return err
+		}
+
+		data.Data = *d
+	} else {
+		s.stale = true
+	}
+
+	s.fromData(&data.Data)
+	s.date = data.Date
+
+	if s.expired(data.Date) {
+		s.expire(ExpiredIdle)
+		return ErrExpired
+	} else if s.absoluteExpired() {
+		s.expire(ExpiredAbsolute)
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// Write encrypts the session data and stores it in one or more session
+// cookies. Any cookies left over from a previously larger session are
+// removed.
+func (s *cookieSession) Write(w http.ResponseWriter) error {
+	if s.isDestroyed() {
+		if w != nil {
+			for i := 0; i < s.chunks || i == 0; i++ {
+				http.SetCookie(w, s.newExpiredCookie(s.chunkName(i)))
+			}
+		}
+
+		s.chunks = 0
+		s.written(0)
+
+		return nil
+	}
+
+	buf := util.BufferPool.GetBuffer()
+	defer util.BufferPool.Put(buf)
+
+	s.touch()
+
+	encoded, err := encodeData(s.Codec(), s.toData())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if err := gob.NewEncoder(buf).Encode(cookieData{Date: now, Encoded: encoded}); err != nil {
+		return err
+	}
+
+	aead := s.aeads[0]
+	nonce, err := randomData(aead.NonceSize())
+	if err != nil {
+		return err
+	}
+
+	value := base64.URLEncoding.EncodeToString(
+		aead.Seal(nonce, nonce, buf.Bytes(), []byte(s.cookieName)))
+
+	var chunks []string
+	for len(value) > cookieChunkSize {
+		chunks = append(chunks, value[:cookieChunkSize])
+		value = value[cookieChunkSize:]
+	}
+	chunks = append(chunks, value)
+
+	if len(chunks) > maxCookieChunks {
+		return ErrCookieTooLarge
+	}
+
+	if w != nil {
+		for i, chunk := range chunks {
+			http.SetCookie(w, s.newCookie(s.chunkName(i), chunk, now))
+		}
+
+		for i := len(chunks); i < s.chunks; i++ {
+			http.SetCookie(w, s.newExpiredCookie(s.chunkName(i)))
+		}
+	}
+
+	s.chunks = len(chunks)
+	s.written(now)
+
+	return nil
+}
+
+// Regenerate gives the session a new name, while keeping its values.
+func (s *cookieSession) Regenerate() error {
+	s.regenerate()
+
+	return nil
+}
+
+// Destroy removes all values of the session. On the next Write, all
+// session cookies will be expired.
+func (s *cookieSession) Destroy() error {
+	s.destroy()
+
+	return nil
+}
+
+// Store returns nil, since the session data is kept in the cookie.
+func (s *cookieSession) Store() SessionStore {
+	return nil
+}
+
+// SetStore does nothing, since the session data is kept in the cookie.
+func (s *cookieSession) SetStore(store SessionStore) {
+}
+
+func (s *cookieSession) chunkName(i int) string {
+	if i == 0 {
+		return s.cookieName
+	}
+
+	return fmt.Sprintf("%s-%d", s.cookieName, i)
+}
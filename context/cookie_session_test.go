@@ -0,0 +1,141 @@
+package context
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCookieSession(t *testing.T) {
+	s := NewCookieSession(secret, nil, "")
+	s.SetName("cookie1")
+	s.Set("foo", "bar")
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a single cookie, got %d\n", len(cookies))
+	}
+
+	if strings.Contains(cookies[0].Value, "cookie1") {
+		t.Fatalf("Expected the session name to be encrypted, got '%s'\n", cookies[0].Value)
+	}
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	addCookies(r, cookies)
+
+	s = NewCookieSession(secret, nil, "")
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Name() != "cookie1" {
+		t.Fatalf("Expected the session name to be 'cookie1', got '%s'\n", s.Name())
+	}
+
+	if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+		t.Fatalf("Expected value for `foo` to be 'bar', got '%v'\n", v)
+	}
+
+	s = NewCookieSession([]byte("other"), nil, "")
+	if err := s.Read(r, nil); err == nil {
+		t.Fatalf("Expected an error when using a different secret\n")
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080", nil)
+	s = NewCookieSession(secret, nil, "")
+	if err := s.Read(r, nil); err != ErrCookieNotExist {
+		t.Fatalf("Expected a missing cookie error, got '%v'\n", err)
+	}
+}
+
+func TestCookieSessionChunks(t *testing.T) {
+	s := NewCookieSession(secret, nil, "")
+	s.SetName("cookie2")
+	s.Set("foo", strings.Repeat("a", 6000))
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) < 2 {
+		t.Fatalf("Expected the session to be split into multiple cookies, got %d\n", len(cookies))
+	}
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	addCookies(r, cookies)
+
+	s = NewCookieSession(secret, nil, "")
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := s.Get("foo"); !ok || len(v.(string)) != 6000 {
+		t.Fatalf("Expected the large value to be restored\n")
+	}
+
+	s.Set("foo", "bar")
+
+	rec = httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := 0
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			expired++
+		}
+	}
+
+	if expired != len(cookies)-1 {
+		t.Fatalf("Expected %d leftover cookies to be expired, got %d\n", len(cookies)-1, expired)
+	}
+
+	s.Set("foo", strings.Repeat("a", 40000))
+	if err := s.Write(httptest.NewRecorder()); err != ErrCookieTooLarge {
+		t.Fatalf("Expected a too large error, got '%v'\n", err)
+	}
+}
+
+func addCookies(r *http.Request, cookies []*http.Cookie) {
+	for _, c := range cookies {
+		if c.MaxAge >= 0 {
+			r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+		}
+	}
+}
+
+func TestCookieSessionDestroy(t *testing.T) {
+	s := NewCookieSession(secret, nil, "")
+	s.SetName("cookie3")
+	s.Set("foo", "bar")
+
+	if err := s.(RegenerableSession).Regenerate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Name() == "cookie3" {
+		t.Fatalf("Expected the session to have a new name\n")
+	}
+
+	if err := s.(RegenerableSession).Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("Expected an expired session cookie, got %v\n", cookies)
+	}
+}
@@ -0,0 +1,76 @@
+package context
+
+import "encoding/json"
+
+// FlashCategory is the category of a flash message, such as FlashSuccess.
+type FlashCategory string
+
+const (
+	FlashSuccess FlashCategory = "success"
+	FlashInfo    FlashCategory = "info"
+	FlashWarning FlashCategory = "warning"
+	FlashError   FlashCategory = "error"
+)
+
+/*
+A FlashMessage is a typed flash value, shown to the user once, usually on
+the next request. The Message may be either the text itself, or an i18n
+message id. The Args have the same meaning as the trailing arguments of the
+"__" template function: an optional count, followed by key-value tuples,
+used when translating or evaluating the message.
+*/
+type FlashMessage struct {
+	Category FlashCategory
+	Message  string
+	Args     []interface{}
+}
+
+type jsonFlashMessage struct {
+	Category FlashCategory `json:"category"`
+	Message  string        `json:"message"`
+	Args     []jsonValue   `json:"args,omitempty"`
+}
+
+func init() {
+	RegisterType("webfw.FlashMessages", []FlashMessage(nil))
+}
+
+// MarshalJSON encodes the message, keeping the type of its arguments, so
+// that it may be stored using the JSONCodec.
+func (m FlashMessage) MarshalJSON() ([]byte, error) {
+	jm := jsonFlashMessage{Category: m.Category, Message: m.Message}
+
+	for _, arg := range m.Args {
+		v, err := jsonEncodeInterface(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		jm.Args = append(jm.Args, v)
+	}
+
+	return json.Marshal(jm)
+}
+
+// UnmarshalJSON decodes a message, encoded using MarshalJSON.
+func (m *FlashMessage) UnmarshalJSON(b []byte) error {
+	jm := jsonFlashMessage{}
+	if err := json.Unmarshal(b, &jm); err != nil {
+		return err
+	}
+
+	m.Category = jm.Category
+	m.Message = jm.Message
+	m.Args = nil
+
+	for _, v := range jm.Args {
+		arg, err := jsonDecodeInterface(v)
+		if err != nil {
+			return err
+		}
+
+		m.Args = append(m.Args, arg)
+	}
+
+	return nil
+}
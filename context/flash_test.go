@@ -0,0 +1,58 @@
+package context
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSessionFlashMessages(t *testing.T) {
+	s := NewSession(secret, nil, "")
+
+	if len(s.(FlashSession).Flashes()) != 0 {
+		t.Fatalf("Expected no flash messages\n")
+	}
+
+	s.(FlashSession).AddFlash(FlashSuccess, "saved", "Name", "foo")
+	s.(FlashSession).AddFlash(FlashError, "failed")
+	s.(FlashSession).AddFlash(FlashSuccess, "items_saved", 2)
+
+	if messages := s.(FlashSession).PeekFlashes(FlashError); len(messages) != 1 || messages[0].Message != "failed" {
+		t.Fatalf("Expected a single error message, got %v\n", messages)
+	}
+
+	messages := s.(FlashSession).Flashes(FlashSuccess)
+	if len(messages) != 2 || messages[0].Message != "saved" || messages[1].Message != "items_saved" {
+		t.Fatalf("Expected two ordered success messages, got %v\n", messages)
+	}
+
+	if !reflect.DeepEqual(messages[0].Args, []interface{}{"Name", "foo"}) {
+		t.Fatalf("Unexpected message arguments %v\n", messages[0].Args)
+	}
+
+	if messages := s.(FlashSession).Flashes(); len(messages) != 1 || messages[0].Category != FlashError {
+		t.Fatalf("Expected the remaining error message, got %v\n", messages)
+	}
+
+	if _, ok := s.Get(contextKey("flashMessages")); ok {
+		t.Fatalf("Expected the consumed messages to be removed\n")
+	}
+
+	s.(FlashSession).AddFlash(FlashInfo, "count", 3, "Name", "foo")
+	values := s.GetAll()
+
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}, MsgpackCodec{}} {
+		b, err := codec.Marshal(values)
+		if err != nil {
+			t.Fatalf("%T: %v\n", codec, err)
+		}
+
+		decoded, err := codec.Unmarshal(b)
+		if err != nil {
+			t.Fatalf("%T: %v\n", codec, err)
+		}
+
+		if !reflect.DeepEqual(values, decoded) {
+			t.Fatalf("%T: Expected %v, got %v\n", codec, values, decoded)
+		}
+	}
+}
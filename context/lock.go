@@ -0,0 +1,77 @@
+package context
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// A SessionLocker is a session store, which is able to lock a session, so
+// that concurrent requests using the same session don't overwrite each
+// other's changes. The Lock method waits at most for the given timeout,
+// returning ErrLockTimeout if the lock couldn't be acquired. Otherwise, it
+// returns a function that releases the lock.
+type SessionLocker interface {
+	Lock(name string, timeout time.Duration) (func() error, error)
+}
+
+// ErrLockTimeout is returned when a session lock couldn't be acquired
+// within the given timeout.
+var ErrLockTimeout = errors.New("Timed out waiting for the session lock")
+
+// processLocks holds the locks of sessions, kept by the current process.
+var processLocks = &keyLocks{locks: map[string]*keyLock{}}
+
+type keyLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// lock acquires the lock for the given key, waiting at most for the
+// timeout. The lock entries are removed once no one holds or waits for
+// them.
+func (kl *keyLocks) lock(key string, timeout time.Duration) (func() error, error) {
+	kl.mutex.Lock()
+	l, ok := kl.locks[key]
+	if !ok {
+		l = &keyLock{ch: make(chan struct{}, 1)}
+		kl.locks[key] = l
+	}
+	l.refs++
+	kl.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case l.ch <- struct{}{}:
+	case <-timer.C:
+		kl.release(key, l)
+		return nil, ErrLockTimeout
+	}
+
+	var once sync.Once
+	return func() error {
+		once.Do(func() {
+			<-l.ch
+			kl.release(key, l)
+		})
+
+		return nil
+	}, nil
+}
+
+func (kl *keyLocks) release(key string, l *keyLock) {
+	kl.mutex.Lock()
+	defer kl.mutex.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(kl.locks, key)
+	}
+}
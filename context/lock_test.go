@@ -0,0 +1,61 @@
+package context
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStoreLock(t *testing.T) {
+	fs := NewFileStore(os.TempDir())
+
+	unlock, err := fs.Lock("lock1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Lock("lock1", 10*time.Millisecond); err != ErrLockTimeout {
+		t.Fatalf("Expected a lock timeout, got '%v'\n", err)
+	}
+
+	other, err := fs.Lock("lock2", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected other sessions to not be locked, got '%v'\n", err)
+	}
+	other()
+
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			unlock, err := fs.Lock("lock1", time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+
+			c := counter
+			time.Sleep(time.Millisecond)
+			counter = c + 1
+		}()
+	}
+
+	unlock()
+	wg.Wait()
+
+	if counter != 10 {
+		t.Fatalf("Expected the counter to be 10, got %d\n", counter)
+	}
+
+	processLocks.mutex.Lock()
+	defer processLocks.mutex.Unlock()
+
+	if len(processLocks.locks) != 0 {
+		t.Fatalf("Expected all lock entries to be removed, got %d\n", len(processLocks.locks))
+	}
+}
@@ -0,0 +1,140 @@
+package context
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrNoIndex is returned by the SessionManager, when its store is unable
+// to index the sessions of each user.
+var ErrNoIndex = errors.New("The session store doesn't support user indexes")
+
+/*
+A SessionManager provides administrative access to the sessions in a
+store. Sessions are associated with users through the SetUser method of a
+UserSession, and may then be listed and revoked per user, if the store
+implements the SessionIndex interface. Only the session metadata is exposed, never the
+session values.
+
+Revoking a session removes its data from the store. The client will still
+send the old session cookie, but it will no longer refer to any values,
+thus effectively logging the user out.
+*/
+type SessionManager struct {
+	Store SessionStore
+}
+
+// NewSessionManager creates a manager for the sessions in the given store.
+func NewSessionManager(store SessionStore) SessionManager {
+	return SessionManager{Store: store}
+}
+
+// List returns the metadata of all sessions of the given user, ordered by
+// the time they were last seen, the most recent first. Any index entries
+// of sessions without data are removed.
+func (m SessionManager) List(user string) ([]SessionMetadata, error) {
+	idx, ok := m.Store.(SessionIndex)
+	if !ok {
+		return nil, ErrNoIndex
+	}
+
+	names, err := idx.UserSessions(user)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []SessionMetadata{}
+	for _, name := range names {
+		meta, err := m.Inspect(name)
+
+		if err == ErrNotExist || err == nil && meta.User != user {
+			if err := idx.RemoveUserSession(user, name); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, meta)
+	}
+
+	sort.Sort(byLastSeen(sessions))
+
+	return sessions, nil
+}
+
+// Inspect returns the metadata of the named session. It returns
+// ErrNotExist if the session data isn't in the store.
+func (m SessionManager) Inspect(name string) (SessionMetadata, error) {
+	b, err := m.Store.Get(name)
+	if err != nil {
+		return SessionMetadata{}, err
+	}
+
+	data, _, err := decodeData(b, false)
+	if err != nil {
+		return SessionMetadata{}, err
+	}
+
+	return SessionMetadata{
+		Name:      name,
+		User:      data.User,
+		Created:   data.Created,
+		LastSeen:  data.LastSeen,
+		IP:        data.IP,
+		UserAgent: data.UserAgent,
+	}, nil
+}
+
+// Revoke removes the data of the named session, along with its index
+// entry.
+func (m SessionManager) Revoke(name string) error {
+	meta, err := m.Inspect(name)
+	if err != nil {
+		if err == ErrNotExist {
+			return nil
+		}
+
+		return err
+	}
+
+	if idx, ok := m.Store.(SessionIndex); ok && meta.User != "" {
+		if err := idx.RemoveUserSession(meta.User, name); err != nil {
+			return err
+		}
+	}
+
+	return m.Store.Delete(name)
+}
+
+// RevokeUser removes all sessions of the given user, returning their
+// number.
+func (m SessionManager) RevokeUser(user string) (int, error) {
+	sessions, err := m.List(user)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, meta := range sessions {
+		if err := m.Revoke(meta.Name); err != nil {
+			return i, err
+		}
+	}
+
+	return len(sessions), nil
+}
+
+type byLastSeen []SessionMetadata
+
+func (s byLastSeen) Len() int {
+	return len(s)
+}
+
+func (s byLastSeen) Less(i, j int) bool {
+	return s[i].LastSeen.After(s[j].LastSeen)
+}
+
+func (s byLastSeen) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
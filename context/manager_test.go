@@ -0,0 +1,106 @@
+package context
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionManager(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "/manager-sessions/")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	testSessionManager(t, NewFileStore(root))
+
+	f := newFakeRedis(t)
+	defer f.Close()
+
+	rs := NewRedisStore("tcp", f.Addr(), 2)
+	defer rs.Close()
+
+	testSessionManager(t, rs)
+}
+
+func testSessionManager(t *testing.T, store SessionStore) {
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("User-Agent", "test-agent")
+
+	names := []string{}
+	sessions := []Session{}
+	for i := 0; i < 3; i++ {
+		s := NewSession(secret, nil, "")
+		s.(StoreSession).SetStore(store)
+		s.Read(r, nil)
+		s.SetName(filepath.Base(t.Name()) + string(rune('a'+i)))
+		s.Set("foo", "bar")
+
+		if i < 2 {
+			s.(UserSession).SetUser("john")
+		} else {
+			s.(UserSession).SetUser("jane")
+		}
+
+		if err := s.Write(httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, s.Name())
+		sessions = append(sessions, s)
+	}
+
+	m := NewSessionManager(store)
+
+	if list, err := m.List("john"); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 2 {
+		t.Fatalf("Expected 2 sessions for 'john', got %d\n", len(list))
+	}
+
+	meta, err := m.Inspect(names[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.User != "jane" || meta.IP != "10.0.0.1" || meta.UserAgent != "test-agent" {
+		t.Fatalf("Unexpected session metadata %#v\n", meta)
+	}
+
+	if meta.Created.IsZero() || meta.LastSeen.IsZero() {
+		t.Fatalf("Expected the session times to be set, got %#v\n", meta)
+	}
+
+	if err := m.Revoke(names[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(names[0]); err != ErrNotExist {
+		t.Fatalf("Expected the revoked session data to be removed, got '%v'\n", err)
+	}
+
+	if list, _ := m.List("john"); len(list) != 1 || list[0].Name != names[1] {
+		t.Fatalf("Expected a single session for 'john', got %v\n", list)
+	}
+
+	// Changing the user moves the session to the new user's index
+	sessions[1].(UserSession).SetUser("jane")
+
+	if err := sessions[1].Write(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	if list, _ := m.List("john"); len(list) != 0 {
+		t.Fatalf("Expected no sessions for 'john', got %v\n", list)
+	}
+
+	if n, err := m.RevokeUser("jane"); err != nil || n != 2 {
+		t.Fatalf("Expected 2 revoked sessions, got %d, '%v'\n", n, err)
+	}
+
+	if list, _ := m.List("jane"); len(list) != 0 {
+		t.Fatalf("Expected no sessions for 'jane', got %v\n", list)
+	}
+}
@@ -0,0 +1,696 @@
+package context
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+/*
+MsgpackCodec encodes the session values in a compact binary format, based
+on MessagePack. Values of type string, int, float64, bool and []byte, as
+well as nil, are stored as their MessagePack counterparts. Any other value
+is stored as an extension, holding the name of its type, as registered with
+RegisterType, and the value itself. Structs are stored as maps of their
+exported fields, while types implementing encoding.BinaryMarshaler, such as
+time.Time, are stored as binary data.
+*/
+type MsgpackCodec struct{}
+
+// The MessagePack extension type of values stored with their type name.
+const msgpackTypedExt = 1
+
+// The MessagePack map of session values, and any other map with non-string
+// keys, is decoded as a list of pairs, until the target type is known.
+type msgpackPair struct {
+	key, value interface{}
+}
+
+type msgpackMap []msgpackPair
+
+type msgpackTyped struct {
+	value interface{}
+}
+
+var errMsgpackInvalid = errors.New("Invalid msgpack session data")
+
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+func (c MsgpackCodec) ID() byte {
+	return 3
+}
+
+func (c MsgpackCodec) Marshal(values SessionValues) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := msgpackEncodeValue(buf, reflect.ValueOf(values)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c MsgpackCodec) Unmarshal(data []byte) (SessionValues, error) {
+	r := bytes.NewReader(data)
+
+	v, err := msgpackDecode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Len() > 0 {
+		return nil, errMsgpackInvalid
+	}
+
+	values := SessionValues{}
+	if err := msgpackAssign(reflect.ValueOf(&values).Elem(), v); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func msgpackEncodeInterface(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+		return nil
+	case string, int, float64, bool, []byte:
+		return msgpackEncodeValue(buf, reflect.ValueOf(t))
+	}
+
+	rv := reflect.ValueOf(v)
+
+	name, err := typeName(rv.Type())
+	if err != nil {
+		return err
+	}
+
+	payload := new(bytes.Buffer)
+	msgpackWriteString(payload, name)
+
+	if err := msgpackEncodeValue(payload, rv); err != nil {
+		return err
+	}
+
+	msgpackWriteExt(buf, msgpackTypedExt, payload.Bytes())
+
+	return nil
+}
+
+func msgpackEncodeValue(buf *bytes.Buffer, rv reflect.Value) error {
+	if rv.Type().Implements(binaryMarshalerType) {
+		if rv.Kind() == reflect.Ptr && rv.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+
+		b, err := rv.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		msgpackWriteBinary(buf, b)
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		msgpackWriteInt(buf, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		msgpackWriteUint(buf, rv.Uint())
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(float32(rv.Float())))
+	case reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(rv.Float()))
+	case reflect.String:
+		msgpackWriteString(buf, rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			msgpackWriteBinary(buf, b)
+			return nil
+		}
+
+		msgpackWriteLength(buf, rv.Len(), 0x90, 0xdc)
+		for i := 0; i < rv.Len(); i++ {
+			if err := msgpackEncodeValue(buf, rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if rv.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+
+		msgpackWriteLength(buf, rv.Len(), 0x80, 0xde)
+		for _, k := range rv.MapKeys() {
+			if err := msgpackEncodeValue(buf, k); err != nil {
+				return err
+			}
+
+			if err := msgpackEncodeValue(buf, rv.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := rv.Type()
+
+		fields := []int{}
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" {
+				fields = append(fields, i)
+			}
+		}
+
+		msgpackWriteLength(buf, len(fields), 0x80, 0xde)
+		for _, i := range fields {
+			msgpackWriteString(buf, t.Field(i).Name)
+
+			if err := msgpackEncodeValue(buf, rv.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if rv.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+
+		return msgpackEncodeValue(buf, rv.Elem())
+	case reflect.Interface:
+		if rv.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+
+		return msgpackEncodeInterface(buf, rv.Elem().Interface())
+	default:
+		return fmt.Errorf("Session value type %s cannot be encoded", rv.Type())
+	}
+
+	return nil
+}
+
+func msgpackWriteInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		msgpackWriteUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func msgpackWriteUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u <= 0x7f:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(u))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, u)
+	}
+}
+
+func msgpackWriteString(buf *bytes.Buffer, s string) {
+	if len(s) < 32 {
+		buf.WriteByte(0xa0 | byte(len(s)))
+	} else {
+		msgpackWriteSize(buf, len(s), 0xd9)
+	}
+
+	buf.WriteString(s)
+}
+
+func msgpackWriteBinary(buf *bytes.Buffer, b []byte) {
+	msgpackWriteSize(buf, len(b), 0xc4)
+	buf.Write(b)
+}
+
+func msgpackWriteExt(buf *bytes.Buffer, kind int8, b []byte) {
+	msgpackWriteSize(buf, len(b), 0xc7)
+	buf.WriteByte(byte(kind))
+	buf.Write(b)
+}
+
+// msgpackWriteLength writes the length of an array or a map, using either
+// its fixed format, or the 16 and 32 bit ones that follow the given code.
+func msgpackWriteLength(buf *bytes.Buffer, n int, fixed, code byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fixed | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackWriteSize writes the size of a string, binary or extension, using
+// the 8, 16 or 32 bit format, starting with the given code.
+func msgpackWriteSize(buf *bytes.Buffer, n int, code byte) {
+	switch {
+	case n <= math.MaxUint8:
+		buf.WriteByte(code)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code + 1)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code + 2)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackDecode reads a single value. Integers are returned as int64 or
+// uint64, arrays as []interface{}, maps as msgpackMap, and typed extensions
+// as msgpackTyped, holding a value of the registered type.
+func msgpackDecode(r *bytes.Reader) (interface{}, error) {
+	code, err := r.ReadByte()
+	if err != nil {
+		return nil, errMsgpackInvalid
+	}
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return msgpackDecodeMap(r, int(code&0x0f))
+	case code&0xf0 == 0x90:
+		return msgpackDecodeArray(r, int(code&0x0f))
+	case code&0xe0 == 0xa0:
+		b, err := msgpackRead(r, int(code&0x1f))
+		return string(b), err
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := msgpackReadSize(r, code-0xc4)
+		if err != nil {
+			return nil, err
+		}
+
+		return msgpackRead(r, n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := msgpackReadSize(r, code-0xc7)
+		if err != nil {
+			return nil, err
+		}
+
+		kind, err := r.ReadByte()
+		if err != nil || kind != msgpackTypedExt {
+			return nil, errMsgpackInvalid
+		}
+
+		b, err := msgpackRead(r, n)
+		if err != nil {
+			return nil, err
+		}
+
+		return msgpackDecodeTyped(bytes.NewReader(b))
+	case 0xca:
+		var f uint32
+		err := binary.Read(r, binary.BigEndian, &f)
+		return float64(math.Float32frombits(f)), err
+	case 0xcb:
+		var f uint64
+		err := binary.Read(r, binary.BigEndian, &f)
+		return math.Float64frombits(f), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := msgpackRead(r, 1<<(code-0xcc))
+		if err != nil {
+			return nil, err
+		}
+
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+
+		return u, nil
+	case 0xd0:
+		var i int8
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd1:
+		var i int16
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd2:
+		var i int32
+		err := binary.Read(r, binary.BigEndian, &i)
+		return int64(i), err
+	case 0xd3:
+		var i int64
+		err := binary.Read(r, binary.BigEndian, &i)
+		return i, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := msgpackReadSize(r, code-0xd9)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := msgpackRead(r, n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := msgpackReadSize(r, code-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+
+		return msgpackDecodeArray(r, n)
+	case 0xde, 0xdf:
+		n, err := msgpackReadSize(r, code-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+
+		return msgpackDecodeMap(r, n)
+	}
+
+	return nil, errMsgpackInvalid
+}
+
+func msgpackDecodeArray(r *bytes.Reader, n int) (interface{}, error) {
+	if n > r.Len() {
+		return nil, errMsgpackInvalid
+	}
+
+	items := make([]interface{}, n)
+	for i := range items {
+		var err error
+		if items[i], err = msgpackDecode(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+func msgpackDecodeMap(r *bytes.Reader, n int) (interface{}, error) {
+	if n > r.Len() {
+		return nil, errMsgpackInvalid
+	}
+
+	m := make(msgpackMap, n)
+	for i := range m {
+		var err error
+		if m[i].key, err = msgpackDecode(r); err != nil {
+			return nil, err
+		}
+
+		if m[i].value, err = msgpackDecode(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func msgpackDecodeTyped(r *bytes.Reader) (interface{}, error) {
+	name, err := msgpackDecode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := name.(string)
+	if !ok {
+		return nil, errMsgpackInvalid
+	}
+
+	t, err := typeByName(s)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := msgpackDecode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := reflect.New(t).Elem()
+	if err := msgpackAssign(rv, v); err != nil {
+		return nil, err
+	}
+
+	return msgpackTyped{rv.Interface()}, nil
+}
+
+func msgpackReadSize(r *bytes.Reader, width byte) (int, error) {
+	b, err := msgpackRead(r, 1<<width)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+
+	if n < 0 || n > r.Len() {
+		return 0, errMsgpackInvalid
+	}
+
+	return n, nil
+}
+
+func msgpackRead(r *bytes.Reader, n int) ([]byte, error) {
+	if n > r.Len() {
+		return nil, errMsgpackInvalid
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errMsgpackInvalid
+	}
+
+	return b, nil
+}
+
+// msgpackAssign stores a decoded value into the destination, converting it
+// to the destination type.
+func msgpackAssign(dst reflect.Value, v interface{}) error {
+	if v == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	if dst.Kind() == reflect.Interface {
+		iv := msgpackInterface(v)
+		if iv == nil {
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+
+		if !reflect.TypeOf(iv).AssignableTo(dst.Type()) {
+			return fmt.Errorf("Cannot assign %T to %s", iv, dst.Type())
+		}
+
+		dst.Set(reflect.ValueOf(iv))
+		return nil
+	}
+
+	if typed, ok := v.(msgpackTyped); ok {
+		rv := reflect.ValueOf(typed.value)
+		if !rv.Type().AssignableTo(dst.Type()) {
+			return fmt.Errorf("Cannot assign %s to %s", rv.Type(), dst.Type())
+		}
+
+		dst.Set(rv)
+		return nil
+	}
+
+	if dst.Type().Implements(binaryMarshalerType) &&
+		reflect.PtrTo(dst.Type()).Implements(binaryUnmarshalerType) {
+		b, ok := v.([]byte)
+		if !ok {
+			return fmt.Errorf("Cannot assign %T to %s", v, dst.Type())
+		}
+
+		return dst.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	}
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		if b, ok := v.(bool); ok {
+			dst.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch n := v.(type) {
+		case int64:
+			dst.SetInt(n)
+			return nil
+		case uint64:
+			dst.SetInt(int64(n))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch n := v.(type) {
+		case int64:
+			dst.SetUint(uint64(n))
+			return nil
+		case uint64:
+			dst.SetUint(n)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := v.(float64); ok {
+			dst.SetFloat(f)
+			return nil
+		}
+	case reflect.String:
+		if s, ok := v.(string); ok {
+			dst.SetString(s)
+			return nil
+		}
+	case reflect.Slice, reflect.Array:
+		if b, ok := v.([]byte); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			if dst.Kind() == reflect.Slice {
+				dst.Set(reflect.MakeSlice(dst.Type(), len(b), len(b)))
+			}
+			reflect.Copy(dst, reflect.ValueOf(b))
+			return nil
+		}
+
+		if items, ok := v.([]interface{}); ok {
+			if dst.Kind() == reflect.Slice {
+				dst.Set(reflect.MakeSlice(dst.Type(), len(items), len(items)))
+			} else if dst.Len() != len(items) {
+				break
+			}
+
+			for i, item := range items {
+				if err := msgpackAssign(dst.Index(i), item); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	case reflect.Map:
+		if m, ok := v.(msgpackMap); ok {
+			dst.Set(reflect.MakeMap(dst.Type()))
+
+			for _, p := range m {
+				key := reflect.New(dst.Type().Key()).Elem()
+				if err := msgpackAssign(key, p.key); err != nil {
+					return err
+				}
+
+				value := reflect.New(dst.Type().Elem()).Elem()
+				if err := msgpackAssign(value, p.value); err != nil {
+					return err
+				}
+
+				dst.SetMapIndex(key, value)
+			}
+
+			return nil
+		}
+	case reflect.Struct:
+		if m, ok := v.(msgpackMap); ok {
+			for _, p := range m {
+				name, ok := p.key.(string)
+				if !ok {
+					return errMsgpackInvalid
+				}
+
+				if f, ok := dst.Type().FieldByName(name); ok && f.PkgPath == "" {
+					if err := msgpackAssign(dst.FieldByIndex(f.Index), p.value); err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		}
+	case reflect.Ptr:
+		ptr := reflect.New(dst.Type().Elem())
+		if err := msgpackAssign(ptr.Elem(), v); err != nil {
+			return err
+		}
+
+		dst.Set(ptr)
+		return nil
+	}
+
+	return fmt.Errorf("Cannot assign %T to %s", v, dst.Type())
+}
+
+// msgpackInterface converts a decoded value, stored without a destination
+// type, to its natural Go type.
+func msgpackInterface(v interface{}) interface{} {
+	switch t := v.(type) {
+	case msgpackTyped:
+		return t.value
+	case int64:
+		return int(t)
+	case uint64:
+		return int(t)
+	case []interface{}:
+		for i := range t {
+			t[i] = msgpackInterface(t[i])
+		}
+	case msgpackMap:
+		m := map[interface{}]interface{}{}
+		for _, p := range t {
+			m[msgpackInterface(p.key)] = msgpackInterface(p.value)
+		}
+
+		return m
+	}
+
+	return v
+}
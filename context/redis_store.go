@@ -0,0 +1,522 @@
+package context
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+RedisStore is a session store which keeps the session data in a server,
+speaking the Redis protocol. It allows multiple server instances to share
+the same sessions. Each session is stored under its name, with the Prefix
+field prepended to it. All data is expired by the server itself, after the
+max-age it was written with, or the MaxAge field, if the former is 0.
+
+Sessions are locked by setting a key, named after the session and
+prefixed with the Prefix field and "lock:". The key expires after the
+LockTTL duration, so that a session isn't locked forever, should the
+process holding the lock exit.
+
+The sessions of each user are indexed in sets, stored under the user
+identifier, prefixed with the Prefix field and "user:". A set expires after
+the MaxAge field duration, since a session was last added to it.
+
+Connections are kept in a pool, whose size is specified when creating the
+store. If the Password field is set, each new connection will be
+authenticated, and if the DB field is non-zero, the database will be
+selected as well.
+*/
+type RedisStore struct {
+	Network  string
+	Address  string
+	Password string
+	DB       int
+	Prefix   string
+	Timeout  time.Duration
+	LockTTL  time.Duration
+	MaxAge   time.Duration
+
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+}
+
+type redisError string
+
+const scanCount = 100
+
+// redisUnlockScript deletes a lock key, only if it holds the given token.
+const redisUnlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+// NewRedisStore creates a new redis session store, connecting to the given
+// address. At most maxIdle connections will be kept in its pool.
+func NewRedisStore(network, address string, maxIdle int) *RedisStore {
+	if network == "" {
+		network = "tcp"
+	}
+
+	if maxIdle <= 0 {
+		maxIdle = 1
+	}
+
+	return &RedisStore{
+		Network: network,
+		Address: address,
+		Prefix:  "session:",
+		Timeout: 5 * time.Second,
+		LockTTL: 30 * time.Second,
+		MaxAge:  15 * 24 * time.Hour,
+		pool:    make(chan *redisConn, maxIdle),
+	}
+}
+
+// Get fetches the session data, stored under the given name.
+func (rs *RedisStore) Get(name string) ([]byte, error) {
+	reply, err := rs.do("GET", rs.Prefix+name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if reply == nil {
+		return nil, ErrNotExist
+	}
+
+	if b, ok := reply.([]byte); ok {
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("Unexpected redis reply %v", reply)
+}
+
+// Set stores the session data under the given name. If the maxAge is
+// positive, it will be used as the expiration time of the data, otherwise
+// the MaxAge field is used.
+func (rs *RedisStore) Set(name string, data []byte, maxAge time.Duration) error {
+	var err error
+
+	if maxAge <= 0 {
+		maxAge = rs.MaxAge
+	}
+
+	if seconds := int64(maxAge / time.Second); seconds > 0 {
+		_, err = rs.do("SET", rs.Prefix+name, data, "EX", seconds)
+	} else {
+		_, err = rs.do("SET", rs.Prefix+name, data)
+	}
+
+	return err
+}
+
+// Delete removes the session data stored under the given name.
+func (rs *RedisStore) Delete(name string) error {
+	_, err := rs.do("DEL", rs.Prefix+name)
+
+	return err
+}
+
+// Cleanup iterates over all keys with the store prefix. If the age is 0,
+// all session data is removed, along with the indexes. Otherwise, since the
+// server expires the session data on its own, only keys without an
+// expiration time, such as ones written by older versions, are affected.
+// They are removed if they haven't been accessed for the given age, or set
+// to expire once they reach it. Names of sessions which no longer exist are
+// removed from the user indexes.
+func (rs *RedisStore) Cleanup(age time.Duration) error {
+	return rs.scan(func(keys []string) error {
+		if age == 0 {
+			args := make([]interface{}, len(keys))
+			for i := range keys {
+				args[i] = keys[i]
+			}
+
+			_, err := rs.do("DEL", args...)
+			return err
+		}
+
+		for _, key := range keys {
+			if strings.HasPrefix(key, rs.userKey("")) {
+				if err := rs.pruneUserSessions(key); err != nil {
+					return err
+				}
+				continue
+			}
+
+			ttl, err := rs.do("TTL", key)
+			if err != nil {
+				return err
+			}
+
+			if ttl != int64(-1) {
+				continue
+			}
+
+			reply, err := rs.do("OBJECT", "IDLETIME", key)
+			if err != nil {
+				return err
+			}
+
+			idle, _ := reply.(int64)
+			if remaining := int64(age/time.Second) - idle; remaining > 0 {
+				_, err = rs.do("EXPIRE", key, remaining)
+			} else {
+				_, err = rs.do("DEL", key)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// AddUserSession adds the session name to a set, stored under the user
+// identifier and the store prefix, and refreshes its expiration time.
+func (rs *RedisStore) AddUserSession(user, name string) error {
+	if _, err := rs.do("SADD", rs.userKey(user), name); err != nil {
+		return err
+	}
+
+	if seconds := int64(rs.MaxAge / time.Second); seconds > 0 {
+		if _, err := rs.do("EXPIRE", rs.userKey(user), seconds); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveUserSession removes the session name from the user's set.
+func (rs *RedisStore) RemoveUserSession(user, name string) error {
+	_, err := rs.do("SREM", rs.userKey(user), name)
+
+	return err
+}
+
+// UserSessions returns all session names in the user's set.
+func (rs *RedisStore) UserSessions(user string) ([]string, error) {
+	reply, err := rs.do("SMEMBERS", rs.userKey(user))
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected redis reply %v", reply)
+	}
+
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		if name, ok := item.([]byte); ok {
+			names = append(names, string(name))
+		}
+	}
+
+	return names, nil
+}
+
+// Lock locks the named session, retrying until the lock has been acquired
+// or the timeout has passed.
+func (rs *RedisStore) Lock(name string, timeout time.Duration) (func() error, error) {
+	b, err := randomData(16)
+	if err != nil {
+		return nil, err
+	}
+
+	key, token := rs.Prefix+"lock:"+name, base64.URLEncoding.EncodeToString(b)
+	deadline := time.Now().Add(timeout)
+	wait := 5 * time.Millisecond
+
+	for {
+		reply, err := rs.do("SET", key, token, "NX", "PX", int64(rs.LockTTL/time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+
+		if reply != nil {
+			break
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, ErrLockTimeout
+		}
+
+		if remaining := deadline.Sub(time.Now()); wait > remaining {
+			wait = remaining
+		}
+
+		time.Sleep(wait)
+		if wait < 100*time.Millisecond {
+			wait *= 2
+		}
+	}
+
+	return func() error {
+		// The lock may have expired and been taken by someone else, so
+		// it is only removed if it still holds the token
+		_, err := rs.do("EVAL", redisUnlockScript, 1, key, token)
+
+		return err
+	}, nil
+}
+
+// Close closes all idle connections in the pool.
+func (rs *RedisStore) Close() error {
+	for {
+		select {
+		case conn := <-rs.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// pruneUserSessions removes the names of sessions, whose data no longer
+// exists, from the user index under the given key.
+func (rs *RedisStore) pruneUserSessions(key string) error {
+	reply, err := rs.do("SMEMBERS", key)
+	if err != nil {
+		return err
+	}
+
+	items, _ := reply.([]interface{})
+	for _, item := range items {
+		name, ok := item.([]byte)
+		if !ok {
+			continue
+		}
+
+		exists, err := rs.do("EXISTS", rs.Prefix+string(name))
+		if err != nil {
+			return err
+		}
+
+		if exists == int64(0) {
+			if _, err := rs.do("SREM", key, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (rs *RedisStore) userKey(user string) string {
+	return rs.Prefix + "user:" + user
+}
+
+func (rs *RedisStore) scan(fn func(keys []string) error) error {
+	cursor := "0"
+	match := escapeGlob(rs.Prefix) + "*"
+
+	for {
+		reply, err := rs.do("SCAN", cursor, "MATCH", match, "COUNT", scanCount)
+		if err != nil {
+			return err
+		}
+
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("Unexpected redis reply %v", reply)
+		}
+
+		next, _ := parts[0].([]byte)
+		items, _ := parts[1].([]interface{})
+
+		keys := make([]string, 0, len(items))
+		for _, item := range items {
+			if key, ok := item.([]byte); ok {
+				keys = append(keys, string(key))
+			}
+		}
+
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+func (rs *RedisStore) do(cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := rs.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(cmd, args...)
+
+	if _, ok := err.(redisError); err == nil || ok {
+		rs.put(conn)
+	} else {
+		conn.Close()
+	}
+
+	return reply, err
+}
+
+func (rs *RedisStore) get() (*redisConn, error) {
+	select {
+	case conn := <-rs.pool:
+		return conn, nil
+	default:
+	}
+
+	c, err := net.DialTimeout(rs.Network, rs.Address, rs.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn{Conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c), timeout: rs.Timeout}
+
+	if rs.Password != "" {
+		if _, err := conn.do("AUTH", rs.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if rs.DB != 0 {
+		if _, err := conn.do("SELECT", int64(rs.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (rs *RedisStore) put(conn *redisConn) {
+	select {
+	case rs.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (c *redisConn) do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args)+1)
+	writeBulk(c.w, []byte(cmd))
+
+	for _, arg := range args {
+		switch t := arg.(type) {
+		case []byte:
+			writeBulk(c.w, t)
+		case string:
+			writeBulk(c.w, []byte(t))
+		case int64:
+			writeBulk(c.w, []byte(strconv.FormatInt(t, 10)))
+		case int:
+			writeBulk(c.w, []byte(strconv.Itoa(t)))
+		default:
+			return nil, fmt.Errorf("Unsupported redis argument type %T", arg)
+		}
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return readReply(c.r)
+}
+
+func writeBulk(w *bufio.Writer, b []byte) {
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("Invalid redis reply")
+	}
+
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if size < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+
+		return b[:size], nil
+	case '*':
+		size, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if size < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("Unknown redis reply type '%c'", kind)
+}
+
+func escapeGlob(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+	return replacer.Replace(s)
+}
+
+func (e redisError) Error() string {
+	return string(e)
+}
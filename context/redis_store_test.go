@@ -0,0 +1,443 @@
+package context
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeRedis struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	data     map[string]string
+	sets     map[string]map[string]bool
+	expires  map[string]time.Time
+	access   map[string]time.Time
+	conns    int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{
+		listener: l,
+		data:     map[string]string{},
+		sets:     map[string]map[string]bool{},
+		expires:  map[string]time.Time{},
+		access:   map[string]time.Time{},
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			f.mutex.Lock()
+			f.conns++
+			f.mutex.Unlock()
+
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeRedis) Addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) Close() {
+	f.listener.Close()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+
+		items, ok := reply.([]interface{})
+		if !ok || len(items) == 0 {
+			return
+		}
+
+		args := make([]string, len(items))
+		for i := range items {
+			args[i] = string(items[i].([]byte))
+		}
+
+		if _, err := conn.Write([]byte(f.exec(args))); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for k, exp := range f.expires {
+		if time.Now().After(exp) {
+			delete(f.data, k)
+			delete(f.sets, k)
+			delete(f.expires, k)
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET", "SET":
+		f.access[args[1]] = time.Now()
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if v, ok := f.data[args[1]]; ok {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+		}
+		return "$-1\r\n"
+	case "SET":
+		var expires time.Time
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if _, ok := f.data[args[1]]; ok {
+					return "$-1\r\n"
+				}
+			case "EX":
+				seconds, _ := strconv.Atoi(args[i+1])
+				expires = time.Now().Add(time.Duration(seconds) * time.Second)
+				i++
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				i++
+			}
+		}
+
+		f.data[args[1]] = args[2]
+		delete(f.expires, args[1])
+
+		if !expires.IsZero() {
+			f.expires[args[1]] = expires
+		}
+		return "+OK\r\n"
+	case "DEL":
+		count := 0
+		for _, k := range args[1:] {
+			_, ok := f.data[k]
+			_, isSet := f.sets[k]
+			if ok || isSet {
+				delete(f.data, k)
+				delete(f.sets, k)
+				delete(f.expires, k)
+				count++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", count)
+	case "SADD":
+		if f.sets[args[1]] == nil {
+			f.sets[args[1]] = map[string]bool{}
+		}
+		f.sets[args[1]][args[2]] = true
+		return ":1\r\n"
+	case "SREM":
+		delete(f.sets[args[1]], args[2])
+		if len(f.sets[args[1]]) == 0 {
+			delete(f.sets, args[1])
+		}
+		return ":1\r\n"
+	case "SMEMBERS":
+		members := []string{}
+		for m := range f.sets[args[1]] {
+			members = append(members, fmt.Sprintf("$%d\r\n%s\r\n", len(m), m))
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(members), strings.Join(members, ""))
+	case "EXISTS":
+		if f.exists(args[1]) {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "TTL":
+		if !f.exists(args[1]) {
+			return ":-2\r\n"
+		}
+		if exp, ok := f.expires[args[1]]; ok {
+			return fmt.Sprintf(":%d\r\n", int(exp.Sub(time.Now()).Seconds()))
+		}
+		return ":-1\r\n"
+	case "EXPIRE":
+		if !f.exists(args[1]) {
+			return ":0\r\n"
+		}
+		seconds, _ := strconv.Atoi(args[2])
+		f.expires[args[1]] = time.Now().Add(time.Duration(seconds) * time.Second)
+		return ":1\r\n"
+	case "OBJECT":
+		if !f.exists(args[2]) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", int(time.Since(f.access[args[2]]).Seconds()))
+	case "EVAL":
+		// Only the unlock script is supported
+		if args[1] != redisUnlockScript || args[2] != "1" {
+			return "-ERR unknown script\r\n"
+		}
+		if f.data[args[3]] != args[4] {
+			return ":0\r\n"
+		}
+		delete(f.data, args[3])
+		delete(f.expires, args[3])
+		return ":1\r\n"
+	case "SCAN":
+		pattern := strings.Replace(args[3], `\`, "", -1)
+		keys := []string{}
+		for _, k := range f.keys() {
+			if ok, _ := path.Match(pattern, k); ok {
+				keys = append(keys, fmt.Sprintf("$%d\r\n%s\r\n", len(k), k))
+			}
+		}
+		return fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", len(keys), strings.Join(keys, ""))
+	}
+
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func (f *fakeRedis) exists(key string) bool {
+	_, ok := f.data[key]
+	_, isSet := f.sets[key]
+
+	return ok || isSet
+}
+
+func (f *fakeRedis) keys() []string {
+	keys := []string{}
+	for k := range f.data {
+		keys = append(keys, k)
+	}
+
+	for k := range f.sets {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+func TestRedisStore(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.Close()
+
+	rs := NewRedisStore("tcp", f.Addr(), 2)
+	defer rs.Close()
+
+	if _, err := rs.Get("test1"); err != ErrNotExist {
+		t.Fatalf("Expected a non-existing session error, got '%v'\n", err)
+	}
+
+	if err := rs.Set("test1", []byte("foo\r\nbar"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := rs.Get("test1"); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "foo\r\nbar" {
+		t.Fatalf("Expected 'foo\\r\\nbar', got '%s'\n", b)
+	}
+
+	if _, ok := f.data["session:test1"]; !ok {
+		t.Fatalf("Expected the key to be prefixed, got %v\n", f.data)
+	}
+
+	if exp, ok := f.expires["session:test1"]; !ok || exp.Sub(time.Now()) < rs.MaxAge-time.Minute {
+		t.Fatalf("Expected 'test1' to expire after the store max-age, got %v\n", exp)
+	}
+
+	if err := rs.Set("test2", []byte("baz"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := f.expires["session:test2"]; !ok {
+		t.Fatalf("Expected 'test2' to have an expiration time\n")
+	}
+
+	if err := rs.Delete("test2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rs.Get("test2"); err != ErrNotExist {
+		t.Fatalf("Expected a non-existing session error, got '%v'\n", err)
+	}
+
+	f.mutex.Lock()
+	if f.conns != 1 {
+		t.Fatalf("Expected a single pooled connection, got %d\n", f.conns)
+	}
+	f.mutex.Unlock()
+
+	// Keys without an expiration time, such as ones written by older
+	// versions, expire based on their last access
+	f.mutex.Lock()
+	f.data["session:old"] = "old"
+	f.access["session:old"] = time.Now().Add(-2 * time.Minute)
+	f.data["session:recent"] = "recent"
+	f.access["session:recent"] = time.Now().Add(-30 * time.Second)
+	f.mutex.Unlock()
+
+	if err := rs.Cleanup(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := f.data["session:old"]; ok {
+		t.Fatalf("Expected the idle key to be removed\n")
+	}
+
+	if exp, ok := f.expires["session:recent"]; !ok || exp.Sub(time.Now()) > 31*time.Second {
+		t.Fatalf("Expected the recent key to expire after its remaining age, got %v\n", exp)
+	}
+
+	f.data["other"] = "value"
+
+	if err := rs.Cleanup(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rs.Get("test1"); err != ErrNotExist {
+		t.Fatalf("Expected a non-existing session error, got '%v'\n", err)
+	}
+
+	if _, ok := f.data["other"]; !ok {
+		t.Fatalf("Expected keys without the prefix to remain\n")
+	}
+}
+
+func TestRedisStoreIndex(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.Close()
+
+	rs := NewRedisStore("tcp", f.Addr(), 2)
+	defer rs.Close()
+
+	for _, name := range []string{"s1", "s2"} {
+		if err := rs.Set(name, []byte(name), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := rs.AddUserSession("john", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := f.expires["session:user:john"]; !ok {
+		t.Fatalf("Expected the user index to have an expiration time\n")
+	}
+
+	if err := rs.Delete("s1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rs.Cleanup(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if names, err := rs.UserSessions("john"); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 || names[0] != "s2" {
+		t.Fatalf("Expected the removed session to be pruned from the index, got %v\n", names)
+	}
+}
+
+func TestRedisSession(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.Close()
+
+	rs := NewRedisStore("tcp", f.Addr(), 2)
+	defer rs.Close()
+
+	s := NewSession(secret, nil, "")
+	s.(StoreSession).SetStore(rs)
+	s.SetName("redis1")
+	s.Set("foo", "bar")
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := rec.Header().Get("Set-Cookie")
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+	s = NewSession(secret, nil, "")
+	s.(StoreSession).SetStore(rs)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+		t.Fatalf("Expected value for `foo` to be 'bar', got '%v'\n", v)
+	}
+}
+
+func TestRedisStoreLock(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.Close()
+
+	rs := NewRedisStore("tcp", f.Addr(), 2)
+	defer rs.Close()
+
+	unlock, err := rs.Lock("lock1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rs.Lock("lock1", 20*time.Millisecond); err != ErrLockTimeout {
+		t.Fatalf("Expected a lock timeout, got '%v'\n", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		unlock()
+	}()
+
+	unlock2, err := rs.Lock("lock1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing a lock, taken over by someone else, leaves it intact
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := f.data["session:lock:lock1"]; !ok {
+		t.Fatalf("Expected the lock to still be held\n")
+	}
+
+	if err := unlock2(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := f.data["session:lock:lock1"]; ok {
+		t.Fatalf("Expected the lock to be released\n")
+	}
+}
@@ -8,14 +8,10 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/gob"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
-	"os"
-	"path"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,12 +31,13 @@ The Session represents persistent user data. Its Name field is how it is
 identified.  The secret is used to salt the hmac, sent along the data
 to the client as a cookie. The data is a base64 encoded string, containing
 the session name and date showing when it was last used. The actual session
-data is stored in the filesystem, in a directory specified by the Path
-field. The data is serialized using encoding/gob, therefore any custom
-data type should be registered with it. The MaxAge field specifies a duration,
-after which an unused session will get cleared of its data and marked as
-expired. It is also used as the max-age and expires fields of the session
-cookie.
+data is stored in a SessionStore, which by default is the filesystem, in a
+directory specified by the Path field. The data is serialized using the
+configured Codec, which defaults to a GobCodec, therefore any custom data
+type should be registered with encoding/gob, unless a different codec is
+used. The MaxAge field specifies a duration, after which an unused session
+will get cleared of its data and marked as expired. It is also used as the
+max-age and expires fields of the session cookie.
 */
 type Session interface {
 	Read(*http.Request, Context) error
@@ -61,8 +58,112 @@ type Session interface {
 	SetFlash(interface{}, interface{})
 }
 
+/*
+The following interfaces describe optional session capabilities. The
+sessions created by NewSession and NewCookieSession implement all of them,
+while custom sessions may implement any subset. Callers should detect them
+with a type assertion, and skip the feature if it is not supported:
+
+	if fs, ok := sess.(context.FlashSession); ok {
+		fs.AddFlash(context.FlashSuccess, "Saved")
+	}
+*/
+
+// A CookieOptionsSession allows configuring the session cookie, its format
+// and the keys of previously issued cookies.
+type CookieOptionsSession interface {
+	CookieOptions() CookieOptions
+	SetCookieOptions(CookieOptions)
+	SetOldKeys(secrets, ciphers [][]byte)
+	CookieVersion() int
+	SetCookieVersion(int)
+}
+
+// A StoreSession keeps its values in a SessionStore, encoded with a Codec,
+// and writes them only when needed.
+type StoreSession interface {
+	Store() SessionStore
+	SetStore(SessionStore)
+	Codec() Codec
+	SetCodec(Codec)
+	SetLazyLoad(bool)
+	Modified() bool
+	RefreshThreshold() time.Duration
+	SetRefreshThreshold(time.Duration)
+}
+
+// A TimeoutSession expires after a period of inactivity, or after a fixed
+// time since its creation.
+type TimeoutSession interface {
+	IdleTimeout() time.Duration
+	SetIdleTimeout(time.Duration)
+	AbsoluteTimeout() time.Duration
+	SetAbsoluteTimeout(time.Duration)
+	Created() time.Time
+	SetExpiryHandler(ExpiryHandler)
+}
+
+// A UserSession is associated with a user, so that it may be listed and
+// revoked through a SessionManager.
+type UserSession interface {
+	User() string
+	SetUser(string)
+	Metadata() SessionMetadata
+}
+
+// A RegenerableSession may be given a new name, or destroyed along with
+// its stored data.
+type RegenerableSession interface {
+	Regenerate() error
+	Destroy() error
+}
+
+// A FlashSession holds typed flash messages.
+type FlashSession interface {
+	AddFlash(FlashCategory, string, ...interface{})
+	Flashes(...FlashCategory) []FlashMessage
+	PeekFlashes(...FlashCategory) []FlashMessage
+}
+
 type SessionGenerator func(secret, cipher []byte, path string) Session
 
+// CookieOptions holds the attributes of the session cookie.
+type CookieOptions struct {
+	Domain   string
+	Path     string
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+}
+
+// ExpiryHandler is called whenever a session expires, before its values
+// are removed.
+type ExpiryHandler func(s Session, reason ExpiryReason)
+
+// ExpiryReason describes why a session has expired.
+type ExpiryReason int
+
+const (
+	// ExpiredIdle is the reason for sessions which haven't been used for
+	// longer than their idle timeout.
+	ExpiredIdle ExpiryReason = iota
+	// ExpiredAbsolute is the reason for sessions which have been created
+	// longer than their absolute timeout ago.
+	ExpiredAbsolute
+)
+
+// SessionMetadata describes a session, without exposing its values. The
+// LastSeen time, IP address and user agent are recorded whenever the
+// session is written.
+type SessionMetadata struct {
+	Name      string
+	User      string
+	Created   time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+}
+
 type SessionValues map[interface{}]interface{}
 type FlashValues map[interface{}]interface{}
 
@@ -71,10 +172,34 @@ type session struct {
 
 	name       string
 	maxAge     time.Duration
+	idle       time.Duration
+	absolute   time.Duration
+	created    time.Time
+	lastSeen   time.Time
+	user       string
+	indexed    string
+	ip         string
+	userAgent  string
+	onExpire   ExpiryHandler
 	values     SessionValues
 	secret     []byte
 	block      cipher.Block
+	oldSecrets [][]byte
+	oldBlocks  []cipher.Block
+	aeads      []cipher.AEAD
+	version    int
 	cookieName string
+	cookieOpts CookieOptions
+	store      SessionStore
+	codec      Codec
+	destroyed  bool
+	date       int64
+	refresh    time.Duration
+	lazy       bool
+	loaded     bool
+	loadErr    error
+	dirty      bool
+	stale      bool
 	mutex      sync.RWMutex
 }
 
@@ -83,20 +208,29 @@ type fileData struct {
 	MaxAge     time.Duration
 	Values     SessionValues
 	CookieName string
+	Created    time.Time
+	LastSeen   time.Time
+	User       string
+	IP         string
+	UserAgent  string
 }
 
 type contextKey string
 
-var fsMutex sync.RWMutex
+const cookieVersion2 = "v2."
 
 // NewSession creates a new session object.
 func NewSession(secret, cipher []byte, path string) Session {
 	s := &session{
 		Path:       path,
 		maxAge:     time.Hour,
+		created:    time.Now(),
+		version:    1,
+		loaded:     true,
 		values:     SessionValues{},
 		secret:     secret,
 		cookieName: "session",
+		cookieOpts: CookieOptions{Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode},
 	}
 
 	if cipher != nil && len(cipher) > 0 {
@@ -107,6 +241,8 @@ func NewSession(secret, cipher []byte, path string) Session {
 		}
 	}
 
+	s.initAEADs()
+
 	return s
 }
 
@@ -114,40 +250,24 @@ func NewSession(secret, cipher []byte, path string) Session {
 // from the filesystem older than a given age. If the age is 0, all
 // session data is removed.
 func CleanupSessions(path string, age time.Duration) error {
-	fsMutex.Lock()
-	defer fsMutex.Unlock()
-
-	files, err := ioutil.ReadDir(path)
-
-	if err != nil {
-		return err
-	}
-
-	for _, fi := range files {
-		if age > 0 {
-			min := time.Now().Add(-age).UnixNano()
-			if fi.ModTime().UnixNano() >= min {
-				continue
-			}
-		}
-
-		if err := os.Remove(filepath.Join(path, fi.Name())); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return NewFileStore(path).Cleanup(age)
 }
 
 // Read fetches the session from the cookie, and loads the session data from
-// the filesystem. It may return a generic error due to the various read
+// the session store. It may return a generic error due to the various read
 // operations, or one of the following:
-//  - ErrExpired - if its older than the set max-age. The session data
-//    is removed
+//  - ErrExpired - if it hasn't been used for longer than its idle timeout,
+//    or if it has been created longer than its absolute timeout ago. The
+//    session data is removed
 //  - ErrNotExist - if session data hasn't been found for this session
 //  - ErrCookieNotExist - if a session cookie doesn't exist
+// If the session is set to load lazily, only the cookie is read, and the
+// session data will be loaded from the store on first access. In that
+// case, ErrNotExist is never returned, and the absolute timeout is checked
+// when the data is loaded. Should the load fail, the session appears empty,
+// and Write returns the error instead of overwriting the stored data.
 func (s *session) Read(r *http.Request, c Context) error {
-	d := http.Dir(s.Path)
+	s.setClient(r)
 
 	if cookie, err := r.Cookie(s.cookieName); err == nil {
 		name, date, err := s.decodeName(cookie.Value)
@@ -156,27 +276,40 @@ func (s *session) Read(r *http.Request, c Context) error {
 			return err
 		}
 
+		s.date = date
+
+		if s.lazy {
+			s.SetName(name)
+
+			if s.expired(date) {
+				if s.onExpire != nil {
+					if data, err := s.load(name); err == nil && data != nil {
+						s.fromData(data)
+					}
+				}
+
+				s.expire(ExpiredIdle)
+				return ErrExpired
+			}
+
+			s.mutex.Lock()
+			s.loaded = false
+			s.loadErr = nil
+			s.mutex.Unlock()
+
+			return nil
+		}
+
 		var data *fileData
 		var ok bool
 
 		if data, ok = getSessionData(s.name, r, c); ok {
 			s.fromData(data)
 		} else {
-			fsMutex.RLock()
-			defer fsMutex.RUnlock()
-
-			if file, err := d.Open(name); err == nil {
-				defer file.Close()
-
-				data = &fileData{}
-
-				dec := gob.NewDecoder(file)
-
-				if err := dec.Decode(data); err == nil {
-					s.fromData(data)
-				} else {
-					return err
-				}
+			if data, err = s.load(name); err != nil {
+				return err
+			} else if data != nil {
+				s.fromData(data)
 			}
 		}
 
@@ -184,15 +317,12 @@ func (s *session) Read(r *http.Request, c Context) error {
 			s.name = name
 
 			return ErrNotExist
-		} else {
-			if s.maxAge != 0 {
-				maxAge := time.Now().Add(-s.maxAge).Unix()
-
-				if date < maxAge {
-					s.DeleteAll()
-					return ErrExpired
-				}
-			}
+		} else if s.expired(date) {
+			s.expire(ExpiredIdle)
+			return ErrExpired
+		} else if s.absoluteExpired() {
+			s.expire(ExpiredAbsolute)
+			return ErrExpired
 		}
 
 		if c != nil {
@@ -206,74 +336,115 @@ func (s *session) Read(r *http.Request, c Context) error {
 }
 
 // Write stores the session name in the session cookie along with the current
-// date, and writes the session data to the filesystem, under the path which
-// is stored in the session itself.
+// date, and writes the session data to the session store.
 func (s *session) Write(w http.ResponseWriter) error {
-	buf := util.BufferPool.GetBuffer()
-	defer util.BufferPool.Put(buf)
+	if s.isDestroyed() {
+		if w != nil {
+			http.SetCookie(w, s.newExpiredCookie(s.cookieName))
+		}
 
-	enc := gob.NewEncoder(buf)
+		s.written(0)
 
-	if err := enc.Encode(s.toData()); err != nil {
-		return err
+		return nil
 	}
 
-	if filepath.Separator != '/' && strings.IndexRune(s.name, filepath.Separator) >= 0 ||
-		strings.Contains(s.name, "\x00") {
-		return errors.New("http: invalid character in file path")
+	// Writing a session, whose data couldn't be loaded, would overwrite
+	// the stored values
+	if err := s.ensureLoaded(); err != nil {
+		return err
 	}
+	s.touch()
 
-	val, date, err := s.encodeName()
+	data := s.toData()
+	b, err := encodeData(s.Codec(), data)
 
 	if err != nil {
 		return err
 	}
 
-	if w != nil {
-		var cookie *http.Cookie
-
-		if s.maxAge > 0 {
-			t := time.Unix(date, 0).Add(s.maxAge)
-			cookie = &http.Cookie{Name: s.cookieName, Value: val, Path: "/", MaxAge: int(s.maxAge.Seconds()), Expires: t}
-		} else {
-			cookie = &http.Cookie{Name: s.cookieName, Value: val, Path: "/"}
-		}
-		http.SetCookie(w, cookie)
-	}
-
-	fsMutex.Lock()
-	defer fsMutex.Unlock()
+	val, date, err := s.encodeName()
 
-	if err := os.MkdirAll(s.Path, os.FileMode(0700)); err != nil {
+	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(filepath.Join(s.Path, filepath.FromSlash(path.Clean("/"+s.name))),
-		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if w != nil {
+		http.SetCookie(w, s.newCookie(s.cookieName, val, date))
+	}
 
-	if err != nil {
+	if err := s.Store().Set(data.Name, b, s.maxAge); err != nil {
 		return err
 	}
 
-	if _, err := f.Write(buf.Bytes()); err != nil {
+	if err := s.index(data.Name, data.User); err != nil {
 		return err
 	}
 
-	f.Close()
+	s.written(date)
 
 	return nil
 }
 
 // Name returns the name of the session
 func (s *session) Name() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	return s.name
 }
 
 // SetName sets a new name for the session
 func (s *session) SetName(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	s.name = name
 }
 
+// Regenerate gives the session a new name, while keeping its values, and
+// removes the data stored under the old name. It should be called whenever
+// the privileges of the user change, such as after logging in, to protect
+// against session fixation. The new session cookie is sent on the next
+// Write.
+func (s *session) Regenerate() error {
+	// The data has to be loaded under the old name, before it is removed
+	if err := s.ensureLoaded(); err != nil {
+		return err
+	}
+
+	old := s.regenerate()
+
+	if old == "" {
+		return nil
+	}
+
+	if err := s.unindex(old); err != nil {
+		return err
+	}
+
+	return s.Store().Delete(old)
+}
+
+// Destroy removes all values of the session, as well as its stored data.
+// On the next Write, the session cookie will be expired, instead of being
+// updated, unless the session is regenerated beforehand.
+func (s *session) Destroy() error {
+	user := s.User()
+	name := s.destroy()
+
+	if name == "" {
+		return nil
+	}
+
+	if idx, ok := s.Store().(SessionIndex); ok && user != "" {
+		if err := idx.RemoveUserSession(user, name); err != nil {
+			return err
+		}
+	}
+
+	return s.Store().Delete(name)
+}
+
 // MaxAge returns the max-age of the session
 func (s *session) MaxAge() time.Duration {
 	return s.maxAge
@@ -295,16 +466,220 @@ func (s *session) SetCookieName(name string) {
 	s.cookieName = name
 }
 
+// CookieOptions returns the attributes of the session cookie
+func (s *session) CookieOptions() CookieOptions {
+	return s.cookieOpts
+}
+
+// SetCookieOptions sets new attributes for the session cookie
+func (s *session) SetCookieOptions(opts CookieOptions) {
+	s.cookieOpts = opts
+}
+
+// SetOldKeys sets a list of previously used secrets and ciphers. The
+// session secret and cipher are always used when writing the cookie, while
+// the old ones are only used to verify existing cookies, allowing the keys
+// to be rotated without invalidating all sessions. Cookies verified with an
+// old key will be signed with the current one on the next Write.
+func (s *session) SetOldKeys(secrets, ciphers [][]byte) {
+	s.oldSecrets = secrets
+	s.oldBlocks = nil
+
+	for _, c := range ciphers {
+		if b, err := aes.NewCipher(c); err == nil {
+			s.oldBlocks = append(s.oldBlocks, b)
+		} else {
+			panic(err)
+		}
+	}
+
+	s.initAEADs()
+}
+
+// CookieVersion returns the format version of the session cookie
+func (s *session) CookieVersion() int {
+	return s.version
+}
+
+// SetCookieVersion sets the format version of the session cookie. Version 1
+// stores the session name and date in plain text, along with their
+// signature. Version 2 encrypts and authenticates the whole payload using
+// AES-GCM. Cookies using either version may be read, regardless of the
+// current one.
+func (s *session) SetCookieVersion(version int) {
+	s.version = version
+}
+
+// IdleTimeout returns the duration, after which an unused session expires.
+func (s *session) IdleTimeout() time.Duration {
+	return s.idle
+}
+
+// SetIdleTimeout sets the duration, after which an unused session expires.
+// If it is 0, the max-age of the session is used instead.
+func (s *session) SetIdleTimeout(timeout time.Duration) {
+	s.idle = timeout
+}
+
+// AbsoluteTimeout returns the maximum lifetime of the session.
+func (s *session) AbsoluteTimeout() time.Duration {
+	return s.absolute
+}
+
+// SetAbsoluteTimeout sets the maximum lifetime of the session, regardless
+// of its use. If it is 0, the session lifetime is not limited.
+func (s *session) SetAbsoluteTimeout(timeout time.Duration) {
+	s.absolute = timeout
+}
+
+// Created returns the time at which the session was created.
+func (s *session) Created() time.Time {
+	s.ensureLoaded()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.created
+}
+
+// User returns the identifier of the user, the session belongs to.
+func (s *session) User() string {
+	s.ensureLoaded()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.user
+}
+
+// SetUser associates the session with a user identifier, such as after a
+// login. If the session store is a SessionIndex, the session will be added
+// to the user's index when it is written, so that it may be managed using
+// a SessionManager.
+func (s *session) SetUser(user string) {
+	s.ensureLoaded()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.user != user {
+		s.user = user
+		s.dirty = true
+	}
+}
+
+// Metadata returns the session metadata.
+func (s *session) Metadata() SessionMetadata {
+	s.ensureLoaded()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return SessionMetadata{
+		Name:      s.name,
+		User:      s.user,
+		Created:   s.created,
+		LastSeen:  s.lastSeen,
+		IP:        s.ip,
+		UserAgent: s.userAgent,
+	}
+}
+
+// SetExpiryHandler sets a function, which will be called when the session
+// expires, before its values are removed. It may be used to log out and
+// audit the expired sessions.
+func (s *session) SetExpiryHandler(handler ExpiryHandler) {
+	s.onExpire = handler
+}
+
+// RefreshThreshold returns the minimum age of the session cookie, after
+// which it will be refreshed, even if the session hasn't been modified.
+func (s *session) RefreshThreshold() time.Duration {
+	return s.refresh
+}
+
+// SetRefreshThreshold sets the minimum age of the session cookie, after
+// which the session is considered modified, so that its cookie and stored
+// data will be refreshed. This allows for a sliding expiration of the
+// session, without writing it on every request. A threshold of 0 causes
+// the session to always be considered modified.
+func (s *session) SetRefreshThreshold(threshold time.Duration) {
+	s.refresh = threshold
+}
+
+// SetLazyLoad sets whether the session data should be loaded from the store
+// by Read, or on first access.
+func (s *session) SetLazyLoad(lazy bool) {
+	s.lazy = lazy
+}
+
+// Modified returns true if the session has to be written. This is the case
+// if any of its values have been changed, if it has been regenerated or
+// destroyed, if its cookie has been signed using an old key or format, or
+// if the cookie is older than the refresh threshold. Changes made directly
+// to the map returned by GetAll, or to values stored by reference, are not
+// tracked.
+func (s *session) Modified() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.dirty || s.stale {
+		return true
+	}
+
+	return time.Now().Unix()-s.date >= int64(s.refresh/time.Second)
+}
+
+// Codec returns the codec used to encode the session values. If no codec
+// has been set, a GobCodec is returned.
+func (s *session) Codec() Codec {
+	if s.codec == nil {
+		return GobCodec{}
+	}
+
+	return s.codec
+}
+
+// SetCodec sets the codec used to encode the session values. Data encoded
+// with a different codec is still readable, and will be rewritten using
+// the new codec on the next Write.
+func (s *session) SetCodec(codec Codec) {
+	s.codec = codec
+}
+
+// Store returns the session store. If no store has been set, a FileStore
+// using the session Path is returned.
+func (s *session) Store() SessionStore {
+	if s.store == nil {
+		return NewFileStore(s.Path)
+	}
+
+	return s.store
+}
+
+// SetStore sets a new store for the session data
+func (s *session) SetStore(store SessionStore) {
+	s.store = store
+}
+
 // Set stores a key-value pair in the session.
 func (s *session) Set(key interface{}, val interface{}) {
+	s.ensureLoaded()
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if old, ok := s.values[key]; !ok || !unchanged(old, val) {
+		s.dirty = true
+	}
+
 	s.values[key] = val
 }
 
 // Get fetches a value for a given key.
 func (s *session) Get(key interface{}) (interface{}, bool) {
+	s.ensureLoaded()
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
@@ -316,6 +691,8 @@ func (s *session) Get(key interface{}) (interface{}, bool) {
 
 // GetAll returns all values stored in the session
 func (s *session) GetAll() SessionValues {
+	s.ensureLoaded()
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -328,14 +705,22 @@ func (s *session) DeleteAll() {
 	defer s.mutex.Unlock()
 
 	s.values = SessionValues{}
+	s.loaded = true
+	s.loadErr = nil
+	s.dirty = true
 }
 
 // Delete removes a value for a given key.
 func (s *session) Delete(key interface{}) {
+	s.ensureLoaded()
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	delete(s.values, key)
+	if _, ok := s.values[key]; ok {
+		delete(s.values, key)
+		s.dirty = true
+	}
 }
 
 // Flash gets a flash value for a given key from the session.  Flash values
@@ -349,6 +734,10 @@ func (s *session) Flash(key interface{}) (interface{}, bool) {
 		if val, ok = flashValues[key]; ok {
 			delete(flashValues, key)
 
+			s.mutex.Lock()
+			s.dirty = true
+			s.mutex.Unlock()
+
 			return val, ok
 		}
 	}
@@ -371,6 +760,267 @@ func (s *session) SetFlash(key interface{}, value interface{}) {
 	s.Set(contextKey("flashValues"), flashValues)
 }
 
+// AddFlash adds a flash message of the given category. Multiple messages
+// may be added for each category, and they will be kept in order until
+// they are fetched.
+func (s *session) AddFlash(category FlashCategory, message string, args ...interface{}) {
+	var messages []FlashMessage
+
+	if val, ok := s.Get(contextKey("flashMessages")); ok {
+		messages = val.([]FlashMessage)
+	}
+
+	messages = append(messages, FlashMessage{Category: category, Message: message, Args: args})
+
+	s.Set(contextKey("flashMessages"), messages)
+}
+
+// Flashes returns and removes all pending flash messages of the given
+// categories, or of all categories, if none are given.
+func (s *session) Flashes(categories ...FlashCategory) []FlashMessage {
+	return s.flashes(true, categories)
+}
+
+// PeekFlashes returns all pending flash messages of the given categories,
+// or of all categories, if none are given, without removing them.
+func (s *session) PeekFlashes(categories ...FlashCategory) []FlashMessage {
+	return s.flashes(false, categories)
+}
+
+func (s *session) flashes(consume bool, categories []FlashCategory) []FlashMessage {
+	val, ok := s.Get(contextKey("flashMessages"))
+	if !ok {
+		return nil
+	}
+
+	var matched, rest []FlashMessage
+	for _, m := range val.([]FlashMessage) {
+		found := len(categories) == 0
+		for _, c := range categories {
+			if m.Category == c {
+				found = true
+				break
+			}
+		}
+
+		if found {
+			matched = append(matched, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+
+	if consume && len(matched) > 0 {
+		if len(rest) > 0 {
+			s.Set(contextKey("flashMessages"), rest)
+		} else {
+			s.Delete(contextKey("flashMessages"))
+		}
+	}
+
+	return matched
+}
+
+func (s *session) regenerate() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old := s.name
+	s.name = util.UUID()
+	s.indexed = ""
+	s.destroyed = false
+	s.dirty = true
+
+	return old
+}
+
+func (s *session) destroy() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.values = SessionValues{}
+	s.user = ""
+	s.indexed = ""
+	s.loaded = true
+	s.loadErr = nil
+	s.destroyed = true
+	s.dirty = true
+
+	return s.name
+}
+
+// setClient records the address and user agent of the client, which will
+// be stored along with the session data.
+func (s *session) setClient(r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ip = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		s.ip = host
+	}
+
+	s.userAgent = r.UserAgent()
+}
+
+func (s *session) touch() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastSeen = time.Now()
+}
+
+// index adds the session to the index of its user, removing it from the
+// index of the previous one, if the store supports indexing.
+func (s *session) index(name, user string) error {
+	idx, ok := s.Store().(SessionIndex)
+	if !ok {
+		return nil
+	}
+
+	s.mutex.Lock()
+	indexed := s.indexed
+	s.indexed = user
+	s.mutex.Unlock()
+
+	if indexed == user {
+		return nil
+	}
+
+	if indexed != "" {
+		if err := idx.RemoveUserSession(indexed, name); err != nil {
+			return err
+		}
+	}
+
+	if user != "" {
+		return idx.AddUserSession(user, name)
+	}
+
+	return nil
+}
+
+// unindex removes a previous name of the session from the index of its
+// user.
+func (s *session) unindex(name string) error {
+	user := s.User()
+
+	if idx, ok := s.Store().(SessionIndex); ok && user != "" {
+		return idx.RemoveUserSession(user, name)
+	}
+
+	return nil
+}
+
+func (s *session) isDestroyed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.destroyed
+}
+
+// ensureLoaded loads the session data from the store, unless it has already
+// been loaded. A failed load isn't retried, and its error is returned by all
+// subsequent calls, so that the session is never written without its
+// stored data.
+func (s *session) ensureLoaded() error {
+	s.mutex.Lock()
+
+	if s.loaded || s.loadErr != nil {
+		err := s.loadErr
+		s.mutex.Unlock()
+		return err
+	}
+
+	data, err := s.load(s.name)
+	if err != nil {
+		s.loadErr = err
+		s.mutex.Unlock()
+		return err
+	}
+
+	s.loaded = true
+	if data != nil {
+		s.setData(data)
+	}
+
+	s.mutex.Unlock()
+
+	if s.absoluteExpired() {
+		s.expire(ExpiredAbsolute)
+	}
+
+	return nil
+}
+
+func (s *session) load(name string) (*fileData, error) {
+	b, err := s.Store().Get(name)
+
+	if err != nil {
+		if err == ErrNotExist {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return s.decodeData(b)
+}
+
+// decodeData deserializes the session data, marking the session as stale
+// if it has been encoded with a codec other than the current one.
+func (s *session) decodeData(b []byte) (*fileData, error) {
+	data, codec, err := decodeData(b, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if codec == nil || codec.ID() != s.Codec().ID() {
+		s.stale = true
+	}
+
+	return data, nil
+}
+
+func (s *session) expired(date int64) bool {
+	idle := s.idle
+	if idle == 0 {
+		idle = s.maxAge
+	}
+
+	return idle != 0 && date < time.Now().Add(-idle).Unix()
+}
+
+func (s *session) absoluteExpired() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.absolute != 0 && s.created.Add(s.absolute).Before(time.Now())
+}
+
+// expire calls the expiry handler, if one is set, and then clears the
+// session values, starting a new lifetime.
+func (s *session) expire(reason ExpiryReason) {
+	if s.onExpire != nil {
+		s.onExpire(s, reason)
+	}
+
+	s.DeleteAll()
+
+	s.mutex.Lock()
+	s.created = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *session) written(date int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.date = date
+	s.dirty = false
+	s.stale = false
+}
+
 func (s *session) toData() *fileData {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
@@ -380,6 +1030,11 @@ func (s *session) toData() *fileData {
 		MaxAge:     s.maxAge,
 		Values:     s.values,
 		CookieName: s.cookieName,
+		Created:    s.created,
+		LastSeen:   s.lastSeen,
+		User:       s.user,
+		IP:         s.ip,
+		UserAgent:  s.userAgent,
 	}
 }
 
@@ -387,13 +1042,67 @@ func (s *session) fromData(data *fileData) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	s.setData(data)
+}
+
+func (s *session) setData(data *fileData) {
 	s.name = data.Name
 	s.maxAge = data.MaxAge
 	s.values = data.Values
 	s.cookieName = data.CookieName
+	if data.Created.IsZero() {
+		// Data written before the creation time was tracked
+		s.stale = true
+	} else {
+		s.created = data.Created
+	}
+	s.lastSeen = data.LastSeen
+	s.user = data.User
+	s.indexed = data.User
+	if s.ip == "" {
+		s.ip = data.IP
+	}
+	if s.userAgent == "" {
+		s.userAgent = data.UserAgent
+	}
+}
+
+func (s *session) newCookie(name, value string, date int64) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   s.cookieOpts.Domain,
+		Path:     s.cookieOpts.Path,
+		Secure:   s.cookieOpts.Secure,
+		HttpOnly: s.cookieOpts.HttpOnly,
+		SameSite: s.cookieOpts.SameSite,
+	}
+
+	if s.maxAge > 0 {
+		cookie.MaxAge = int(s.maxAge.Seconds())
+		cookie.Expires = time.Unix(date, 0).Add(s.maxAge)
+	}
+
+	return cookie
+}
+
+func (s *session) newExpiredCookie(name string) *http.Cookie {
+	cookie := s.newCookie(name, "", 0)
+	cookie.MaxAge = -1
+	cookie.Expires = time.Unix(1, 0)
+
+	return cookie
 }
 
 func (s *session) decodeName(data string) (string, int64, error) {
+	if strings.HasPrefix(data, cookieVersion2) {
+		s.stale = s.version < 2
+
+		return s.decodeNameV2(data[len(cookieVersion2):])
+	}
+
+	s.stale = s.version >= 2
+
 	decoded, err := base64.URLEncoding.DecodeString(data)
 
 	if err != nil {
@@ -411,31 +1120,40 @@ func (s *session) decodeName(data string) (string, int64, error) {
 		return "", 0, err
 	}
 
-	sig := parts[2]
+	for i, block := range append([]cipher.Block{s.block}, s.oldBlocks...) {
+		sig := parts[2]
 
-	if s.block != nil {
-		size := s.block.BlockSize()
-		if len(sig) > size {
-			key := sig[:size]
-			sig = sig[size:]
+		if block != nil {
+			size := block.BlockSize()
+			if len(sig) <= size {
+				continue
+			}
 
-			ctr := cipher.NewCTR(s.block, key)
-			ctr.XORKeyStream(sig, sig)
-		} else {
-			return "", 0, errors.New("Invalid cookie encryption part")
+			sig = make([]byte, len(parts[2])-size)
+
+			ctr := cipher.NewCTR(block, parts[2][:size])
+			ctr.XORKeyStream(sig, parts[2][size:])
 		}
-	}
 
-	if !s.checkSignature(sig, parts[0], t1) {
-		return "", 0, errors.New("Signatures don't match")
+		for j, secret := range append([][]byte{s.secret}, s.oldSecrets...) {
+			if s.checkSignature(sig, parts[0], secret, t1) {
+				s.stale = s.stale || i > 0 || j > 0
+
+				return string(parts[0]), t1, nil
+			}
+		}
 	}
 
-	return string(parts[0]), t1, nil
+	return "", 0, errors.New("Signatures don't match")
 }
 
 func (s *session) encodeName() (string, int64, error) {
 	now := time.Now().Unix()
 
+	if s.version >= 2 {
+		return s.encodeNameV2(now)
+	}
+
 	sig, err := createSignature(s.cookieName, []byte(s.name), s.secret, now)
 
 	if err != nil {
@@ -460,8 +1178,87 @@ func (s *session) encodeName() (string, int64, error) {
 	return string(encoded), now, nil
 }
 
-func (s *session) checkSignature(signature, name []byte, date int64) bool {
-	expected, err := createSignature(s.cookieName, name, s.secret, date)
+func (s *session) decodeNameV2(data string) (string, int64, error) {
+	encrypted, err := base64.URLEncoding.DecodeString(data)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	var plain []byte
+	for i, aead := range s.aeads {
+		size := aead.NonceSize()
+		if len(encrypted) < size {
+			return "", 0, errors.New("Invalid cookie encryption part")
+		}
+
+		if plain, err = aead.Open(nil, encrypted[:size], encrypted[size:], []byte(cookieVersion2+s.cookieName)); err == nil {
+			s.stale = s.stale || i > 0
+			break
+		}
+	}
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	parts := bytes.SplitN(plain, []byte("|"), 2)
+	if len(parts) != 2 {
+		return "", 0, errors.New("Not enough cookie parts")
+	}
+
+	t1, err := strconv.ParseInt(string(parts[1]), 10, 64)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	return string(parts[0]), t1, nil
+}
+
+func (s *session) encodeNameV2(now int64) (string, int64, error) {
+	aead := s.aeads[0]
+
+	nonce, err := randomData(aead.NonceSize())
+	if err != nil {
+		return "", 0, err
+	}
+
+	message := []byte(fmt.Sprintf("%s|%d", s.name, now))
+
+	encoded := base64.URLEncoding.EncodeToString(
+		aead.Seal(nonce, nonce, message, []byte(cookieVersion2+s.cookieName)))
+
+	return cookieVersion2 + encoded, now, nil
+}
+
+// initAEADs creates the AES-GCM ciphers used for encrypting the cookie
+// payload. The first one uses the session cipher, or a key derived from
+// the secret, and is used for encryption. The rest are created from the
+// old ciphers and secrets, and are only used for decryption.
+func (s *session) initAEADs() {
+	blocks := []cipher.Block{s.block}
+	if s.block == nil {
+		blocks[0] = secretBlock(s.secret)
+	}
+
+	blocks = append(blocks, s.oldBlocks...)
+	for _, secret := range s.oldSecrets {
+		blocks = append(blocks, secretBlock(secret))
+	}
+
+	s.aeads = make([]cipher.AEAD, len(blocks))
+	for i, block := range blocks {
+		if aead, err := cipher.NewGCM(block); err == nil {
+			s.aeads[i] = aead
+		} else {
+			panic(err)
+		}
+	}
+}
+
+func (s *session) checkSignature(signature, name, secret []byte, date int64) bool {
+	expected, err := createSignature(s.cookieName, name, secret, date)
 	if err != nil {
 		return false
 	}
@@ -502,3 +1299,27 @@ func randomData(size int) ([]byte, error) {
 	}
 	return data, nil
 }
+
+func secretBlock(secret []byte) cipher.Block {
+	key := sha256.Sum256(secret)
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return block
+}
+
+// unchanged reports whether a new value of a basic type is equal to the
+// old one. Other types are always considered changed, since they may have
+// been modified in place.
+func unchanged(old, val interface{}) bool {
+	switch val.(type) {
+	case string, bool, int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, float32, float64:
+		return old == val
+	}
+
+	return false
+}
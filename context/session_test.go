@@ -4,11 +4,11 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -18,10 +18,10 @@ import (
 var secret = []byte("test")
 
 func TestSession(t *testing.T) {
-	os.Remove(path.Join(os.TempDir(), "test1"))
-	os.Remove(path.Join(os.TempDir(), "test2"))
-	os.Remove(path.Join(os.TempDir(), "test3"))
-	os.Remove(path.Join(os.TempDir(), "test4"))
+	NewFileStore(os.TempDir()).Delete("test1")
+	NewFileStore(os.TempDir()).Delete("test2")
+	NewFileStore(os.TempDir()).Delete("test3")
+	NewFileStore(os.TempDir()).Delete("test4")
 
 	s := NewSession(secret, nil, os.TempDir())
 	s.SetName("test1")
@@ -225,7 +225,7 @@ func TestCleanup(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := os.Stat(filepath.Join(root, "test1")); !os.IsNotExist(err) {
+	if _, err := os.Stat(NewFileStore(root).filename("test1")); !os.IsNotExist(err) {
 		t.Fatal("Session 'test1' already exists")
 	}
 
@@ -234,7 +234,7 @@ func TestCleanup(t *testing.T) {
 	rec := httptest.NewRecorder()
 	s.Write(rec)
 
-	if _, err := os.Stat(filepath.Join(root, "test1")); os.IsNotExist(err) {
+	if _, err := os.Stat(NewFileStore(root).filename("test1")); os.IsNotExist(err) {
 		t.Fatal(err)
 	}
 
@@ -248,7 +248,7 @@ func TestCleanup(t *testing.T) {
 	rec = httptest.NewRecorder()
 	s.Write(rec)
 
-	if _, err := os.Stat(filepath.Join(root, "test2")); os.IsNotExist(err) {
+	if _, err := os.Stat(NewFileStore(root).filename("test2")); os.IsNotExist(err) {
 		t.Fatal(err)
 	}
 
@@ -299,7 +299,7 @@ func TestCleanup(t *testing.T) {
 		t.Fatalf("Expected the session to not have values\n")
 	}
 
-	if _, err := os.Stat(filepath.Join(root, "test3")); os.IsNotExist(err) {
+	if _, err := os.Stat(NewFileStore(root).filename("test3")); os.IsNotExist(err) {
 		t.Fatal(err)
 	}
 
@@ -307,7 +307,7 @@ func TestCleanup(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := os.Stat(filepath.Join(root, "test3")); !os.IsNotExist(err) {
+	if _, err := os.Stat(NewFileStore(root).filename("test3")); !os.IsNotExist(err) {
 		t.Fatalf("Expected the session 'test3' to not exist anymore")
 	}
 
@@ -336,3 +336,491 @@ func addCookie(t *testing.T, name string, r *http.Request, cipher []byte) {
 
 	r.AddCookie(cookie)
 }
+
+func TestSessionRegenerate(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "/sessions/")
+
+	s := NewSession(secret, nil, root)
+	s.SetName("test5")
+	s.Set("foo", "bar")
+
+	if err := s.Write(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.(RegenerableSession).Regenerate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Name() == "test5" {
+		t.Fatalf("Expected the session to have a new name\n")
+	}
+
+	if _, err := os.Stat(NewFileStore(root).filename("test5")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the old session data to be removed\n")
+	}
+
+	if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+		t.Fatalf("Expected value for `foo` to be 'bar', got '%v'\n", v)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := rec.Header().Get("Set-Cookie")
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+	name := s.Name()
+	s = NewSession(secret, nil, root)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Name() != name {
+		t.Fatalf("Expected the session name to be '%s', got '%s'\n", name, s.Name())
+	}
+
+	if err := s.(RegenerableSession).Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.Get("foo"); ok {
+		t.Fatalf("Expected the session to not have values\n")
+	}
+
+	if _, err := os.Stat(NewFileStore(root).filename(name)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the session data to be removed\n")
+	}
+
+	rec = httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("Expected an expired session cookie, got %v\n", cookies)
+	}
+
+	if _, err := os.Stat(NewFileStore(root).filename(name)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the destroyed session to not be written\n")
+	}
+}
+
+func TestSessionRegenerateLazy(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "/sessions/")
+	store := NewFileStore(root)
+
+	s := NewSession(secret, nil, root)
+	s.SetName("test6")
+	s.Set("foo", "bar")
+	s.(UserSession).SetUser("john")
+	s.(FlashSession).AddFlash(FlashSuccess, "Logged in")
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := rec.Header().Get("Set-Cookie")
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+	s = NewSession(secret, nil, root)
+	s.(StoreSession).SetLazyLoad(true)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.(RegenerableSession).Regenerate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Name() == "test6" {
+		t.Fatalf("Expected the session to have a new name\n")
+	}
+
+	if _, err := store.Get("test6"); err != ErrNotExist {
+		t.Fatalf("Expected the old session data to be removed, got '%v'\n", err)
+	}
+
+	if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+		t.Fatalf("Expected value for `foo` to be 'bar', got '%v'\n", v)
+	}
+
+	if user := s.(UserSession).User(); user != "john" {
+		t.Fatalf("Expected the user to be kept, got '%s'\n", user)
+	}
+
+	if flashes := s.(FlashSession).PeekFlashes(); len(flashes) != 1 {
+		t.Fatalf("Expected the flash messages to be kept, got %v\n", flashes)
+	}
+
+	if err := s.Write(httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := store.UserSessions("john")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 1 || names[0] != s.Name() {
+		t.Fatalf("Expected only the new session in the user index, got %v\n", names)
+	}
+
+	if err := s.(RegenerableSession).Destroy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	oldCipher, _ := base64.StdEncoding.DecodeString(`HsPW6w85KMiTNm7q5ZaruE/f3Hl9wlKFYP8AyYF/N7s=`)
+	newCipher, _ := base64.StdEncoding.DecodeString(`3Bz0WQ4nY7Lp0qkKxVqjq1oI2jv0wRZbVZ7Tn4mS2lE=`)
+	newSecret := []byte("rotated")
+
+	for _, generator := range []SessionGenerator{NewSession, NewCookieSession} {
+		s := generator(secret, oldCipher, os.TempDir())
+		s.SetName("test6")
+		s.Set("foo", "bar")
+
+		rec := httptest.NewRecorder()
+		if err := s.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+
+		cookie := rec.Header().Get("Set-Cookie")
+		r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+		r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+		s = generator(newSecret, newCipher, os.TempDir())
+		if err := s.Read(r, nil); err == nil {
+			t.Fatalf("Expected a verification error without the old keys\n")
+		}
+
+		s = generator(newSecret, newCipher, os.TempDir())
+		s.(CookieOptionsSession).SetOldKeys([][]byte{secret}, [][]byte{oldCipher})
+
+		if err := s.Read(r, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+			t.Fatalf("Expected value for `foo` to be 'bar', got '%v'\n", v)
+		}
+
+		rec = httptest.NewRecorder()
+		if err := s.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+
+		cookie = rec.Header().Get("Set-Cookie")
+		r, _ = http.NewRequest("GET", "http://localhost:8080", nil)
+		r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+		s = generator(newSecret, newCipher, os.TempDir())
+		if err := s.Read(r, nil); err != nil {
+			t.Fatalf("Expected the cookie to be signed with the new keys, got '%v'\n", err)
+		}
+	}
+}
+
+func TestSessionCookieVersion(t *testing.T) {
+	s := NewSession(secret, nil, os.TempDir())
+	s.SetName("test7")
+	s.Set("foo", "bar")
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := rec.Header().Get("Set-Cookie")
+
+	s.(CookieOptionsSession).SetCookieVersion(2)
+
+	rec = httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	v2 := rec.Header().Get("Set-Cookie")
+	if !strings.HasPrefix(v2, "session=v2.") {
+		t.Fatalf("Expected a versioned cookie, got '%s'\n", v2)
+	}
+
+	decoded, err := base64.URLEncoding.DecodeString(v2[len("session=v2."):strings.Index(v2, ";")])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(decoded), "test7") {
+		t.Fatalf("Expected the session name to be encrypted\n")
+	}
+
+	for _, cookie := range []string{v1, v2} {
+		r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+		r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+		s = NewSession(secret, nil, os.TempDir())
+		s.(CookieOptionsSession).SetCookieVersion(2)
+
+		if err := s.Read(r, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if s.Name() != "test7" {
+			t.Fatalf("Expected the session name to be 'test7', got '%s'\n", s.Name())
+		}
+	}
+
+	value := v2[:strings.Index(v2, ";")]
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Cookie", value[:len(value)-4]+"AAA=")
+
+	s = NewSession(secret, nil, os.TempDir())
+	if err := s.Read(r, nil); err == nil {
+		t.Fatalf("Expected an error for a tampered cookie\n")
+	}
+}
+
+func TestSessionModified(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "/sessions/")
+
+	s := NewSession(secret, nil, root)
+	s.SetName("test8")
+	s.(StoreSession).SetRefreshThreshold(time.Hour)
+
+	if !s.(StoreSession).Modified() {
+		t.Fatalf("Expected a new session to be modified\n")
+	}
+
+	s.Set("foo", "bar")
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.(StoreSession).Modified() {
+		t.Fatalf("Expected a written session to not be modified\n")
+	}
+
+	s.Set("foo", "bar")
+	if s.(StoreSession).Modified() {
+		t.Fatalf("Expected setting the same value to not modify the session\n")
+	}
+
+	cookie := rec.Header().Get("Set-Cookie")
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+	s = NewSession(secret, nil, root)
+	s.(StoreSession).SetRefreshThreshold(time.Hour)
+	s.(StoreSession).SetLazyLoad(true)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.(*session).loaded {
+		t.Fatalf("Expected the session data to not be loaded yet\n")
+	}
+
+	if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+		t.Fatalf("Expected value for `foo` to be 'bar', got '%v'\n", v)
+	}
+
+	if s.(StoreSession).Modified() {
+		t.Fatalf("Expected a read session to not be modified\n")
+	}
+
+	s.Delete("foo")
+	if !s.(StoreSession).Modified() {
+		t.Fatalf("Expected the session to be modified after a deletion\n")
+	}
+
+	s = NewSession(secret, nil, root)
+	s.(StoreSession).SetLazyLoad(true)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.(StoreSession).Modified() {
+		t.Fatalf("Expected the session to need a refresh without a threshold\n")
+	}
+}
+
+// failingStore fails to read any session data.
+type failingStore struct {
+	SessionStore
+}
+
+func (fs failingStore) Get(name string) ([]byte, error) {
+	return nil, errors.New("Store unavailable")
+}
+
+func TestSessionLoadFailure(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "/sessions/")
+
+	s := NewSession(secret, nil, root)
+	s.SetName("test12")
+	s.Set("foo", "bar")
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := rec.Header().Get("Set-Cookie")
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+	s = NewSession(secret, nil, root)
+	s.(StoreSession).SetStore(failingStore{NewFileStore(root)})
+	s.(StoreSession).SetLazyLoad(true)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.Get("foo"); ok {
+		t.Fatalf("Expected the values to be unavailable\n")
+	}
+
+	s.Set("baz", "qux")
+
+	if err := s.Write(httptest.NewRecorder()); err == nil {
+		t.Fatalf("Expected the write to fail after a failed load\n")
+	}
+
+	s = NewSession(secret, nil, root)
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+		t.Fatalf("Expected the stored value for `foo` to be 'bar', got '%v'\n", v)
+	}
+
+	if _, ok := s.Get("baz"); ok {
+		t.Fatalf("Expected the stored data to be left intact\n")
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "/sessions/")
+
+	s := NewSession(secret, nil, root)
+	s.SetName("test9")
+	s.Set("foo", "bar")
+
+	rec := httptest.NewRecorder()
+	if err := s.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := rec.Header().Get("Set-Cookie")
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+	var reasons []ExpiryReason
+	handler := func(s Session, reason ExpiryReason) {
+		if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+			t.Fatalf("Expected the expired session values to be available, got '%v'\n", v)
+		}
+
+		reasons = append(reasons, reason)
+	}
+
+	s = NewSession(secret, nil, root)
+	s.(TimeoutSession).SetIdleTimeout(time.Nanosecond)
+	s.(TimeoutSession).SetExpiryHandler(handler)
+	time.Sleep(time.Second)
+
+	if err := s.Read(r, nil); err != ErrExpired {
+		t.Fatalf("Expected an idle session to expire, got '%v'\n", err)
+	}
+
+	if len(reasons) != 1 || reasons[0] != ExpiredIdle {
+		t.Fatalf("Expected an idle expiry, got %v\n", reasons)
+	}
+
+	if _, ok := s.Get("foo"); ok {
+		t.Fatalf("Expected the expired session to be empty\n")
+	}
+
+	reasons = nil
+	s = NewSession(secret, nil, root)
+	s.(TimeoutSession).SetAbsoluteTimeout(time.Millisecond)
+	s.(TimeoutSession).SetExpiryHandler(handler)
+	s.(StoreSession).SetLazyLoad(true)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reasons) != 0 {
+		t.Fatalf("Expected the absolute timeout to be checked when loading the data\n")
+	}
+
+	created := s.(TimeoutSession).Created()
+
+	if len(reasons) != 1 || reasons[0] != ExpiredAbsolute {
+		t.Fatalf("Expected an absolute expiry, got %v\n", reasons)
+	}
+
+	if time.Since(created) > time.Second {
+		t.Fatalf("Expected the expired session to start a new lifetime, created at %v\n", created)
+	}
+
+	if !s.(StoreSession).Modified() {
+		t.Fatalf("Expected the expired session to be modified\n")
+	}
+
+	s = NewSession(secret, nil, root)
+	s.(TimeoutSession).SetAbsoluteTimeout(time.Hour)
+
+	if err := s.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := s.Get("foo"); !ok || v.(string) != "bar" {
+		t.Fatalf("Expected value for `foo` to be 'bar', got '%v'\n", v)
+	}
+}
+
+func TestSessionCapabilities(t *testing.T) {
+	for _, generator := range []SessionGenerator{NewSession, NewCookieSession} {
+		s := generator(secret, nil, os.TempDir())
+
+		if _, ok := s.(CookieOptionsSession); !ok {
+			t.Fatalf("Expected %T to be a CookieOptionsSession\n", s)
+		}
+
+		if _, ok := s.(StoreSession); !ok {
+			t.Fatalf("Expected %T to be a StoreSession\n", s)
+		}
+
+		if _, ok := s.(TimeoutSession); !ok {
+			t.Fatalf("Expected %T to be a TimeoutSession\n", s)
+		}
+
+		if _, ok := s.(UserSession); !ok {
+			t.Fatalf("Expected %T to be a UserSession\n", s)
+		}
+
+		if _, ok := s.(RegenerableSession); !ok {
+			t.Fatalf("Expected %T to be a RegenerableSession\n", s)
+		}
+
+		if _, ok := s.(FlashSession); !ok {
+			t.Fatalf("Expected %T to be a FlashSession\n", s)
+		}
+	}
+}
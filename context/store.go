@@ -0,0 +1,442 @@
+package context
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A SessionStore persists the serialized session data, keyed by the session
+// name. The Get method should return ErrNotExist if no data is stored under
+// the given name. The maxAge passed to Set is the session max-age, and may be
+// used by the store to expire the data on its own. The Cleanup method
+// removes all data older than the given age, or all data if the age is 0.
+type SessionStore interface {
+	Get(name string) ([]byte, error)
+	Set(name string, data []byte, maxAge time.Duration) error
+	Delete(name string) error
+	Cleanup(age time.Duration) error
+}
+
+// A SessionIndex is a session store, which also keeps an index of the
+// sessions that belong to each user. The UserSessions method may return
+// names of sessions whose data no longer exists, and it is up to the
+// caller to skip them.
+type SessionIndex interface {
+	SessionStore
+	AddUserSession(user, name string) error
+	RemoveUserSession(user, name string) error
+	UserSessions(user string) ([]string, error)
+}
+
+// A SessionCleaner is a session store, which reports the outcome of each
+// cleanup.
+type SessionCleaner interface {
+	CleanupWithStats(age time.Duration) (CleanupStats, error)
+}
+
+// FileStore is the default session store. It keeps the session data as
+// files in the directory specified by its Path field. In order to keep
+// the directories small, each file is placed in a subdirectory, named
+// after the first two hex digits of the hash of the session name. Files
+// written directly in the Path directory by previous versions are still
+// read, and are moved to their subdirectory when written again.
+//
+// The sessions of each user are indexed as empty files in a "users"
+// subdirectory. Index entries of sessions, whose data no longer exists, are
+// removed during a cleanup. Sessions may be locked, though the locks are
+// only held within the current process.
+type FileStore struct {
+	Path string
+}
+
+// CleanupStats describes a single session cleanup.
+type CleanupStats struct {
+	Scanned  int
+	Removed  int
+	Duration time.Duration
+}
+
+// The number of directory entries read at once during a cleanup.
+const cleanupBatchSize = 256
+
+// File operations are guarded by a fixed number of locks, chosen by the
+// hash of the file path, so that operations on different sessions rarely
+// block each other.
+var fileLocks [64]sync.RWMutex
+
+// NewFileStore creates a session store, using the given directory path.
+func NewFileStore(path string) FileStore {
+	return FileStore{Path: path}
+}
+
+// Get reads the session data from the file named after the session.
+func (fs FileStore) Get(name string) ([]byte, error) {
+	for _, filename := range []string{fs.filename(name), fs.flatFilename(name)} {
+		lock := fileLock(filename)
+
+		lock.RLock()
+		b, err := ioutil.ReadFile(filename)
+		lock.RUnlock()
+
+		if err == nil {
+			return b, nil
+		}
+	}
+
+	return nil, ErrNotExist
+}
+
+// Set writes the session data to a file, named after the session. The
+// directory is created if it doesn't exist.
+func (fs FileStore) Set(name string, data []byte, maxAge time.Duration) error {
+	if filepath.Separator != '/' && strings.IndexRune(name, filepath.Separator) >= 0 ||
+		strings.Contains(name, "\x00") {
+		return errors.New("http: invalid character in file path")
+	}
+
+	if err := fs.writeFile(fs.filename(name), data); err != nil {
+		return err
+	}
+
+	return fs.removeFile(fs.flatFilename(name))
+}
+
+// Delete removes the session data file.
+func (fs FileStore) Delete(name string) error {
+	for _, filename := range []string{fs.filename(name), fs.flatFilename(name)} {
+		if err := fs.removeFile(filename); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Cleanup removes all session data files older than the given age. If the
+// age is 0, all session data is removed.
+func (fs FileStore) Cleanup(age time.Duration) error {
+	_, err := fs.CleanupWithStats(age)
+
+	return err
+}
+
+// CleanupWithStats removes all session data files older than the given
+// age, like Cleanup, and returns the number of scanned and removed files. The
+// directories are read in batches, and each file is locked only while it
+// is being removed, so that the sessions may be used during the cleanup.
+// Afterwards, the user index entries of the missing sessions are removed.
+func (fs FileStore) CleanupWithStats(age time.Duration) (CleanupStats, error) {
+	start := time.Now()
+	stats := CleanupStats{}
+
+	var min time.Time
+	if age > 0 {
+		min = start.Add(-age)
+	}
+
+	dirs := []string{fs.Path}
+	for i := 0; i < 256; i++ {
+		dirs = append(dirs, filepath.Join(fs.Path, fmt.Sprintf("%02x", i)))
+	}
+
+	for _, dir := range dirs {
+		if err := fs.cleanupDir(dir, min, &stats); err != nil {
+			stats.Duration = time.Since(start)
+			return stats, err
+		}
+	}
+
+	err := fs.cleanupUsers()
+	stats.Duration = time.Since(start)
+
+	return stats, err
+}
+
+// AddUserSession adds the session name to the index of the given user.
+func (fs FileStore) AddUserSession(user, name string) error {
+	dir := fs.userDir(user)
+	lock := fileLock(dir)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, filepath.Base(fs.filename(name))), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// RemoveUserSession removes the session name from the index of the given
+// user.
+func (fs FileStore) RemoveUserSession(user, name string) error {
+	dir := fs.userDir(user)
+	lock := fileLock(dir)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.Remove(filepath.Join(dir, filepath.Base(fs.filename(name)))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Only succeeds if there are no other sessions left
+	os.Remove(dir)
+
+	return nil
+}
+
+// UserSessions returns the names of all sessions in the user's index.
+func (fs FileStore) UserSessions(user string) ([]string, error) {
+	dir := fs.userDir(user)
+	lock := fileLock(dir)
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	names := make([]string, len(files))
+	for i, fi := range files {
+		names[i] = fi.Name()
+	}
+
+	return names, nil
+}
+
+// Lock locks the named session within the current process.
+func (fs FileStore) Lock(name string, timeout time.Duration) (func() error, error) {
+	return processLocks.lock(fs.filename(name), timeout)
+}
+
+func (fs FileStore) cleanupDir(dir string, min time.Time, stats *CleanupStats) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+	defer d.Close()
+
+	for {
+		files, err := d.Readdir(cleanupBatchSize)
+
+		for _, fi := range files {
+			if fi.IsDir() {
+				continue
+			}
+
+			stats.Scanned++
+
+			if !min.IsZero() && !fi.ModTime().Before(min) {
+				continue
+			}
+
+			removed, err := fs.removeOld(filepath.Join(dir, fi.Name()), min)
+			if err != nil {
+				return err
+			}
+
+			if removed {
+				stats.Removed++
+			}
+		}
+
+		if err == io.EOF || len(files) == 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// cleanupUsers removes the entries of the user indexes, whose sessions no
+// longer exist, along with any emptied index.
+func (fs FileStore) cleanupUsers() error {
+	users := filepath.Join(fs.Path, "users")
+	d, err := os.Open(users)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+	defer d.Close()
+
+	for {
+		dirs, err := d.Readdir(cleanupBatchSize)
+
+		for _, fi := range dirs {
+			if !fi.IsDir() {
+				continue
+			}
+
+			if err := fs.pruneUserDir(filepath.Join(users, fi.Name())); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF || len(dirs) == 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (fs FileStore) pruneUserDir(dir string) error {
+	lock := fileLock(dir)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, fi := range files {
+		if fs.exists(fi.Name()) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Only succeeds if there are no sessions left
+	os.Remove(dir)
+
+	return nil
+}
+
+// exists reports whether the data of the named session exists.
+func (fs FileStore) exists(name string) bool {
+	for _, filename := range []string{fs.filename(name), fs.flatFilename(name)} {
+		if _, err := os.Stat(filename); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeOld removes the file, if it hasn't been modified since it has
+// been scanned.
+func (fs FileStore) removeOld(filename string, min time.Time) (bool, error) {
+	lock := fileLock(filename)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if !min.IsZero() && !fi.ModTime().Before(min) {
+		return false, nil
+	}
+
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (fs FileStore) writeFile(filename string, data []byte) error {
+	lock := fileLock(filename)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(filename), os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+
+	return err
+}
+
+func (fs FileStore) removeFile(filename string) error {
+	lock := fileLock(filename)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (fs FileStore) userDir(user string) string {
+	sum := sha256.Sum256([]byte(user))
+
+	return filepath.Join(fs.Path, "users", hex.EncodeToString(sum[:]))
+}
+
+func (fs FileStore) filename(name string) string {
+	name = filepath.FromSlash(path.Clean("/" + name))
+	sum := sha256.Sum256([]byte(name))
+
+	return filepath.Join(fs.Path, hex.EncodeToString(sum[:1]), name)
+}
+
+// flatFilename returns the location of the session file, written by
+// previous versions of the store.
+func (fs FileStore) flatFilename(name string) string {
+	return filepath.Join(fs.Path, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func fileLock(filename string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(filename))
+
+	return &fileLocks[h.Sum32()%uint32(len(fileLocks))]
+}
@@ -0,0 +1,124 @@
+package context
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "webfw-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	store := NewFileStore(root)
+
+	if err := store.Set("sharded", []byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := store.filename("sharded")
+	if filepath.Dir(filepath.Dir(filename)) != root {
+		t.Fatalf("Expected '%s' to be in a subdirectory of '%s'\n", filename, root)
+	}
+
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// Data written by previous versions of the store
+	legacy := filepath.Join(root, "legacy")
+	if err := ioutil.WriteFile(legacy, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := store.Get("legacy"); err != nil || string(b) != "old" {
+		t.Fatalf("Expected the legacy data to be 'old', got '%s', %v\n", b, err)
+	}
+
+	if err := store.Set("legacy", []byte("new"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("Expected the legacy file to be removed\n")
+	}
+
+	if b, err := store.Get("legacy"); err != nil || string(b) != "new" {
+		t.Fatalf("Expected the data to be 'new', got '%s', %v\n", b, err)
+	}
+
+	if err := store.Delete("legacy"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get("legacy"); err != ErrNotExist {
+		t.Fatalf("Expected ErrNotExist, got %v\n", err)
+	}
+
+	if err := ioutil.WriteFile(legacy, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.AddUserSession("john", "sharded"); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, f := range []string{legacy, filename} {
+		if err := os.Chtimes(f, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Set("fresh", []byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.AddUserSession("john", "fresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.AddUserSession("jane", "legacy"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.CleanupWithStats(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Scanned != 3 || stats.Removed != 2 {
+		t.Fatalf("Expected 2 of 3 sessions to be removed, got %+v\n", stats)
+	}
+
+	for _, name := range []string{"sharded", "legacy"} {
+		if _, err := store.Get(name); err != ErrNotExist {
+			t.Fatalf("Expected '%s' to be removed, got %v\n", name, err)
+		}
+	}
+
+	if _, err := store.Get("fresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	if names, err := store.UserSessions("john"); err != nil || len(names) != 1 || names[0] != "fresh" {
+		t.Fatalf("Expected only the existing session in the user index, got %v, %v\n", names, err)
+	}
+
+	if _, err := os.Stat(store.userDir("jane")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the emptied user index to be removed, got %v\n", err)
+	}
+
+	if err := store.Cleanup(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get("fresh"); err != ErrNotExist {
+		t.Fatalf("Expected all sessions to be removed, got %v\n", err)
+	}
+}
@@ -113,15 +113,8 @@ func (d Dispatcher) NameToPath(name string, method Method, params ...RouteParams
 // RequestRoute returns the route object and params associated with the
 // supplied request.
 func (d Dispatcher) RequestRoute(r *http.Request) (Route, RouteParams, bool) {
-	path := strings.SplitN(r.RequestURI, "?", 2)[0]
-	if path == "" {
-		path = r.URL.RequestURI()
-	}
-	if d.Pattern != "/" {
-		path = path[len(d.Pattern)-1:]
-	}
 	method := ReverseMethodNames[r.Method]
-	match, matchFound := d.trie.Lookup(path, method)
+	match, matchFound := d.trie.Lookup(d.requestPath(r), method)
 
 	if matchFound {
 		r, ok := match.RouteMap[method]
@@ -132,6 +125,32 @@ func (d Dispatcher) RequestRoute(r *http.Request) (Route, RouteParams, bool) {
 	}
 }
 
+// RequestMethods returns the methods of all routes, registered for the path
+// of the supplied request, regardless of the request method.
+func (d Dispatcher) RequestMethods(r *http.Request) Method {
+	var methods Method
+
+	if match, ok := d.trie.Lookup(d.requestPath(r), MethodAll); ok {
+		for method := range match.RouteMap {
+			methods |= method
+		}
+	}
+
+	return methods
+}
+
+func (d Dispatcher) requestPath(r *http.Request) string {
+	path := strings.SplitN(r.RequestURI, "?", 2)[0]
+	if path == "" {
+		path = r.URL.RequestURI()
+	}
+	if d.Pattern != "/" {
+		path = path[len(d.Pattern)-1:]
+	}
+
+	return path
+}
+
 // Initialize creates all configured middleware handlers, producing a chain of
 // functions to be called on each request. Initializes and registers all
 // handled controllers. This function is called automatically by the Server
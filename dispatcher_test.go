@@ -394,3 +394,28 @@ func (mmw MyCustomMW3) Handler(ph http.Handler, c context.Context) http.Handler
 
 	return http.HandlerFunc(handler)
 }
+
+func TestDispatcherRequestMethods(t *testing.T) {
+	d := NewDispatcher("/api/", Config{})
+
+	d.Handle(controller{pattern: "/items", method: MethodGet | MethodHead})
+	d.Handle(controller{pattern: "/items", method: MethodPost})
+	d.Handle(controller{pattern: "/items/:id", method: MethodPut | MethodDelete})
+
+	d.Initialize()
+
+	for uri, expected := range map[string]Method{
+		"/api/items":       MethodGet | MethodHead | MethodPost,
+		"/api/items?q=1":   MethodGet | MethodHead | MethodPost,
+		"/api/items/42":    MethodPut | MethodDelete,
+		"/api/unknown":     0,
+		"/api/items/42/44": 0,
+	} {
+		r, _ := http.NewRequest("OPTIONS", "http://localhost:8080"+uri, nil)
+		r.RequestURI = uri
+
+		if m := d.RequestMethods(r); m != expected {
+			t.Fatalf("Expected methods %d for '%s', got %d\n", expected, uri, m)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package webfw
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/sse"
+)
+
+/*
+The EventSourceController streams the events, published to its Hub, to
+browsers using the Server-Sent Events protocol. Clients reconnecting with a
+Last-Event-ID header receive any events they have missed, as long as those
+are still in the hub's history.
+
+If Retry is set, it is sent to the client as the reconnection delay. If
+Heartbeat is set, a comment is sent whenever there have been no events for
+that long, so that idle connections aren't closed by proxies. If Authorize
+is set, and it returns false, the request is rejected with a "403
+Forbidden" status.
+*/
+type EventSourceController struct {
+	BasePatternController
+
+	Hub       *sse.Hub
+	Retry     time.Duration
+	Heartbeat time.Duration
+	Authorize func(r *http.Request) bool
+}
+
+// NewEventSourceController creates an event stream controller for the
+// given pattern and route name, handling GET requests.
+func NewEventSourceController(pattern, name string, hub *sse.Hub) EventSourceController {
+	return EventSourceController{
+		BasePatternController: NewBasePatternController(pattern, MethodGet, name),
+		Hub:                   hub,
+		Heartbeat:             30 * time.Second,
+	}
+}
+
+func (con EventSourceController) Handler(c context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if con.Authorize != nil && !con.Authorize(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		sw, err := sse.NewWriter(w)
+		if err != nil {
+			GetLogger(c).Printf("Unable to start the event stream: %v\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if con.Retry > 0 {
+			if err := sw.Retry(con.Retry); err != nil {
+				return
+			}
+		}
+
+		sub := con.Hub.Subscribe(sse.LastEventID(r))
+		defer con.Hub.Unsubscribe(sub)
+
+		var heartbeat <-chan time.Time
+		if con.Heartbeat > 0 {
+			ticker := time.NewTicker(con.Heartbeat)
+			defer ticker.Stop()
+
+			heartbeat = ticker.C
+		}
+
+		sent := false
+		for {
+			select {
+			case e, ok := <-sub.Events:
+				if !ok {
+					return
+				}
+
+				if err := sw.Send(e); err != nil {
+					return
+				}
+				sent = true
+			case <-heartbeat:
+				if !sent {
+					if err := sw.Comment(""); err != nil {
+						return
+					}
+				}
+				sent = false
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package webfw
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urandom/webfw/sse"
+)
+
+func TestEventSourceController(t *testing.T) {
+	hub := sse.NewHub(10)
+	hub.Publish(sse.Event{Data: "seen"})
+	hub.Publish(sse.Event{Data: "missed"})
+
+	con := NewEventSourceController("/events", "events", hub)
+	con.Retry = time.Second
+
+	d := NewDispatcher("/", Config{})
+	d.Handle(con)
+	d.Initialize()
+
+	server := httptest.NewServer(d)
+	defer server.Close()
+
+	r, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	r.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got '%s'\n", ct)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if e := readEvent(); e != "retry: 1000\n" {
+		t.Fatalf("Expected the retry delay, got '%q'\n", e)
+	}
+
+	// Events published before the subscription
+	if e := readEvent(); e != "id: 2\ndata: missed\n" {
+		t.Fatalf("Expected the missed event, got '%q'\n", e)
+	}
+
+	for hub.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	hub.Publish(sse.Event{Event: "update", Data: "live"})
+
+	if e := readEvent(); e != "id: 3\nevent: update\ndata: live\n" {
+		t.Fatalf("Expected the live event, got '%q'\n", e)
+	}
+
+	hub.Close()
+
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Fatalf("Expected the stream to end when the hub is closed\n")
+	}
+
+	con.Authorize = func(r *http.Request) bool { return false }
+	w := httptest.NewRecorder()
+	con.Handler(d.Context).ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected code %d, got %d\n", http.StatusForbidden, w.Code)
+	}
+}
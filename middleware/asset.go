@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/urandom/webfw/fs"
+)
+
+// AssetManifest maps the paths of static files, relative to the static
+// directory, to their fingerprinted paths. A fingerprinted path contains a
+// hash of the file contents before the extension, such as "app.3f9a1c2b.js"
+// for "app.js".
+type AssetManifest map[string]string
+
+// FingerprintAssets scans the static directory, either on disk or in the
+// default embedded file system, and fingerprints every file in it. Hidden
+// files, and precompressed variants of other files, are skipped.
+func FingerprintAssets(root string) (AssetManifest, error) {
+	m := AssetManifest{}
+
+	if err := m.scan(root, ""); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Path returns the fingerprinted path of the asset, or the given path if
+// the asset isn't in the manifest.
+func (m AssetManifest) Path(name string) string {
+	key := strings.TrimPrefix(name, "/")
+
+	if fingerprinted, ok := m[key]; ok {
+		return name[:len(name)-len(key)] + fingerprinted
+	}
+
+	return name
+}
+
+// WriteFile writes the manifest as a JSON object to the named file, for use
+// by external tools.
+func (m AssetManifest) WriteFile(name string) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(name, b, 0644)
+}
+
+// originals maps the fingerprinted paths back to the asset paths.
+func (m AssetManifest) originals() map[string]string {
+	originals := make(map[string]string, len(m))
+	for name, fingerprinted := range m {
+		originals[fingerprinted] = name
+	}
+
+	return originals
+}
+
+func (m AssetManifest) scan(root, dir string) error {
+	file, err := fs.DefaultFS.OpenRoot(root, dir)
+	if err != nil {
+		return err
+	}
+
+	stats, err := file.Readdir(-1)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for _, stat := range stats {
+		names[stat.Name()] = true
+	}
+
+	for _, stat := range stats {
+		name := stat.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		if stat.IsDir() {
+			if err := m.scan(root, path.Join(dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if ext := path.Ext(name); ext == ".br" || ext == ".gz" {
+			if names[strings.TrimSuffix(name, ext)] {
+				continue
+			}
+		}
+
+		asset := path.Join(dir, name)
+		hash, err := hashAsset(root, asset)
+		if err != nil {
+			return err
+		}
+
+		ext := path.Ext(asset)
+		m[asset] = asset[:len(asset)-len(ext)] + "." + hash + ext
+	}
+
+	return nil
+}
+
+func hashAsset(root, name string) (string, error) {
+	file, err := fs.DefaultFS.OpenRoot(root, name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))[:8], nil
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/renderer"
+)
+
+func TestFingerprintAssets(t *testing.T) {
+	dir, files := assetDir(t)
+	defer os.RemoveAll(dir)
+
+	m, err := FingerprintAssets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m) != 3 {
+		t.Fatalf("Expected 3 fingerprinted assets, got %v\n", m)
+	}
+
+	for name, expected := range map[string]string{
+		"app.js":       "app." + assetHash(files["app.js"]) + ".js",
+		"css/site.css": "css/site." + assetHash(files["css/site.css"]) + ".css",
+		"LICENSE":      "LICENSE." + assetHash(files["LICENSE"]),
+	} {
+		if m[name] != expected {
+			t.Fatalf("Expected '%s' for '%s', got '%s'\n", expected, name, m[name])
+		}
+	}
+
+	if p := m.Path("/app.js"); p != "/"+m["app.js"] {
+		t.Fatalf("Expected the fingerprinted path, got '%s'\n", p)
+	}
+
+	if p := m.Path("missing.js"); p != "missing.js" {
+		t.Fatalf("Expected an unknown asset to keep its path, got '%s'\n", p)
+	}
+
+	manifest := path.Join(dir, ".manifest.json")
+	if err := m.WriteFile(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadFile(manifest)
+
+	var decoded map[string]string
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded["app.js"] != m["app.js"] {
+		t.Fatalf("Expected the manifest to contain the assets, got '%s'\n", b)
+	}
+}
+
+func TestStaticHandlerFingerprint(t *testing.T) {
+	dir, files := assetDir(t)
+	defer os.RemoveAll(dir)
+
+	c := context.NewContext()
+	ren := renderer.NewRenderer("testdata", "test.tmpl")
+	c.SetGlobal(context.BaseCtxKey("renderer"), ren)
+
+	manifest := path.Join(dir, ".manifest.json")
+	mw := Static{Path: dir, Prefix: "/static", Fingerprint: true, Manifest: manifest}
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/page" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := ren.Render(w, nil, c.GetAll(r), "test_asset.tmpl"); err != nil {
+			t.Fatal(err)
+		}
+	}), c)
+
+	if _, err := os.Stat(manifest); err != nil {
+		t.Fatalf("Expected the manifest to be written, got %v\n", err)
+	}
+
+	uri := "/static/app." + assetHash(files["app.js"]) + ".js"
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/page", nil)
+	r.RequestURI = "/page"
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if expected := "[asset: " + uri + "]"; !strings.Contains(rec.Body.String(), expected) {
+		t.Fatalf("Expected '%s' in '%s'\n", expected, rec.Body.String())
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080"+uri, nil)
+	r.RequestURI = uri
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != files["app.js.gz"] {
+		t.Fatalf("Expected the precompressed asset, got %d '%s'\n", rec.Code, rec.Body.String())
+	}
+
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Fatalf("Expected an immutable Cache-Control header, got '%s'\n", cc)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/static/app.js", nil)
+	r.RequestURI = "/static/app.js"
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != files["app.js"] {
+		t.Fatalf("Expected the original asset, got %d '%s'\n", rec.Code, rec.Body.String())
+	}
+
+	if cc := rec.Header().Get("Cache-Control"); cc != "" {
+		t.Fatalf("Expected no Cache-Control header for the original path, got '%s'\n", cc)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/static/app.00000000.js", nil)
+	r.RequestURI = "/static/app.00000000.js"
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected code %d for a stale fingerprint, got %d\n", http.StatusNotFound, rec.Code)
+	}
+}
+
+func assetDir(t *testing.T) (string, map[string]string) {
+	dir, err := ioutil.TempDir("", "webfw-asset")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"app.js":       "var app;",
+		"app.js.gz":    "gzip compressed app",
+		"css/site.css": "body {}",
+		"LICENSE":      "license",
+		".hidden":      "hidden",
+	}
+
+	os.Mkdir(path.Join(dir, "css"), 0755)
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir, files
+}
+
+func assetHash(content string) string {
+	hash := sha256.Sum256([]byte(content))
+
+	return hex.EncodeToString(hash[:])[:8]
+}
@@ -0,0 +1,470 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	stdcontext "context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urandom/webfw"
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/util"
+)
+
+/*
+The Cache middleware stores the responses of GET and HEAD requests in an
+in-process ResponseCache, and serves subsequent requests from it. Responses
+are keyed on the method, path and query of the request, as well as the
+request headers listed in "VaryHeaders" and in the Vary header of the
+response. Concurrent requests for a response that isn't cached yet wait
+for the first one, instead of calling the handlers themselves. They are
+released as soon as its headers show that it won't be stored, or once it
+is flushed.
+
+A response is only cached if its status is 200, 203, 301, 404 or 410, it
+doesn't set any cookies or vary by them, and its Cache-Control header
+doesn't contain "no-store", "no-cache" or "private". Its lifetime is taken
+from the "s-maxage" or "max-age" directives of the Cache-Control header,
+falling back to "TTL". Once it expires, a response may still be served for
+the "stale-while-revalidate" directive duration, or the
+"StaleWhileRevalidate" one, while it is refreshed in the background,
+without the session of the request. If the Session middleware is placed
+before the Cache one in the dispatcher configuration, it doesn't create a
+session for such refreshes, as its cookie would prevent the refreshed
+response from being stored. Requests with an Authorization header
+or a session cookie are never cached. Served responses have their "Age"
+and "X-Cache" headers set.
+
+The following fields may be set, through the "cache" server configuration
+section as well:
+
+ * "TTL" ("ttl") is the time.Duration string of the default lifetime of
+   a response. If it is empty or 0, only responses with an explicit
+   lifetime are cached.
+ * "StaleWhileRevalidate" ("stale-while-revalidate") is the time.Duration
+   string, during which an expired response may still be served.
+ * "MaxSize" ("max-size") is the size of the cache, in bytes. If it is 0,
+   the DefaultCacheMaxSize is used.
+ * "VaryHeaders" ("vary-header") lists additional request headers, which
+   are a part of the key.
+ * "Language" ("language") adds the language, set by the I18N middleware,
+   to the key. The Cache middleware has to be placed after the I18N one in
+   the dispatcher configuration in that case.
+
+Cached responses may be invalidated through the ResponseCache, obtained
+with GetResponseCache, by the name of the route that produced them, or by
+a tag, set by the handler using CacheTags. A "Store" may also be provided
+instead.
+*/
+type Cache struct {
+	TTL                  string
+	StaleWhileRevalidate string
+	MaxSize              int64
+	VaryHeaders          []string
+	Language             bool
+	Store                *ResponseCache
+}
+
+type cacheRecorder struct {
+	util.ResponseWriter
+	release  func()
+	code     int
+	header   http.Header
+	body     bytes.Buffer
+	maxSize  int64
+	overflow bool
+}
+
+// discardWriter is the response writer of background revalidations.
+type discardWriter struct {
+	header http.Header
+}
+
+func (mw Cache) Handler(ph http.Handler, c context.Context) http.Handler {
+	ttl := parseCacheDuration(mw.TTL)
+	swr := parseCacheDuration(mw.StaleWhileRevalidate)
+
+	if mw.Store == nil {
+		if mw.MaxSize == 0 {
+			mw.MaxSize = DefaultCacheMaxSize
+		}
+		mw.Store = NewResponseCache(mw.MaxSize)
+	}
+	rc := mw.Store
+	vary := mergeVary(mw.VaryHeaders)
+
+	c.SetGlobal(context.BaseCtxKey("responseCache"), rc)
+
+	// produce calls the handlers, and creates a cache entry out of the
+	// recorded response, if it may be cached. The release function is
+	// called once it is known that the response won't be stored.
+	produce := func(w http.ResponseWriter, r *http.Request, primary string, release func()) (*cacheEntry, []string) {
+		rec := &cacheRecorder{ResponseWriter: util.NewResponseWriter(w), release: release, maxSize: rc.maxSize}
+		rec.Before(func(util.ResponseWriter) {
+			if _, _, _, ok := cacheable(rec.code, rec.header, ttl, swr); !ok {
+				release()
+			}
+		})
+		ph.ServeHTTP(rec, r)
+
+		if rec.code == 0 && !rec.Written() {
+			rec.WriteHeader(http.StatusOK)
+		}
+
+		return mw.entry(rec, r, c, primary, vary, ttl, swr)
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" || r.Header.Get("Authorization") != "" || hasSessionCookie(r, c) {
+			ph.ServeHTTP(w, r)
+			return
+		}
+
+		primary := mw.primaryKey(r, c)
+		key := rc.key(primary, r, vary)
+
+		if e := rc.get(key); e != nil {
+			if rc.now().After(e.expires) {
+				if call, leader := rc.begin(key); leader {
+					mw.revalidate(ph, r, c, key, call, primary, produce)
+				}
+				serveCached(w, r, e, "STALE", rc.now())
+			} else {
+				serveCached(w, r, e, "HIT", rc.now())
+			}
+			return
+		}
+
+		call, leader := rc.begin(key)
+		if !leader {
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+
+			// The response may vary by headers, which weren't known
+			// before it was produced
+			if call.entry != nil && call.entry.key == rc.key(primary, r, vary) {
+				serveCached(w, r, call.entry, "HIT", rc.now())
+			} else {
+				ph.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+
+		var e *cacheEntry
+		var entryVary []string
+		defer func() {
+			rc.finish(key, call, primary, entryVary, e)
+		}()
+
+		e, entryVary = produce(w, r, primary, func() { rc.release(key, call) })
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+func (mw Cache) primaryKey(r *http.Request, c context.Context) string {
+	uriParts := strings.SplitN(r.RequestURI, "?", 2)
+	if uriParts[0] == "" {
+		uriParts = []string{r.URL.Path, r.URL.RawQuery}
+	}
+
+	key := r.Method + "\x00" + uriParts[0]
+	if len(uriParts) > 1 {
+		key += "?" + uriParts[1]
+	}
+
+	if mw.Language {
+		if lang, ok := c.Get(r, context.BaseCtxKey("lang")); ok {
+			key += "\x00lang=" + lang.(string)
+		}
+	}
+
+	return key
+}
+
+// revalidate refreshes a stale response in the background, using a copy of
+// the request. Only the language is copied from its context data, so that
+// the refresh can't be rendered for the session or user of the request.
+func (mw Cache) revalidate(ph http.Handler, r *http.Request, c context.Context, key string, call *cacheCall, primary string, produce func(http.ResponseWriter, *http.Request, string, func()) (*cacheEntry, []string)) {
+	r2 := r.WithContext(stdcontext.Background())
+	r2.Header = cloneHeader(r.Header)
+	r2.Header.Del("Authorization")
+	r2.Header.Del("Cookie")
+
+	for _, k := range []string{"lang", "langs"} {
+		if v, ok := c.Get(r, context.BaseCtxKey(k)); ok {
+			c.Set(r2, context.BaseCtxKey(k), v)
+		}
+	}
+	c.Set(r2, context.BaseCtxKey("cacheRevalidation"), true)
+
+	go func() {
+		var e *cacheEntry
+		var vary []string
+
+		defer func() {
+			c.DeleteAll(r2)
+			mw.Store.finish(key, call, primary, vary, e)
+		}()
+
+		e, vary = produce(&discardWriter{header: http.Header{}}, r2, primary, func() { mw.Store.release(key, call) })
+	}()
+}
+
+// entry returns the recorded response as a cache entry, or nil if it may
+// not be cached.
+func (mw Cache) entry(rec *cacheRecorder, r *http.Request, c context.Context, primary string, vary []string, ttl, swr time.Duration) (*cacheEntry, []string) {
+	if rec.overflow {
+		return nil, nil
+	}
+
+	h := rec.header
+	ttl, swr, responseVary, ok := cacheable(rec.code, h, ttl, swr)
+	if !ok {
+		return nil, nil
+	}
+	vary = mergeVary(vary, responseVary)
+
+	var route string
+	if val, ok := c.GetGlobal(context.BaseCtxKey("dispatcher")); ok {
+		if rt, _, ok := val.(*webfw.Dispatcher).RequestRoute(r); ok {
+			route = rt.Name
+		}
+	}
+
+	var tags []string
+	if val, ok := c.Get(r, context.BaseCtxKey("cacheTags")); ok {
+		tags = val.([]string)
+	}
+
+	h.Del("X-Cache")
+
+	now := mw.Store.now()
+	e := &cacheEntry{
+		key:     varyKey(primary, r, vary),
+		status:  rec.code,
+		header:  h,
+		body:    rec.body.Bytes(),
+		route:   route,
+		tags:    tags,
+		created: now,
+		expires: now.Add(ttl),
+		stale:   now.Add(ttl + swr),
+	}
+
+	e.size = int64(len(e.key) + len(e.body))
+	for k, v := range h {
+		for _, s := range v {
+			e.size += int64(len(k) + len(s))
+		}
+	}
+
+	return e, vary
+}
+
+// cacheable returns the lifetime, the stale duration and the Vary header
+// names of a response with the given status and headers, or false if it may
+// not be stored.
+func cacheable(code int, h http.Header, ttl, swr time.Duration) (time.Duration, time.Duration, []string, bool) {
+	if h == nil {
+		return 0, 0, nil, false
+	}
+
+	switch code {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently,
+		http.StatusNotFound, http.StatusGone:
+	default:
+		return 0, 0, nil, false
+	}
+
+	if len(h["Set-Cookie"]) > 0 {
+		return 0, 0, nil, false
+	}
+
+	directives := cacheControl(h.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0, 0, nil, false
+		}
+	}
+
+	if v, ok := directives["s-maxage"]; ok {
+		ttl = parseCacheSeconds(v)
+	} else if v, ok := directives["max-age"]; ok {
+		ttl = parseCacheSeconds(v)
+	}
+
+	if v, ok := directives["stale-while-revalidate"]; ok {
+		swr = parseCacheSeconds(v)
+	}
+
+	if ttl <= 0 {
+		return 0, 0, nil, false
+	}
+
+	var vary []string
+	for _, v := range h["Vary"] {
+		for _, part := range strings.Split(v, ",") {
+			switch http.CanonicalHeaderKey(strings.TrimSpace(part)) {
+			case "*", "Cookie":
+				return 0, 0, nil, false
+			}
+			vary = append(vary, part)
+		}
+	}
+
+	return ttl, swr, vary, true
+}
+
+// hasSessionCookie reports whether the request carries the cookie of the
+// Session middleware.
+func hasSessionCookie(r *http.Request, c context.Context) bool {
+	name := "session"
+	if val, ok := c.GetGlobal(context.BaseCtxKey("sessionCookieName")); ok {
+		name = val.(string)
+	}
+
+	_, err := r.Cookie(name)
+
+	return err == nil
+}
+
+func serveCached(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string, now time.Time) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = append([]string(nil), v...)
+	}
+
+	h.Set("Age", strconv.Itoa(int(now.Sub(e.created).Seconds())))
+	h.Set("X-Cache", status)
+
+	w.WriteHeader(e.status)
+	if r.Method != "HEAD" {
+		w.Write(e.body)
+	}
+}
+
+func (rec *cacheRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+		// The headers are copied before they are sent, so that any
+		// added by outer middleware, such as session cookies, aren't
+		// cached.
+		rec.header = cloneHeader(rec.Header())
+	}
+
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.code == 0 {
+		if rec.Header().Get("Content-Type") == "" {
+			rec.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.maxSize {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+			rec.release()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *cacheRecorder) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{rec}, r)
+}
+
+// Flush releases the requests waiting for the response, since it is being
+// streamed.
+func (rec *cacheRecorder) Flush() {
+	rec.release()
+	rec.ResponseWriter.Flush()
+}
+
+func (rec *cacheRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rec.overflow = true
+	rec.release()
+
+	return rec.ResponseWriter.Hijack()
+}
+
+func (dw *discardWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (dw *discardWriter) WriteHeader(code int) {
+}
+
+// cacheControl parses the directives of a Cache-Control header.
+func cacheControl(header string) map[string]string {
+	directives := map[string]string{}
+
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			directives[name] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		} else {
+			directives[name] = ""
+		}
+	}
+
+	return directives
+}
+
+func parseCacheSeconds(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func parseCacheDuration(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		panic(err)
+	}
+
+	return d
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+
+	return clone
+}
@@ -0,0 +1,469 @@
+package middleware
+
+import (
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/urandom/webfw"
+	"github.com/urandom/webfw/context"
+)
+
+type cacheController struct {
+	webfw.BasePatternController
+	calls *int32
+}
+
+func (con cacheController) Handler(c context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(con.calls, 1)
+		fmt.Fprintf(w, "%s %d", r.URL.Path, n)
+	})
+}
+
+func cacheRequest(h http.Handler, uri string, header http.Header) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "http://localhost:8080"+uri, nil)
+	r.RequestURI = uri
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	return rec
+}
+
+func TestCacheHandler(t *testing.T) {
+	c := context.NewContext()
+	store := NewResponseCache(DefaultCacheMaxSize)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	var calls int32
+	h := Cache{TTL: "1m", Store: store}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+
+		switch r.URL.Path {
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/cookie":
+			http.SetCookie(w, &http.Cookie{Name: "id", Value: "1"})
+		case "/max-age":
+			w.Header().Set("Cache-Control", "public, max-age=5")
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/vary":
+			w.Header().Set("Vary", "Accept-Language")
+		case "/vary-cookie":
+			w.Header().Set("Vary", "Accept-Encoding, Cookie")
+		}
+
+		fmt.Fprintf(w, "%s %d %s", r.URL.Path, n, r.Header.Get("Accept-Language"))
+	}), c)
+
+	if rc, ok := GetResponseCache(c); !ok || rc != store {
+		t.Fatalf("Expected the store to be registered in the context\n")
+	}
+
+	rec := cacheRequest(h, "/page?q=1", nil)
+	if rec.Body.String() != "/page 1 " || rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected a cache miss, got '%s' %v\n", rec.Body.String(), rec.Header())
+	}
+
+	now = now.Add(10 * time.Second)
+	rec = cacheRequest(h, "/page?q=1", nil)
+	if rec.Body.String() != "/page 1 " || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a cache hit, got '%s' %v\n", rec.Body.String(), rec.Header())
+	}
+
+	if age := rec.Header().Get("Age"); age != "10" {
+		t.Fatalf("Expected an Age of 10, got '%s'\n", age)
+	}
+
+	if rec = cacheRequest(h, "/page?q=2", nil); rec.Body.String() != "/page 2 " {
+		t.Fatalf("Expected the query to be a part of the key, got '%s'\n", rec.Body.String())
+	}
+
+	for _, uri := range []string{"/no-store", "/cookie", "/vary-cookie", "/error"} {
+		first := cacheRequest(h, uri, nil).Body.String()
+		if second := cacheRequest(h, uri, nil).Body.String(); first == second {
+			t.Fatalf("Expected '%s' not to be cached\n", uri)
+		}
+	}
+
+	rec = cacheRequest(h, "/page?q=1", http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}})
+	if rec.Header().Get("X-Cache") != "" {
+		t.Fatalf("Expected authorized requests to bypass the cache\n")
+	}
+
+	rec = cacheRequest(h, "/page?q=1", http.Header{"Cookie": {"session=abc"}})
+	if rec.Header().Get("X-Cache") != "" {
+		t.Fatalf("Expected requests with a session to bypass the cache\n")
+	}
+
+	if rec = cacheRequest(h, "/page?q=1", http.Header{"Cookie": {"theme=dark"}}); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected other cookies to be ignored, got %v\n", rec.Header())
+	}
+
+	first := cacheRequest(h, "/max-age", nil).Body.String()
+	now = now.Add(4 * time.Second)
+	if second := cacheRequest(h, "/max-age", nil).Body.String(); first != second {
+		t.Fatalf("Expected the response to be cached for its max-age\n")
+	}
+	now = now.Add(2 * time.Second)
+	if third := cacheRequest(h, "/max-age", nil).Body.String(); first == third {
+		t.Fatalf("Expected the response to expire after its max-age\n")
+	}
+
+	en := cacheRequest(h, "/vary", http.Header{"Accept-Language": {"en"}}).Body.String()
+	de := cacheRequest(h, "/vary", http.Header{"Accept-Language": {"de"}}).Body.String()
+	if en == de {
+		t.Fatalf("Expected responses to vary by language, got '%s'\n", en)
+	}
+
+	if rec = cacheRequest(h, "/vary", http.Header{"Accept-Language": {"en"}}); rec.Body.String() != en || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected a cached response for the same language, got '%s'\n", rec.Body.String())
+	}
+
+	now = now.Add(2 * time.Minute)
+	if rec = cacheRequest(h, "/page?q=1", nil); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected an expired response to be replaced, got %v\n", rec.Header())
+	}
+}
+
+func TestCacheHandlerStaleWhileRevalidate(t *testing.T) {
+	c := context.NewContext()
+	store := NewResponseCache(DefaultCacheMaxSize)
+	now := time.Now()
+	var nowMutex sync.Mutex
+	store.now = func() time.Time {
+		nowMutex.Lock()
+		defer nowMutex.Unlock()
+		return now
+	}
+
+	var calls int32
+	cached := Cache{TTL: "1m", StaleWhileRevalidate: "1m", Store: store}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, session := c.Get(r, context.BaseCtxKey("session"))
+		fmt.Fprintf(w, "%d %v", atomic.AddInt32(&calls, 1), session)
+	}), c)
+
+	// Stands in for a Session middleware, which creates a session for
+	// each request without a cookie
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Set(r, context.BaseCtxKey("session"), "new")
+		cached.ServeHTTP(w, r)
+	})
+
+	cacheRequest(h, "/", nil)
+
+	nowMutex.Lock()
+	now = now.Add(90 * time.Second)
+	nowMutex.Unlock()
+
+	if rec := cacheRequest(h, "/", nil); rec.Body.String() != "1 true" || rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("Expected the stale response, got '%s' %v\n", rec.Body.String(), rec.Header())
+	}
+
+	for i := 0; i < 100; i++ {
+		if rec := cacheRequest(h, "/", nil); rec.Body.String() == "2 false" {
+			if rec.Header().Get("X-Cache") != "HIT" {
+				t.Fatalf("Expected the revalidated response to be fresh, got %v\n", rec.Header())
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Expected the response to be revalidated in the background\n")
+}
+
+func TestCacheHandlerCoalescing(t *testing.T) {
+	c := context.NewContext()
+	release := make(chan struct{})
+
+	var calls int32
+	h := Cache{TTL: "1m"}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Write([]byte("slow"))
+	}), c)
+
+	var wg sync.WaitGroup
+	bodies := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies <- cacheRequest(h, "/slow", nil).Body.String()
+		}()
+	}
+
+	for {
+		store, _ := GetResponseCache(c)
+		store.mutex.Lock()
+		_, pending := store.calls["GET\x00/slow"]
+		store.mutex.Unlock()
+
+		if pending {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		if body != "slow" {
+			t.Fatalf("Expected all requests to receive the response, got '%s'\n", body)
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("Expected the handler to be called once, got %d\n", calls)
+	}
+}
+
+func TestCacheHandlerSessionRevalidation(t *testing.T) {
+	c := context.NewContext()
+	store := NewResponseCache(DefaultCacheMaxSize)
+	now := time.Now()
+	var nowMutex sync.Mutex
+	store.now = func() time.Time {
+		nowMutex.Lock()
+		defer nowMutex.Unlock()
+		return now
+	}
+
+	// The Session middleware is placed before the Cache one, and sets a
+	// cookie for each new client
+	sessions := Session{
+		Path:   path.Join(os.TempDir(), "session"),
+		Secret: secret,
+	}
+
+	var calls int32
+	h := Cache{TTL: "1m", StaleWhileRevalidate: "1m", Store: store}.Handler(sessions.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", atomic.AddInt32(&calls, 1))
+	}), c), c)
+
+	cacheRequest(h, "/", nil)
+	if store.Len() != 0 {
+		t.Fatalf("Expected a response with a new session cookie not to be stored\n")
+	}
+
+	// Seeds the cache with a response for the same key
+	cached := Cache{TTL: "1m", StaleWhileRevalidate: "1m", Store: store}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", atomic.AddInt32(&calls, 1))
+	}), c)
+	cacheRequest(cached, "/", nil)
+
+	nowMutex.Lock()
+	now = now.Add(90 * time.Second)
+	nowMutex.Unlock()
+
+	if rec := cacheRequest(h, "/", nil); rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("Expected the stale response, got %v\n", rec.Header())
+	}
+
+	for i := 0; i < 100; i++ {
+		if rec := cacheRequest(h, "/", nil); rec.Header().Get("X-Cache") == "HIT" {
+			if rec.Body.String() != "3" {
+				t.Fatalf("Expected the revalidated response, got '%s'\n", rec.Body.String())
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Expected the response to be revalidated without a session\n")
+}
+
+func TestCacheHandlerCancelledWaiter(t *testing.T) {
+	c := context.NewContext()
+	release := make(chan struct{})
+	defer close(release)
+
+	var calls int32
+	h := Cache{TTL: "1m"}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Write([]byte("slow"))
+	}), c)
+
+	go cacheRequest(h, "/slow", nil)
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	r, _ := http.NewRequest("GET", "http://localhost:8080/slow", nil)
+	r.RequestURI = "/slow"
+	r = r.WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a cancelled request to stop waiting for the response\n")
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("Expected the cancelled request not to call the handler, got %d calls\n", n)
+	}
+}
+
+func TestCacheHandlerUncacheableCoalescing(t *testing.T) {
+	c := context.NewContext()
+	proceed, release := make(chan struct{}), make(chan struct{})
+
+	var calls int32
+	h := Cache{TTL: "1m"}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-proceed
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+			<-release
+		}
+		w.Write([]byte("private"))
+	}), c)
+
+	leader := make(chan string)
+	go func() {
+		leader <- cacheRequest(h, "/private", nil).Body.String()
+	}()
+
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cacheRequest(h, "/private", nil)
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("Expected the requests to wait for the first one, got %d calls\n", n)
+	}
+
+	close(proceed)
+
+	waiters := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waiters)
+	}()
+
+	select {
+	case <-waiters:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the waiting requests to be released once the response was known to be uncacheable\n")
+	}
+
+	close(release)
+	if body := <-leader; body != "private" {
+		t.Fatalf("Expected the first response to be completed, got '%s'\n", body)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 6 {
+		t.Fatalf("Expected each request to call the handler, got %d calls\n", n)
+	}
+}
+
+func TestResponseCacheInvalidation(t *testing.T) {
+	store := NewResponseCache(DefaultCacheMaxSize)
+
+	var calls int32
+	d := webfw.NewDispatcher("/", webfw.Config{})
+	d.RegisterMiddleware(Cache{TTL: "1m", Store: store})
+	d.Handle(cacheController{webfw.NewBasePatternController("/a", webfw.MethodGet, "a"), &calls})
+	d.Handle(cacheController{webfw.NewBasePatternController("/b", webfw.MethodGet, "b"), &calls})
+	d.Initialize()
+
+	tagged := Cache{TTL: "1m", Store: store}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CacheTags(d.Context, r, "posts")
+		fmt.Fprintf(w, "%d", atomic.AddInt32(&calls, 1))
+	}), d.Context)
+
+	a := cacheRequest(d, "/a", nil).Body.String()
+	b := cacheRequest(d, "/b", nil).Body.String()
+	posts := cacheRequest(tagged, "/posts", nil).Body.String()
+
+	if store.Len() != 3 || store.Size() == 0 {
+		t.Fatalf("Expected 3 cached responses, got %d\n", store.Len())
+	}
+
+	if n := store.InvalidateRoute("a"); n != 1 {
+		t.Fatalf("Expected 1 response to be invalidated, got %d\n", n)
+	}
+
+	if cacheRequest(d, "/a", nil).Body.String() == a {
+		t.Fatalf("Expected the route to be invalidated\n")
+	}
+
+	if cacheRequest(d, "/b", nil).Body.String() != b {
+		t.Fatalf("Expected the other route to stay cached\n")
+	}
+
+	if n := store.InvalidateTag("posts"); n != 1 {
+		t.Fatalf("Expected 1 tagged response to be invalidated, got %d\n", n)
+	}
+
+	if cacheRequest(tagged, "/posts", nil).Body.String() == posts {
+		t.Fatalf("Expected the tagged response to be invalidated\n")
+	}
+
+	store.Purge()
+	if store.Len() != 0 || store.Size() != 0 {
+		t.Fatalf("Expected an empty cache, got %d responses\n", store.Len())
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := context.NewContext()
+	store := NewResponseCache(300)
+
+	h := Cache{TTL: "1m", Store: store}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(make([]byte, 80))
+	}), c)
+
+	for _, uri := range []string{"/1", "/2", "/1", "/3"} {
+		cacheRequest(h, uri, nil)
+	}
+
+	if store.Size() > 300 {
+		t.Fatalf("Expected the cache size to be bounded, got %d\n", store.Size())
+	}
+
+	if rec := cacheRequest(h, "/1", nil); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected the recently used response to be kept\n")
+	}
+
+	if rec := cacheRequest(h, "/2", nil); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected the least recently used response to be evicted\n")
+	}
+}
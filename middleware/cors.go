@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urandom/webfw"
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/util"
+)
+
+/*
+The CORS middleware allows cross-origin requests to the application, by
+setting the Access-Control headers for requests from the allowed origins.
+Preflight requests - OPTIONS requests with an Access-Control-Request-Method
+header - are answered directly, with a "204 No Content" status, allowing
+only the methods of the routes that are actually registered for the path.
+Preflight requests for unknown paths are passed on to the next handler.
+Preflight requests for disallowed origins, methods or headers are answered
+without any Access-Control headers, causing the browser to reject the
+actual request.
+
+The following fields may be set, through the "cors" server configuration
+section as well:
+
+ * "AllowedOrigins" ("origin") lists the allowed origins. An origin may
+   be "*", allowing any one, contain "*" wildcards, such as
+   "https://*.example.com", or be a regular expression, if it starts with
+   "^". If it is empty, no origin is allowed.
+ * "AllowedMethods" ("method") further restricts the methods of the
+   registered routes.
+ * "AllowedHeaders" ("header") lists the request headers, which may be
+   sent by the client. A "*" allows any header. If it is empty, the
+   DefaultCORSHeaders are used.
+ * "ExposedHeaders" ("exposed-header") lists the response headers, which
+   may be read by the client.
+ * "AllowCredentials" ("credentials") allows requests with cookies or
+   authorization. It may not be combined with the "*" origin.
+ * "MaxAge" ("max-age") is the time.Duration string, for which the client
+   may cache the preflight response.
+
+Unless any origin is allowed, all responses vary by the Origin request
+header, so that shared caches don't serve a response to the wrong origin.
+
+The CORS middleware should be placed after the Session and CSRF ones in the
+dispatcher configuration, so that preflight requests are answered before
+reaching them.
+*/
+type CORS struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           string
+}
+
+// DefaultCORSHeaders are the request headers, allowed by the CORS middleware
+// if it doesn't specify its own.
+var DefaultCORSHeaders = []string{
+	"Accept", "Accept-Language", "Content-Language", "Content-Type", "X-Requested-With",
+}
+
+func (mw CORS) Handler(ph http.Handler, c context.Context) http.Handler {
+	var maxAge string
+	if mw.MaxAge != "" {
+		d, err := time.ParseDuration(mw.MaxAge)
+		if err != nil {
+			panic(err)
+		}
+		maxAge = strconv.Itoa(int(d.Seconds()))
+	}
+
+	anyOrigin := false
+	var origins []*regexp.Regexp
+	for _, o := range mw.AllowedOrigins {
+		if o == "*" {
+			if mw.AllowCredentials {
+				panic("The cors '*' origin may not be combined with credentials")
+			}
+
+			anyOrigin = true
+			continue
+		}
+
+		origins = append(origins, corsOriginPattern(o))
+	}
+
+	var allowedMethods webfw.Method
+	for _, m := range mw.AllowedMethods {
+		method, ok := webfw.ReverseMethodNames[strings.ToUpper(m)]
+		if !ok {
+			panic(fmt.Sprintf("Unknown cors method '%s'", m))
+		}
+		allowedMethods |= method
+	}
+	if allowedMethods == 0 {
+		allowedMethods = webfw.MethodAll
+	}
+
+	headers := mw.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+
+	anyHeader := false
+	allowedHeaders := map[string]bool{}
+	for _, h := range headers {
+		if h == "*" {
+			anyHeader = true
+		}
+		allowedHeaders[http.CanonicalHeaderKey(strings.TrimSpace(h))] = true
+	}
+
+	exposed := strings.Join(mw.ExposedHeaders, ", ")
+
+	allowOrigin := func(origin string) (string, bool) {
+		if anyOrigin {
+			return "*", true
+		}
+
+		for _, re := range origins {
+			if re.MatchString(origin) {
+				return origin, true
+			}
+		}
+
+		return "", false
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if !anyOrigin {
+			util.AddVary(h, "Origin")
+		}
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			ph.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			methods := webfw.MethodAll
+			if val, ok := c.GetGlobal(context.BaseCtxKey("dispatcher")); ok {
+				methods = val.(*webfw.Dispatcher).RequestMethods(r)
+			}
+
+			if methods == 0 {
+				ph.ServeHTTP(w, r)
+				return
+			}
+			methods &= allowedMethods
+
+			util.AddVary(h, "Access-Control-Request-Method")
+			util.AddVary(h, "Access-Control-Request-Headers")
+
+			allowed, ok := allowOrigin(origin)
+			requested := webfw.ReverseMethodNames[r.Header.Get("Access-Control-Request-Method")]
+			requestedHeaders, headersOk := corsRequestHeaders(r, anyHeader, allowedHeaders)
+
+			if ok && requested&methods > 0 && headersOk {
+				h.Set("Access-Control-Allow-Origin", allowed)
+				h.Set("Access-Control-Allow-Methods", corsMethods(methods))
+				if len(requestedHeaders) > 0 {
+					h.Set("Access-Control-Allow-Headers", strings.Join(requestedHeaders, ", "))
+				}
+				if mw.AllowCredentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+				if maxAge != "" {
+					h.Set("Access-Control-Max-Age", maxAge)
+				}
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed, ok := allowOrigin(origin); ok && webfw.ReverseMethodNames[r.Method]&allowedMethods > 0 {
+			h.Set("Access-Control-Allow-Origin", allowed)
+			if mw.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if exposed != "" {
+				h.Set("Access-Control-Expose-Headers", exposed)
+			}
+		}
+
+		ph.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// corsOriginPattern compiles an allowed origin, which is either a regular
+// expression, or a literal one with "*" wildcards.
+func corsOriginPattern(origin string) *regexp.Regexp {
+	if strings.HasPrefix(origin, "^") {
+		return regexp.MustCompile(origin)
+	}
+
+	parts := strings.Split(strings.ToLower(origin), "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+
+	return regexp.MustCompile("^(?i)" + strings.Join(parts, "[^/]*") + "$")
+}
+
+// corsRequestHeaders returns the canonical request headers of a preflight
+// request, and whether all of them are allowed.
+func corsRequestHeaders(r *http.Request, anyHeader bool, allowed map[string]bool) ([]string, bool) {
+	var headers []string
+
+	for _, v := range r.Header["Access-Control-Request-Headers"] {
+		for _, h := range strings.Split(v, ",") {
+			h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+			if h == "" {
+				continue
+			}
+
+			if !anyHeader && !allowed[h] {
+				return nil, false
+			}
+			headers = append(headers, h)
+		}
+	}
+
+	return headers, true
+}
+
+func corsMethods(methods webfw.Method) string {
+	var names []string
+	for _, m := range []webfw.Method{
+		webfw.MethodGet, webfw.MethodHead, webfw.MethodPost,
+		webfw.MethodPut, webfw.MethodPatch, webfw.MethodDelete,
+	} {
+		if methods&m > 0 {
+			names = append(names, webfw.MethodNames[m])
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/urandom/webfw"
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/renderer"
+)
+
+type corsController struct {
+	webfw.BasePatternController
+}
+
+func (con corsController) Handler(c context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Total", "1")
+		w.Write([]byte("ok"))
+	})
+}
+
+func corsRequest(h http.Handler, method, uri string, header http.Header) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, "http://localhost:8080"+uri, nil)
+	r.RequestURI = uri
+	for k, v := range header {
+		r.Header[k] = v
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	return rec
+}
+
+func TestCORSPreflight(t *testing.T) {
+	d := webfw.NewDispatcher("/", webfw.Config{})
+	d.Renderer = renderer.NewRenderer("testdata", "test.tmpl")
+
+	d.RegisterMiddleware(CORS{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.example.org", `^https://[a-z]+\.example\.net$`},
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT"},
+		AllowedHeaders: []string{"Content-Type", "X-Requested-With"},
+		MaxAge:         "10m",
+	})
+	d.Handle(corsController{webfw.NewBasePatternController("/items", webfw.MethodGet|webfw.MethodPost, "")})
+	d.Handle(corsController{webfw.NewBasePatternController("/items/:id", webfw.MethodPut|webfw.MethodDelete, "")})
+	d.Initialize()
+
+	preflight := func(uri, origin, method, headers string) *httptest.ResponseRecorder {
+		h := http.Header{
+			"Origin":                        {origin},
+			"Access-Control-Request-Method": {method},
+		}
+		if headers != "" {
+			h.Set("Access-Control-Request-Headers", headers)
+		}
+
+		return corsRequest(d, "OPTIONS", uri, h)
+	}
+
+	rec := preflight("/items", "https://app.example.com", "POST", "content-type, x-requested-with")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected code %d, got %d\n", http.StatusNoContent, rec.Code)
+	}
+
+	for k, v := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Content-Type, X-Requested-With",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if h := rec.Header().Get(k); h != v {
+			t.Fatalf("Expected %s '%s', got '%s'\n", k, v, h)
+		}
+	}
+
+	if v := strings.Join(rec.Header()["Vary"], ", "); v != "Origin, Access-Control-Request-Method, Access-Control-Request-Headers" {
+		t.Fatalf("Expected the preflight response to vary by its request headers, got '%s'\n", v)
+	}
+
+	if h := rec.Header().Get("Access-Control-Allow-Credentials"); h != "" {
+		t.Fatalf("Expected no credentials header, got '%s'\n", h)
+	}
+
+	rec = preflight("/items/42", "https://api.example.org", "PUT", "")
+	if h := rec.Header().Get("Access-Control-Allow-Methods"); h != "PUT" {
+		t.Fatalf("Expected only the allowed, registered methods, got '%s'\n", h)
+	}
+
+	if h := rec.Header().Get("Access-Control-Allow-Origin"); h != "https://api.example.org" {
+		t.Fatalf("Expected the wildcard origin to match, got '%s'\n", h)
+	}
+
+	if h := preflight("/items", "https://abc.example.net", "GET", "").Header().Get("Access-Control-Allow-Origin"); h != "https://abc.example.net" {
+		t.Fatalf("Expected the regexp origin to match, got '%s'\n", h)
+	}
+
+	for _, p := range []struct{ uri, origin, method, headers string }{
+		{"/items", "https://evil.com", "GET", ""},
+		{"/items", "https://app.example.com.evil.com", "GET", ""},
+		{"/items", "https://a.b/c.example.org", "GET", ""},
+		{"/items", "https://app.example.com", "PUT", ""},
+		{"/items/42", "https://app.example.com", "DELETE", ""},
+		{"/items", "https://app.example.com", "GET", "Authorization"},
+	} {
+		rec := preflight(p.uri, p.origin, p.method, p.headers)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("Expected code %d for %+v, got %d\n", http.StatusNoContent, p, rec.Code)
+		}
+
+		if h := rec.Header().Get("Access-Control-Allow-Origin"); h != "" {
+			t.Fatalf("Expected the preflight %+v to be rejected, got '%s'\n", p, h)
+		}
+	}
+
+	if rec := preflight("/unknown", "https://app.example.com", "GET", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected code %d for an unknown path, got %d\n", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	c := context.NewContext()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	h := CORS{
+		AllowedOrigins:   []string{"https://*.com"},
+		AllowedMethods:   []string{"GET"},
+		ExposedHeaders:   []string{"X-Total"},
+		AllowCredentials: true,
+	}.Handler(ok, c)
+
+	rec := corsRequest(h, "GET", "/items", http.Header{"Origin": {"https://any.com"}})
+	for k, v := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://any.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Expose-Headers":    "X-Total",
+		"Vary":                             "Origin",
+	} {
+		if h := rec.Header().Get(k); h != v {
+			t.Fatalf("Expected %s '%s', got '%s'\n", k, v, h)
+		}
+	}
+
+	if rec.Body.String() != "ok" {
+		t.Fatalf("Expected the handler to be called, got '%s'\n", rec.Body.String())
+	}
+
+	if h := corsRequest(h, "POST", "/items", http.Header{"Origin": {"https://any.com"}}).Header().Get("Access-Control-Allow-Origin"); h != "" {
+		t.Fatalf("Expected no cors headers for a disallowed method, got '%s'\n", h)
+	}
+
+	rec = corsRequest(h, "GET", "/items", nil)
+	if h := rec.Header().Get("Access-Control-Allow-Origin"); h != "" || rec.Header().Get("Vary") != "Origin" {
+		t.Fatalf("Expected only the Vary header for a same-origin request, got %v\n", rec.Header())
+	}
+
+	// Without a dispatcher, all methods are considered registered
+	rec = corsRequest(h, "OPTIONS", "/items", http.Header{
+		"Origin":                        {"https://any.com"},
+		"Access-Control-Request-Method": {"GET"},
+	})
+	if h := rec.Header().Get("Access-Control-Allow-Methods"); h != "GET" {
+		t.Fatalf("Expected the allowed methods, got '%s'\n", h)
+	}
+
+	h = CORS{AllowedOrigins: []string{"*"}}.Handler(ok, c)
+	for _, origin := range []string{"https://any.com", ""} {
+		rec := corsRequest(h, "GET", "/", http.Header{"Origin": {origin}})
+		if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "*" && origin != "" {
+			t.Fatalf("Expected any origin to be allowed, got '%s'\n", o)
+		}
+
+		if v := rec.Header().Get("Vary"); v != "" {
+			t.Fatalf("Expected no Vary header when any origin is allowed, got '%s'\n", v)
+		}
+	}
+
+	h = CORS{}.Handler(ok, c)
+	rec = corsRequest(h, "GET", "/", http.Header{"Origin": {"https://any.com"}})
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "" || rec.Header().Get("Vary") != "Origin" {
+		t.Fatalf("Expected no origin to be allowed by default, got %v\n", rec.Header())
+	}
+
+	for _, mw := range []CORS{
+		{AllowedMethods: []string{"FETCH"}},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("Expected %+v to panic\n", mw)
+				}
+			}()
+
+			mw.Handler(h, c)
+		}()
+	}
+}
@@ -0,0 +1,301 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/urandom/webfw"
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/renderer"
+)
+
+/*
+The CSRF middleware protects the unsafe requests - any request, whose method
+is not GET, HEAD, OPTIONS or TRACE - from cross-site request forgery. Each
+client receives a random token, which has to be sent back with every unsafe
+request, either as the value of the form field, specified by "FieldName",
+or in the request header, specified by "HeaderName". Requests with a
+missing or wrong token are rejected with a "403 Forbidden" status, and the
+"403.tmpl" template is rendered, with the "csrfError" data key set to the
+error message.
+
+If the Session middleware is in use, the token is stored in the session.
+It is then only loaded, or created, for unsafe requests, or when it is
+first asked for, through CSRFToken or the template functions, so that other
+safe requests don't load the session data.
+In that case, the CSRF middleware has to be placed before the Session one
+in the dispatcher configuration, so that it is called after the session
+has been initialized. Otherwise, the token is stored in a cookie, specified
+by "CookieName", and each unsafe request has to repeat its value, a
+technique known as a double-submit cookie. The "Secure" field of the cookie
+may be "true", "false", or "auto", in which case the cookie is secure if the
+request was received over TLS, either directly, or as reported by a proxy
+via the X-Forwarded-Proto header.
+
+Requests may be exempt from the check either by the name of their route,
+listed in "ExemptRoutes", or by their path prefix, relative to the
+dispatcher pattern, listed in "ExemptURLPrefix".
+
+The middleware also registers the following template functions, each
+expecting the request object as its argument:
+
+ * "csrfToken" - returns the token of the current request, for use with
+   javascript requests.
+ * "csrfField" - returns a hidden form input, holding the token.
+   Example:
+    - <form method="post">{{ csrfField .base.r }}</form>
+*/
+type CSRF struct {
+	Pattern         string
+	FieldName       string
+	HeaderName      string
+	CookieName      string
+	CookiePath      string
+	Domain          string
+	Secure          string
+	ExemptRoutes    []string
+	ExemptURLPrefix []string
+}
+
+const csrfSessionKey = "csrfToken"
+
+func (mw CSRF) Handler(ph http.Handler, c context.Context) http.Handler {
+	mw = mw.withDefaults()
+
+	switch mw.Secure {
+	case "", "false", "true", "auto":
+	default:
+		panic(fmt.Sprintf("Invalid csrf secure value '%s'", mw.Secure))
+	}
+
+	webfw.GetRenderer(c).Funcs(mw.TemplateFuncMap(c))
+	logger := webfw.GetLogger(c)
+
+	c.SetGlobal(context.BaseCtxKey("csrfFieldName"), mw.FieldName)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		// The token is only obtained when it is needed, so that safe
+		// requests don't have to load, or create, the session
+		var token string
+		var err error
+		obtained := false
+		getToken := func() (string, error) {
+			if !obtained {
+				token, err = mw.token(w, r, c)
+				obtained = true
+			}
+
+			return token, err
+		}
+
+		c.Set(r, context.BaseCtxKey("csrfToken"), func() string {
+			token, err := getToken()
+			if err != nil {
+				logger.Printf("Unable to generate a csrf token: %v", err)
+			}
+
+			return token
+		})
+
+		// Without a session, the cookie is set right away, as it might
+		// be too late once the response has been written
+		_, hasSession := c.Get(r, context.BaseCtxKey("session"))
+		if !hasSession || !isSafeMethod(r.Method) && !mw.exempt(r, c) {
+			if _, err := getToken(); err != nil {
+				logger.Printf("Unable to generate a csrf token: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if isSafeMethod(r.Method) || mw.exempt(r, c) {
+			ph.ServeHTTP(w, r)
+			return
+		}
+
+		sent := r.Header.Get(mw.HeaderName)
+		if sent == "" {
+			sent = r.PostFormValue(mw.FieldName)
+		}
+
+		if sent == "" {
+			mw.forbid(w, r, c, "Missing csrf token")
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			mw.forbid(w, r, c, "Invalid csrf token")
+			return
+		}
+
+		ph.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// TemplateFuncMap returns the csrf template functions.
+func (mw CSRF) TemplateFuncMap(c context.Context) template.FuncMap {
+	mw = mw.withDefaults()
+
+	return template.FuncMap{
+		"csrfToken": func(r *http.Request) string {
+			return CSRFToken(c, r)
+		},
+		"csrfField": func(r *http.Request) template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+				template.HTMLEscapeString(mw.FieldName),
+				template.HTMLEscapeString(CSRFToken(c, r))))
+		},
+	}
+}
+
+// CSRFToken returns the csrf token of the current request, if the CSRF
+// middleware is in use. If the token is stored in the session, it is only
+// created, or loaded, on the first call.
+func CSRFToken(c context.Context, r *http.Request) string {
+	if val, ok := c.Get(r, context.BaseCtxKey("csrfToken")); ok {
+		return val.(func() string)()
+	}
+
+	return ""
+}
+
+func (mw CSRF) withDefaults() CSRF {
+	if mw.FieldName == "" {
+		mw.FieldName = "csrf_token"
+	}
+
+	if mw.HeaderName == "" {
+		mw.HeaderName = "X-CSRF-Token"
+	}
+
+	if mw.CookieName == "" {
+		mw.CookieName = "csrf_token"
+	}
+
+	if mw.CookiePath == "" {
+		mw.CookiePath = mw.Pattern
+	}
+
+	if mw.CookiePath == "" {
+		mw.CookiePath = "/"
+	}
+
+	return mw
+}
+
+// token returns the stored token of the client, creating a new one if
+// there is none.
+func (mw CSRF) token(w http.ResponseWriter, r *http.Request, c context.Context) (string, error) {
+	if val, ok := c.Get(r, context.BaseCtxKey("session")); ok {
+		sess := val.(context.Session)
+
+		if v, ok := sess.Get(csrfSessionKey); ok {
+			if token, ok := v.(string); ok && token != "" {
+				return token, nil
+			}
+		}
+
+		token, err := newCSRFToken()
+		if err != nil {
+			return "", err
+		}
+
+		sess.Set(csrfSessionKey, token)
+
+		return token, nil
+	}
+
+	if cookie, err := r.Cookie(mw.CookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	token, err := newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     mw.CookieName,
+		Value:    token,
+		Path:     mw.CookiePath,
+		Domain:   mw.Domain,
+		Secure:   mw.Secure == "true" || mw.Secure == "auto" && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return token, nil
+}
+
+func (mw CSRF) exempt(r *http.Request, c context.Context) bool {
+	uriParts := strings.SplitN(r.RequestURI, "?", 2)
+	if uriParts[0] == "" {
+		uriParts[0] = r.URL.Path
+	}
+
+	for _, prefix := range mw.ExemptURLPrefix {
+		if prefix == "" {
+			continue
+		}
+
+		if prefix[0] == '/' {
+			prefix = prefix[1:]
+		}
+
+		if strings.HasPrefix(uriParts[0], mw.Pattern+prefix+"/") || uriParts[0] == mw.Pattern+prefix {
+			return true
+		}
+	}
+
+	if len(mw.ExemptRoutes) == 0 {
+		return false
+	}
+
+	if val, ok := c.GetGlobal(context.BaseCtxKey("dispatcher")); ok {
+		if route, _, ok := val.(*webfw.Dispatcher).RequestRoute(r); ok {
+			for _, name := range mw.ExemptRoutes {
+				if route.Name == name {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func (mw CSRF) forbid(w http.ResponseWriter, r *http.Request, c context.Context, message string) {
+	webfw.GetLogger(c).Printf("Rejected %s request to %s: %s", r.Method, r.URL.Path, message)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+
+	err := webfw.GetRenderCtx(c, r)(w, renderer.RenderData{"csrfError": message}, "403.tmpl")
+	if err != nil {
+		w.Write([]byte(http.StatusText(http.StatusForbidden)))
+	}
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/urandom/webfw"
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/renderer"
+)
+
+var csrfFieldRegexp = regexp.MustCompile(`<input type="hidden" name="csrf_token" value="([^"]+)">`)
+
+type csrfController struct {
+	webfw.BasePatternController
+}
+
+func (con csrfController) Handler(c context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+}
+
+func TestCSRFHandler(t *testing.T) {
+	c := context.NewContext()
+	ren := renderer.NewRenderer("testdata", "test.tmpl")
+	c.SetGlobal(context.BaseCtxKey("renderer"), ren)
+
+	mw := CSRF{Pattern: "/", ExemptURLPrefix: []string{"", "/hooks"}}
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Set(r, context.BaseCtxKey("r"), r)
+		if err := ren.Render(w, nil, c.GetAll(r), "test_csrf.tmpl"); err != nil {
+			t.Fatal(err)
+		}
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/form", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	m := csrfFieldRegexp.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("Expected a csrf field in '%s'\n", rec.Body.String())
+	}
+	token := m[1]
+
+	if !strings.HasSuffix(strings.TrimSpace(rec.Body.String()), token) {
+		t.Fatalf("Expected body '%s' to end with the token\n", rec.Body.String())
+	}
+
+	cookie := rec.Header().Get("Set-Cookie")
+	if !strings.HasPrefix(cookie, "csrf_token="+token+";") {
+		t.Fatalf("Expected a csrf cookie with the token, got '%s'\n", cookie)
+	}
+	cookie = cookie[:strings.Index(cookie, ";")]
+
+	for _, test := range []struct {
+		path, cookie, header, field string
+		code                        int
+	}{
+		{"/form", "", "", "", http.StatusForbidden},
+		{"/form", cookie, "", "", http.StatusForbidden},
+		{"/form", "", "", token, http.StatusForbidden},
+		{"/form", cookie, "", "wrong", http.StatusForbidden},
+		{"/form", cookie, "", token, http.StatusOK},
+		{"/form", cookie, token, "", http.StatusOK},
+		{"/hooks/github", "", "", "", http.StatusOK},
+		{"/hooksmith", "", "", "", http.StatusForbidden},
+	} {
+		form := url.Values{}
+		if test.field != "" {
+			form.Set("csrf_token", test.field)
+		}
+
+		r, _ := http.NewRequest("POST", "http://localhost:8080"+test.path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.cookie != "" {
+			r.Header.Set("Cookie", test.cookie)
+		}
+		if test.header != "" {
+			r.Header.Set("X-CSRF-Token", test.header)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		if rec.Code != test.code {
+			t.Fatalf("Expected code %d for %+v, got %d\n", test.code, test, rec.Code)
+		}
+
+		if test.code == http.StatusForbidden && !strings.Contains(rec.Body.String(), "Forbidden: ") {
+			t.Fatalf("Expected the 403 template to be rendered, got '%s'\n", rec.Body.String())
+		}
+	}
+}
+
+func TestCSRFSecure(t *testing.T) {
+	c := context.NewContext()
+	c.SetGlobal(context.BaseCtxKey("renderer"), renderer.NewRenderer("testdata", "test.tmpl"))
+
+	h := CSRF{Secure: "auto"}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), c)
+
+	for proto, secure := range map[string]bool{"": false, "http": false, "https": true} {
+		r, _ := http.NewRequest("GET", "http://localhost:8080/form", nil)
+		if proto != "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		if strings.Contains(rec.Header().Get("Set-Cookie"), "; Secure") != secure {
+			t.Fatalf("Expected a secure cookie %v for '%s', got '%s'\n", secure, proto, rec.Header().Get("Set-Cookie"))
+		}
+	}
+}
+
+// csrfCountingStore counts the loaded sessions.
+type csrfCountingStore struct {
+	context.SessionStore
+	gets *int32
+}
+
+func (cs csrfCountingStore) Get(name string) ([]byte, error) {
+	atomic.AddInt32(cs.gets, 1)
+
+	return cs.SessionStore.Get(name)
+}
+
+func TestCSRFSession(t *testing.T) {
+	c := context.NewContext()
+	c.SetGlobal(context.BaseCtxKey("renderer"), renderer.NewRenderer("testdata", "test.tmpl"))
+
+	var gets int32
+	smw := Session{
+		Path:            path.Join(os.TempDir(), "session"),
+		Secret:          secret,
+		RefreshInterval: "1h",
+		Store:           csrfCountingStore{context.NewFileStore(path.Join(os.TempDir(), "session")), &gets},
+	}
+
+	var token string
+	h := smw.Handler(CSRF{}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/plain" {
+			token = CSRFToken(c, r)
+		}
+	}), c), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/form", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if token == "" {
+		t.Fatalf("Expected a csrf token\n")
+	}
+
+	cookie := rec.Header().Get("Set-Cookie")
+	if strings.Contains(cookie, "csrf_token") {
+		t.Fatalf("Expected the token to be stored in the session, got cookie '%s'\n", cookie)
+	}
+	cookie = cookie[:strings.Index(cookie, ";")]
+
+	atomic.StoreInt32(&gets, 0)
+	r, _ = http.NewRequest("GET", "http://localhost:8080/plain", nil)
+	r.Header.Set("Cookie", cookie)
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if n := atomic.LoadInt32(&gets); n != 0 || rec.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("Expected a safe request not to load or write the session, got %d loads, %v\n", n, rec.Header())
+	}
+
+	r, _ = http.NewRequest("POST", "http://localhost:8080/form", nil)
+	r.Header.Set("Cookie", cookie)
+	r.Header.Set("X-CSRF-Token", token)
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected code %d, got %d\n", http.StatusOK, rec.Code)
+	}
+
+	r, _ = http.NewRequest("POST", "http://localhost:8080/form", nil)
+	r.Header.Set("X-CSRF-Token", token)
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected code %d without the session, got %d\n", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestCSRFExemptRoutes(t *testing.T) {
+	d := webfw.NewDispatcher("/", webfw.Config{})
+	d.Renderer = renderer.NewRenderer("testdata", "test.tmpl")
+
+	d.RegisterMiddleware(CSRF{ExemptRoutes: []string{"webhook"}})
+	d.Handle(csrfController{webfw.NewBasePatternController("/webhook", webfw.MethodPost, "webhook")})
+	d.Handle(csrfController{webfw.NewBasePatternController("/form", webfw.MethodPost, "form")})
+	d.Initialize()
+
+	for p, code := range map[string]int{
+		"/webhook": http.StatusOK,
+		"/form":    http.StatusForbidden,
+	} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080"+p, nil)
+		rec := httptest.NewRecorder()
+
+		d.ServeHTTP(rec, r)
+
+		if rec.Code != code {
+			t.Fatalf("Expected code %d for '%s', got %d\n", code, p, rec.Code)
+		}
+	}
+}
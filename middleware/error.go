@@ -8,6 +8,7 @@ import (
 
 	"github.com/urandom/webfw"
 	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/util"
 )
 
 // The Error middleware provides basic panic recovery for a request. For
@@ -17,7 +18,8 @@ import (
 // stack trace will be written to the error log. It also has a ShowStack
 // option, which will cause the stack trace to be written to the response
 // writer if true. It is set to true if the global configuration is set to
-// "devel".
+// "devel". If the response headers have already been sent when the panic
+// occurs, it is only logged.
 type Error struct {
 	ShowStack bool
 }
@@ -25,6 +27,8 @@ type Error struct {
 func (emw Error) Handler(ph http.Handler, c context.Context) http.Handler {
 	logger := webfw.GetLogger(c)
 	handler := func(w http.ResponseWriter, r *http.Request) {
+		rw := util.NewResponseWriter(w)
+
 		defer func() {
 			if rec := recover(); rec != nil {
 				stack := debug.Stack()
@@ -32,17 +36,24 @@ func (emw Error) Handler(ph http.Handler, c context.Context) http.Handler {
 				message := fmt.Sprintf("%s - %s\n%s\n", timestamp, rec, stack)
 
 				logger.Print(message)
-				w.WriteHeader(http.StatusInternalServerError)
+				c.DeleteAll(r)
+
+				// The response can no longer be replaced once its
+				// headers have been sent
+				if rw.Written() {
+					return
+				}
+
+				rw.WriteHeader(http.StatusInternalServerError)
 
 				if !emw.ShowStack {
 					message = "Internal Server Error"
 				}
-				w.Write([]byte(message))
-				c.DeleteAll(r)
+				rw.Write([]byte(message))
 			}
 		}()
 
-		ph.ServeHTTP(w, r)
+		ph.ServeHTTP(rw, r)
 	}
 
 	return http.HandlerFunc(handler)
@@ -0,0 +1,288 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/util"
+)
+
+/*
+The ETag middleware adds strong, content based ETags to successful GET
+responses, and answers conditional requests with a "304 Not Modified"
+status. The response body is hashed while it is being written, and held
+back until it is complete, since a matching If-None-Match header means it
+must not be sent at all.
+
+Responses which already carry an ETag or Last-Modified header, such as
+those created with the CheckNotModified helper, are not hashed. Their
+validators are compared against the If-None-Match and If-Modified-Since
+request headers instead. Since the body of a HEAD response may be omitted,
+such responses are only compared if they already carry a validator.
+
+The following fields may be set, through the "etag" server configuration
+section as well:
+
+ * "MaxSize" ("max-size") is the largest body, in bytes, that will be held
+   back. Larger responses, as well as flushed ones, are sent without an
+   ETag. If it is 0, the DefaultETagMaxSize is used.
+
+Responses with a "Cache-Control: no-store" header are never modified. When
+used along with the Gzip middleware, the ETag one has to be placed before
+it in the dispatcher configuration, so that the uncompressed body is
+hashed.
+*/
+type ETag struct {
+	MaxSize int
+}
+
+// DefaultETagMaxSize is the maximum size of a response body, hashed by the
+// ETag middleware, if it doesn't specify its own.
+const DefaultETagMaxSize = 1 << 20
+
+type etagResponseWriter struct {
+	util.ResponseWriter
+	r       *http.Request
+	maxSize int
+
+	code        int
+	decided     bool
+	notModified bool
+	buf         *bytes.Buffer
+	hash        hash.Hash
+}
+
+func (mw ETag) Handler(ph http.Handler, c context.Context) http.Handler {
+	if mw.MaxSize == 0 {
+		mw.MaxSize = DefaultETagMaxSize
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			ph.ServeHTTP(w, r)
+			return
+		}
+
+		ew := &etagResponseWriter{
+			ResponseWriter: util.NewResponseWriter(w),
+			r:              r,
+			maxSize:        mw.MaxSize,
+		}
+		defer ew.close()
+
+		ph.ServeHTTP(ew, r)
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// CheckNotModified sets the given validators as the ETag and Last-Modified
+// response headers, either of which may be empty. If the request is a GET or
+// HEAD one, and its conditional headers match the validators, a "304 Not
+// Modified" response is written, and true is returned. A controller may then
+// skip rendering the response:
+//
+//	if middleware.CheckNotModified(w, r, post.Hash, post.Updated) {
+//		return
+//	}
+//
+// The etag is quoted, unless it already is.
+func CheckNotModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	h := w.Header()
+
+	if etag != "" {
+		if !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+			etag = `"` + etag + `"`
+		}
+		h.Set("ETag", etag)
+	}
+
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	if (r.Method == "GET" || r.Method == "HEAD") && notModified(r, h) {
+		writeNotModified(w)
+		return true
+	}
+
+	return false
+}
+
+func (ew *etagResponseWriter) WriteHeader(code int) {
+	if ew.code != 0 {
+		return
+	}
+	ew.code = code
+
+	h := ew.Header()
+	switch {
+	case code != http.StatusOK || strings.Contains(h.Get("Cache-Control"), "no-store"):
+		ew.passThrough()
+	case h.Get("ETag") != "" || h.Get("Last-Modified") != "":
+		if notModified(ew.r, h) {
+			ew.decided, ew.notModified = true, true
+			writeNotModified(ew.ResponseWriter)
+		} else {
+			ew.passThrough()
+		}
+	case ew.r.Method == "HEAD":
+		ew.passThrough()
+	default:
+		ew.buf = util.BufferPool.GetBuffer()
+		ew.hash = sha256.New()
+	}
+}
+
+func (ew *etagResponseWriter) Write(b []byte) (int, error) {
+	ew.WriteHeader(http.StatusOK)
+
+	if ew.notModified {
+		return len(b), nil
+	}
+
+	if ew.decided {
+		return ew.ResponseWriter.Write(b)
+	}
+
+	ew.hash.Write(b)
+	ew.buf.Write(b)
+
+	if ew.buf.Len() > ew.maxSize {
+		if err := ew.giveUp(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func (ew *etagResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if ew.decided && !ew.notModified {
+		return ew.ResponseWriter.ReadFrom(r)
+	}
+
+	return io.Copy(writerOnly{ew}, r)
+}
+
+func (ew *etagResponseWriter) Flush() {
+	ew.WriteHeader(http.StatusOK)
+
+	if ew.notModified {
+		return
+	}
+
+	if !ew.decided {
+		ew.giveUp()
+	}
+
+	ew.ResponseWriter.Flush()
+}
+
+// close computes the ETag of a held back response, and sends it, unless it
+// matches the request.
+func (ew *etagResponseWriter) close() {
+	if ew.decided || ew.code == 0 {
+		return
+	}
+	defer ew.release()
+
+	ew.decided = true
+
+	h := ew.Header()
+	h.Set("ETag", `"`+base64.RawURLEncoding.EncodeToString(ew.hash.Sum(nil))+`"`)
+
+	if notModified(ew.r, h) {
+		writeNotModified(ew.ResponseWriter)
+		return
+	}
+
+	ew.ResponseWriter.WriteHeader(ew.code)
+	ew.buf.WriteTo(ew.ResponseWriter)
+}
+
+// giveUp sends the held back response without an ETag.
+func (ew *etagResponseWriter) giveUp() error {
+	defer ew.release()
+
+	ew.passThrough()
+	_, err := ew.buf.WriteTo(ew.ResponseWriter)
+
+	return err
+}
+
+func (ew *etagResponseWriter) passThrough() {
+	ew.decided = true
+	ew.ResponseWriter.WriteHeader(ew.code)
+}
+
+func (ew *etagResponseWriter) release() {
+	util.BufferPool.Put(ew.buf)
+	ew.buf, ew.hash = nil, nil
+}
+
+// notModified returns true if the conditional headers of the request match
+// the validators in the response headers. If-Modified-Since is only
+// considered in the absence of If-None-Match.
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, h.Get("ETag"))
+	}
+
+	ims, lm := r.Header.Get("If-Modified-Since"), h.Get("Last-Modified")
+	if ims == "" || lm == "" {
+		return false
+	}
+
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	modTime, err := http.ParseTime(lm)
+	if err != nil {
+		return false
+	}
+
+	return !modTime.After(since)
+}
+
+// etagMatch performs a weak comparison of the etag against the list of
+// entity tags in an If-None-Match header.
+func etagMatch(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	if h.Get("ETag") != "" {
+		h.Del("Last-Modified")
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urandom/webfw/context"
+)
+
+func TestETagHandler(t *testing.T) {
+	c := context.NewContext()
+	mw := ETag{MaxSize: 100}
+
+	body := "Test this string"
+	hash := sha256.Sum256([]byte(body))
+	etag := `"` + base64.RawURLEncoding.EncodeToString(hash[:]) + `"`
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/large":
+			w.Write([]byte(strings.Repeat("a", 101)))
+			return
+		case "/flushed":
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body[:4]))
+		w.Write([]byte(body[4:]))
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Fatalf("Expected the original response, got %d '%s'\n", rec.Code, rec.Body.String())
+	}
+
+	if e := rec.Header().Get("ETag"); e != etag {
+		t.Fatalf("Expected ETag '%s', got '%s'\n", etag, e)
+	}
+
+	for _, inm := range []string{etag, `"other", W/` + etag, "*"} {
+		r.Header.Set("If-None-Match", inm)
+		rec = httptest.NewRecorder()
+
+		h.ServeHTTP(rec, r)
+
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Fatalf("Expected code %d for '%s', got %d '%s'\n", http.StatusNotModified, inm, rec.Code, rec.Body.String())
+		}
+
+		if rec.Header().Get("Content-Type") != "" || rec.Header().Get("ETag") != etag {
+			t.Fatalf("Expected only the validators in the 304 headers, got %v\n", rec.Header())
+		}
+	}
+
+	r.Header.Set("If-None-Match", `"other"`)
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected code %d for a different ETag, got %d\n", http.StatusOK, rec.Code)
+	}
+
+	for _, p := range []string{"/error", "/large", "/flushed", "/no-store"} {
+		r, _ := http.NewRequest("GET", "http://localhost:8080"+p, nil)
+		r.Header.Set("If-None-Match", "*")
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, r)
+
+		if rec.Code == http.StatusNotModified || rec.Header().Get("ETag") != "" {
+			t.Fatalf("Expected no ETag for '%s', got %d %v\n", p, rec.Code, rec.Header())
+		}
+
+		if rec.Body.Len() == 0 {
+			t.Fatalf("Expected a body for '%s'\n", p)
+		}
+	}
+
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", nil)
+	r.Header.Set("If-None-Match", "*")
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != "" {
+		t.Fatalf("Expected a POST request to pass through, got %d %v\n", rec.Code, rec.Header())
+	}
+}
+
+func TestETagHead(t *testing.T) {
+	c := context.NewContext()
+
+	h := ETag{}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/validated" && CheckNotModified(w, r, "v1", time.Time{}) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		if r.Method != "HEAD" {
+			w.Write([]byte("body"))
+		}
+	}), c)
+
+	etags := map[string]string{}
+	for _, method := range []string{"GET", "HEAD"} {
+		for _, p := range []string{"/", "/validated"} {
+			r, _ := http.NewRequest(method, "http://localhost:8080"+p, nil)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, r)
+
+			etags[method+" "+p] = rec.Header().Get("ETag")
+		}
+	}
+
+	if etags["GET /"] == "" || etags["HEAD /"] != "" {
+		t.Fatalf("Expected an ETag only for the GET response, got %v\n", etags)
+	}
+
+	if etags["GET /validated"] != `"v1"` || etags["HEAD /validated"] != etags["GET /validated"] {
+		t.Fatalf("Expected the same controller ETag for GET and HEAD, got %v\n", etags)
+	}
+
+	// The hash of the empty HEAD body must not be used as a validator
+	emptyHash := sha256.Sum256(nil)
+	r, _ := http.NewRequest("HEAD", "http://localhost:8080/", nil)
+	r.Header.Set("If-None-Match", `"`+base64.RawURLEncoding.EncodeToString(emptyHash[:])+`"`)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected code %d for a HEAD request, got %d\n", http.StatusOK, rec.Code)
+	}
+
+	r, _ = http.NewRequest("HEAD", "http://localhost:8080/validated", nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("Expected code %d for a validated HEAD request, got %d\n", http.StatusNotModified, rec.Code)
+	}
+}
+
+func TestCheckNotModified(t *testing.T) {
+	c := context.NewContext()
+	modTime := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	rendered := 0
+
+	h := ETag{}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if CheckNotModified(w, r, "v1", modTime) {
+			return
+		}
+
+		rendered++
+		w.Write([]byte("rendered"))
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Header().Get("ETag") != `"v1"` || rec.Header().Get("Last-Modified") != modTime.Format(http.TimeFormat) {
+		t.Fatalf("Expected the controller validators, got %v\n", rec.Header())
+	}
+
+	for _, test := range []struct {
+		header, value string
+		code          int
+	}{
+		{"If-None-Match", `"v1"`, http.StatusNotModified},
+		{"If-None-Match", `"v0"`, http.StatusOK},
+		{"If-Modified-Since", modTime.Format(http.TimeFormat), http.StatusNotModified},
+		{"If-Modified-Since", modTime.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+	} {
+		r, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+		r.Header.Set(test.header, test.value)
+		rec := httptest.NewRecorder()
+
+		rendered = 0
+		h.ServeHTTP(rec, r)
+
+		if rec.Code != test.code {
+			t.Fatalf("Expected code %d for %+v, got %d\n", test.code, test, rec.Code)
+		}
+
+		if (test.code == http.StatusOK) != (rendered == 1) {
+			t.Fatalf("Expected the response to be rendered only if modified, %+v\n", test)
+		}
+	}
+}
@@ -2,62 +2,402 @@ package middleware
 
 import (
 	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/andybalholm/brotli"
 	"github.com/urandom/webfw/context"
 	"github.com/urandom/webfw/util"
-
-	"strconv"
-	"strings"
 )
 
-// The Gzip middleware will compress the response using the gzip format.
-// If placed in the middleware chain, it will be triggered whenever the
-// client states it may accept gzip via the Accept-Encoding header.
-type Gzip struct{}
+/*
+The Gzip middleware compresses the response, using the best encoding
+accepted by the client, according to the q-values of its Accept-Encoding
+header. The supported encodings are "br", "gzip" and "deflate", preferred
+in that order when the client has no preference.
+
+The following fields may be set, through the "gzip" server configuration
+section as well:
+
+ * "Encodings" ("encoding") limits the encodings that may be used. All of
+   them are enabled by default.
+ * "Level" ("level") is the compression level, in the range of the chosen
+   encoding - 1-9 for gzip and deflate, 0-11 for brotli. If it is 0, each
+   encoding uses its default level.
+ * "MinSize" ("min-size") is the minimum size of a response body, in
+   bytes, for it to be compressed. Up to that many bytes are held back,
+   until the size is known.
+ * "ContentTypes" ("content-type") lists the media types that will be
+   compressed. A type may end in "*", such as "text/*", to match any
+   subtype. Textual types, along with javascript, json, xml and svg, are
+   compressed by default.
+
+Responses without a body, or those with a Content-Encoding header already
+set, are never compressed. The response is compressed while it is being
+written, thus the handlers may flush it at any point. Flushing a response
+that hasn't reached the minimum size yet sends it uncompressed. Pooled
+encoders are reused between requests.
+*/
+type Gzip struct {
+	Encodings    []string
+	Level        int
+	MinSize      int
+	ContentTypes []string
+}
+
+// DefaultCompressibleTypes are the media types, compressed by the Gzip
+// middleware, if it doesn't specify its own.
+var DefaultCompressibleTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/x-javascript",
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+var supportedEncodings = []string{"br", "gzip", "deflate"}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Encoders are pooled per encoding and level.
+var encoderPools = struct {
+	sync.Mutex
+	pools map[string]*sync.Pool
+}{pools: map[string]*sync.Pool{}}
+
+type gzipResponseWriter struct {
+	util.ResponseWriter
+	mw       Gzip
+	encoding string
+
+	code    int
+	decided bool
+	buf     []byte
+	enc     encoder
+	pool    *sync.Pool
+}
 
 func (gmw Gzip) Handler(ph http.Handler, c context.Context) http.Handler {
+	encodings := supportedEncodings
+	if len(gmw.Encodings) > 0 {
+		encodings = nil
+		for _, e := range gmw.Encodings {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if !supportedEncoding(e) {
+				panic(fmt.Sprintf("Unsupported compression encoding '%s'", e))
+			}
+			encodings = append(encodings, e)
+		}
+	}
+
+	if len(gmw.ContentTypes) == 0 {
+		gmw.ContentTypes = DefaultCompressibleTypes
+	}
+
+	for _, e := range encodings {
+		// Invalid levels are caught here, rather than during a request
+		newEncoder(e, gmw.Level, ioutil.Discard).Close()
+	}
+
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		rec := util.NewRecorderHijacker(w)
-		useGzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+		util.AddVary(w.Header(), "Accept-Encoding")
 
-		ph.ServeHTTP(rec, r)
+		encoding := util.NegotiateEncoding(r.Header.Get("Accept-Encoding"), encodings)
+		if encoding == "" {
+			ph.ServeHTTP(w, r)
+			return
+		}
 
-		for k, v := range rec.Header() {
-			w.Header()[k] = v
+		gw := &gzipResponseWriter{
+			ResponseWriter: util.NewResponseWriter(w),
+			mw:             gmw,
+			encoding:       encoding,
 		}
-		w.Header().Set("Vary", "Accept-Encoding")
+		defer gw.close()
 
-		if useGzip {
-			w.Header().Set("Content-Encoding", "gzip")
+		ph.ServeHTTP(gw, r)
+	}
 
-			if w.Header().Get("Content-Type") == "" {
-				w.Header().Set("Content-Type", http.DetectContentType(rec.GetBody().Bytes()))
-			}
+	return http.HandlerFunc(handler)
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.code != 0 {
+		return
+	}
+	gw.code = code
+
+	h := gw.Header()
+	if !bodyAllowed(code) || h.Get("Content-Encoding") != "" {
+		gw.passThrough()
+		return
+	}
+
+	if ct := h.Get("Content-Type"); ct != "" && !gw.compressible(ct) {
+		gw.passThrough()
+		return
+	}
+
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n < gw.mw.MinSize {
+			gw.passThrough()
 		}
+	}
+}
 
-		if useGzip {
-			buf := util.BufferPool.GetBuffer()
-			defer util.BufferPool.Put(buf)
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if gw.code == 0 {
+		if gw.Header().Get("Content-Type") == "" {
+			gw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
 
-			gz := gzip.NewWriter(buf)
+		gw.WriteHeader(http.StatusOK)
+	}
 
-			if _, err := gz.Write(rec.GetBody().Bytes()); err != nil {
-				panic(err)
-			}
-			gz.Close()
+	if gw.decided {
+		if gw.enc != nil {
+			return gw.enc.Write(b)
+		}
 
-			w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		return gw.ResponseWriter.Write(b)
+	}
 
-			w.WriteHeader(rec.GetCode())
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) >= gw.mw.MinSize {
+		if gw.Header().Get("Content-Type") == "" {
+			gw.Header().Set("Content-Type", http.DetectContentType(gw.buf))
+		}
 
-			buf.WriteTo(w)
+		if gw.compressible(gw.Header().Get("Content-Type")) {
+			gw.compress()
 		} else {
-			w.WriteHeader(rec.GetCode())
+			gw.passThrough()
+		}
 
-			w.Write(rec.GetBody().Bytes())
+		if err := gw.writeBuffered(); err != nil {
+			return 0, err
 		}
 	}
 
-	return http.HandlerFunc(handler)
+	return len(b), nil
+}
+
+func (gw *gzipResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if gw.decided && gw.enc == nil {
+		return gw.ResponseWriter.ReadFrom(r)
+	}
+
+	return io.Copy(writerOnly{gw}, r)
+}
+
+func (gw *gzipResponseWriter) Flush() {
+	if gw.code == 0 {
+		gw.WriteHeader(http.StatusOK)
+	}
+
+	if !gw.decided {
+		if ct := gw.Header().Get("Content-Type"); ct != "" && gw.compressible(ct) && len(gw.buf) >= gw.mw.MinSize {
+			gw.compress()
+		} else {
+			gw.passThrough()
+		}
+		gw.writeBuffered()
+	}
+
+	if gw.enc != nil {
+		gw.enc.Flush()
+	}
+
+	gw.ResponseWriter.Flush()
+}
+
+// close sends any held back response, and finishes the compressed stream.
+func (gw *gzipResponseWriter) close() {
+	if gw.code == 0 {
+		return
+	}
+
+	if !gw.decided {
+		gw.passThrough()
+		if err := gw.writeBuffered(); err != nil {
+			return
+		}
+	}
+
+	if gw.enc != nil {
+		gw.enc.Close()
+		gw.enc.Reset(nil)
+		gw.pool.Put(gw.enc)
+		gw.enc = nil
+	}
+}
+
+// passThrough sends the headers, without compressing the body.
+func (gw *gzipResponseWriter) passThrough() {
+	gw.decided = true
+	gw.ResponseWriter.WriteHeader(gw.code)
+}
+
+// compress sends the headers, and starts compressing the body.
+func (gw *gzipResponseWriter) compress() {
+	gw.decided = true
+
+	gw.Header().Set("Content-Encoding", gw.encoding)
+	gw.Header().Del("Content-Length")
+	gw.Header().Del("Accept-Ranges")
+
+	if etag := gw.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The compressed representation is no longer byte-for-byte
+		// equal to the uncompressed one
+		gw.Header().Set("ETag", "W/"+etag)
+	}
+
+	gw.ResponseWriter.WriteHeader(gw.code)
+
+	gw.pool = encoderPool(gw.encoding, gw.mw.Level)
+	if enc, ok := gw.pool.Get().(encoder); ok {
+		enc.Reset(gw.ResponseWriter)
+		gw.enc = enc
+	} else {
+		gw.enc = newEncoder(gw.encoding, gw.mw.Level, gw.ResponseWriter)
+	}
+}
+
+func (gw *gzipResponseWriter) writeBuffered() error {
+	if len(gw.buf) == 0 {
+		return nil
+	}
+
+	buf := gw.buf
+	gw.buf = nil
+
+	var err error
+	if gw.enc != nil {
+		_, err = gw.enc.Write(buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(buf)
+	}
+
+	return err
+}
+
+func (gw *gzipResponseWriter) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range gw.mw.ContentTypes {
+		t = strings.ToLower(t)
+
+		if t == mediaType {
+			return true
+		}
+
+		if i := strings.Index(t, "*"); i != -1 {
+			if strings.HasPrefix(mediaType, t[:i]) && strings.HasSuffix(mediaType[i:], t[i+1:]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func encoderPool(encoding string, level int) *sync.Pool {
+	key := encoding + "-" + strconv.Itoa(level)
+
+	encoderPools.Lock()
+	defer encoderPools.Unlock()
+
+	pool, ok := encoderPools.pools[key]
+	if !ok {
+		pool = &sync.Pool{}
+		encoderPools.pools[key] = pool
+	}
+
+	return pool
+}
+
+func newEncoder(encoding string, level int, w io.Writer) encoder {
+	switch encoding {
+	case "br":
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			panic(fmt.Sprintf("Invalid brotli compression level %d", level))
+		}
+
+		return brotli.NewWriterLevel(w, level)
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		enc, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			panic(err)
+		}
+
+		return enc
+	case "deflate":
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+
+		enc, err := zlib.NewWriterLevel(w, level)
+		if err != nil {
+			panic(err)
+		}
+
+		return enc
+	}
+
+	panic(fmt.Sprintf("Unsupported compression encoding '%s'", encoding))
+}
+
+func supportedEncoding(encoding string) bool {
+	for _, e := range supportedEncodings {
+		if e == encoding {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bodyAllowed returns true if a response with the given status may
+// contain a body.
+func bodyAllowed(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+
+	return true
+}
+
+// writerOnly hides any io.ReaderFrom implementation of the writer, so that
+// io.Copy doesn't call it recursively.
+type writerOnly struct {
+	io.Writer
 }
@@ -3,10 +3,15 @@ package middleware
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/andybalholm/brotli"
 	"github.com/urandom/webfw/context"
 )
 
@@ -48,3 +53,153 @@ func TestGzipHandler(t *testing.T) {
 	}
 
 }
+
+func TestGzipStreaming(t *testing.T) {
+	c := context.NewContext()
+	mw := Gzip{}
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>first"))
+		w.(http.Flusher).Flush()
+
+		rec := w.(*gzipResponseWriter).Unwrap().(*httptest.ResponseRecorder)
+		if !rec.Flushed || rec.Body.Len() == 0 {
+			t.Fatalf("Expected the first part to be flushed\n")
+		}
+
+		w.Write([]byte(" second</html>"))
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzip encoded response, got %v\n", rec.Header())
+	}
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Fatalf("Expected the content type to be detected, got '%s'\n", ct)
+	}
+
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "<html>first second</html>" {
+		t.Fatalf("Expected the whole body, got '%s'\n", b)
+	}
+
+	h = mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), c)
+
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != 0 {
+		t.Fatalf("Expected an empty, unencoded response, got %d, %v\n", rec.Code, rec.Header())
+	}
+}
+
+func TestGzipEncodings(t *testing.T) {
+	c := context.NewContext()
+	mw := Gzip{MinSize: 20, Level: 5}
+
+	body := strings.Repeat("Test this string ", 10)
+	contentType := ""
+	encoded := false
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if encoded {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Write([]byte(r.URL.Query().Get("prefix")))
+		w.Write([]byte(body))
+	}), c)
+
+	for _, test := range []struct {
+		accept, contentType, encoding string
+		preEncoded                    bool
+		decode                        func(io.Reader) (io.Reader, error)
+	}{
+		{"br", "", "br", false, func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }},
+		{"gzip", "", "gzip", false, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"deflate", "", "deflate", false, func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }},
+		{"gzip", "image/png", "", false, nil},
+		{"gzip", "text/css; charset=utf-8", "gzip", false, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"br", "", "gzip", true, nil},
+	} {
+		// Run twice, to use the pooled encoders
+		for i := 0; i < 2; i++ {
+			contentType, encoded = test.contentType, test.preEncoded
+
+			r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+			r.Header.Set("Accept-Encoding", test.accept)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, r)
+
+			if e := rec.Header().Get("Content-Encoding"); e != test.encoding {
+				t.Fatalf("Expected encoding '%s' for %+v, got '%s'\n", test.encoding, test, e)
+			}
+
+			if rec.Header().Get("Vary") != "Accept-Encoding" {
+				t.Fatalf("Expected a Vary header, got %v\n", rec.Header())
+			}
+
+			var reader io.Reader = rec.Body
+			if test.decode != nil {
+				var err error
+				if reader, err = test.decode(rec.Body); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			b, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != body {
+				t.Fatalf("Expected the original body for %+v, got '%s'\n", test, b)
+			}
+		}
+	}
+
+	contentType, encoded = "", false
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	body = "short"
+	h.ServeHTTP(rec, r)
+
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "short" {
+		t.Fatalf("Expected a response below the minimum size to not be compressed\n")
+	}
+
+	// The minimum size is reached over multiple writes
+	r, _ = http.NewRequest("GET", "http://localhost:8080?prefix="+strings.Repeat("p", 15), nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected the response to be compressed once it reaches the minimum size\n")
+	}
+}
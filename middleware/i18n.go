@@ -204,24 +204,17 @@ func (imw I18N) TemplateFuncMap() template.FuncMap {
 }
 
 func t(message, lang, fallback string, data ...interface{}) (template.HTML, error) {
-	var count interface{}
-	hasCount := false
-
-	if len(data)%2 == 1 {
-		if !isNumber(data[0]) {
-			return "", errors.New("The count argument must be a number")
-		}
-		count = data[0]
-		hasCount = true
-
-		data = data[1:]
+	count, hasCount, dataMap, err := messageData(data)
+	if err != nil {
+		return "", err
 	}
 
-	dataMap := map[string]interface{}{}
-	for i := 0; i < len(data); i += 2 {
-		dataMap[data[i].(string)] = data[i+1]
-	}
+	return translate(message, lang, fallback, count, hasCount, dataMap)
+}
 
+// translate returns the translation of the message, or the evaluated message
+// itself, if it has no translation mapping.
+func translate(message, lang, fallback string, count interface{}, hasCount bool, dataMap map[string]interface{}) (template.HTML, error) {
 	T, err := i18n.Tfunc(lang, fallback)
 
 	if err != nil {
@@ -237,23 +230,55 @@ func t(message, lang, fallback string, data ...interface{}) (template.HTML, erro
 
 	if translated == message {
 		// Doesn't have a translation mapping, we have to do the template evaluation by hand
-		t, err := ttemplate.New("i18n").Parse(message)
+		return evalMessage(message, dataMap)
+	} else {
+		return template.HTML(translated), nil
+	}
+}
 
-		if err != nil {
-			return "", err
+// messageData splits the trailing arguments of a message into an optional
+// count and a map of the key-value tuples.
+func messageData(data []interface{}) (interface{}, bool, map[string]interface{}, error) {
+	var count interface{}
+	hasCount := false
+
+	if len(data)%2 == 1 {
+		if !isNumber(data[0]) {
+			return nil, false, nil, errors.New("The count argument must be a number")
 		}
+		count = data[0]
+		hasCount = true
 
-		buf := util.BufferPool.GetBuffer()
-		defer util.BufferPool.Put(buf)
+		data = data[1:]
+	}
 
-		if err := t.Execute(buf, dataMap); err != nil {
-			return "", err
+	dataMap := map[string]interface{}{}
+	for i := 0; i < len(data); i += 2 {
+		key, ok := data[i].(string)
+		if !ok {
+			return nil, false, nil, fmt.Errorf("The message argument key '%v' must be a string", data[i])
 		}
+		dataMap[key] = data[i+1]
+	}
 
-		return template.HTML(buf.String()), nil
-	} else {
-		return template.HTML(translated), nil
+	return count, hasCount, dataMap, nil
+}
+
+func evalMessage(message string, dataMap map[string]interface{}) (template.HTML, error) {
+	t, err := ttemplate.New("i18n").Parse(message)
+
+	if err != nil {
+		return "", err
 	}
+
+	buf := util.BufferPool.GetBuffer()
+	defer util.BufferPool.Put(buf)
+
+	if err := t.Execute(buf, dataMap); err != nil {
+		return "", err
+	}
+
+	return template.HTML(buf.String()), nil
 }
 
 func isNumber(n interface{}) bool {
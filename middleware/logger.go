@@ -23,7 +23,7 @@ const dateFormat = "Jan 2, 2006 at 3:04pm (MST)"
 
 func (lmw Logger) Handler(ph http.Handler, c context.Context) http.Handler {
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		rec := util.NewRecorderHijacker(w)
+		rw := util.NewResponseWriter(w)
 
 		uri := r.URL.RequestURI()
 		remoteAddr := webfw.RemoteAddr(r)
@@ -32,17 +32,11 @@ func (lmw Logger) Handler(ph http.Handler, c context.Context) http.Handler {
 		referer := r.Header.Get("Referer")
 		userAgent := r.Header.Get("User-Agent")
 
-		ph.ServeHTTP(rec, r)
-
-		for k, v := range rec.Header() {
-			w.Header()[k] = v
-		}
-		w.WriteHeader(rec.GetCode())
-		w.Write(rec.GetBody().Bytes())
+		ph.ServeHTTP(rw, r)
 
 		timestamp := time.Now().Format(dateFormat)
-		code := rec.GetCode()
-		length := rec.GetBody().Len()
+		code := rw.Status()
+		length := rw.Size()
 
 		lmw.AccessLogger.Print(fmt.Sprintf("%s - %s [%s] \"%s %s\" %d %d \"%s\" %s",
 			remoteAddr, remoteUser, timestamp, method, uri, code, length, referer, userAgent))
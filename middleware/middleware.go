@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/urandom/webfw"
+	"github.com/urandom/webfw/context"
 )
 
 // InitializeDefault creates all default middleware objects by the order
@@ -21,7 +24,12 @@ func InitializeDefault(d *webfw.Dispatcher) {
 		case "Logger":
 			d.RegisterMiddleware(Logger{AccessLogger: webfw.NewStandardLogger(os.Stdout, "", 0)})
 		case "Gzip":
-			d.RegisterMiddleware(Gzip{})
+			d.RegisterMiddleware(Gzip{
+				Encodings:    d.Config.Gzip.Encodings,
+				Level:        d.Config.Gzip.Level,
+				MinSize:      d.Config.Gzip.MinSize,
+				ContentTypes: d.Config.Gzip.ContentTypes,
+			})
 		case "Static":
 			d.RegisterMiddleware(Static{
 				FileList: d.Config.Static.FileList || d.Config.Server.Devel,
@@ -29,8 +37,18 @@ func InitializeDefault(d *webfw.Dispatcher) {
 				Expires:  d.Config.Static.Expires,
 				Prefix:   d.Config.Static.Prefix,
 				Index:    d.Config.Static.Index,
+
+				FileListTemplate: d.Config.Static.FileListTemplate,
+
+				Fingerprint: d.Config.Static.Fingerprint,
+				Manifest:    d.Config.Static.Manifest,
+				ContentETag: d.Config.Static.ContentETag,
 			})
 		case "Session":
+			if !d.Config.Server.Devel && d.Config.UsesDefaultSessionSecret() {
+				panic("The default session secret may only be used in devel mode")
+			}
+
 			var cipher []byte
 			if d.Config.Session.Cipher != "" {
 				var err error
@@ -38,15 +56,98 @@ func InitializeDefault(d *webfw.Dispatcher) {
 					panic(err)
 				}
 			}
-			d.RegisterMiddleware(Session{
+			var oldSecrets, oldCiphers [][]byte
+			for _, secret := range d.Config.Session.OldSecrets {
+				oldSecrets = append(oldSecrets, []byte(secret))
+			}
+			for _, c := range d.Config.Session.OldCiphers {
+				if oldCipher, err := base64.StdEncoding.DecodeString(c); err == nil {
+					oldCiphers = append(oldCiphers, oldCipher)
+				} else {
+					panic(err)
+				}
+			}
+			smw := Session{
 				Path:            d.Config.Session.Dir,
 				Secret:          []byte(d.Config.Session.Secret),
 				Cipher:          cipher,
+				OldSecrets:      oldSecrets,
+				OldCiphers:      oldCiphers,
 				MaxAge:          d.Config.Session.MaxAge,
+				RefreshInterval: d.Config.Session.RefreshInterval,
+				IdleTimeout:     d.Config.Session.IdleTimeout,
+				AbsoluteTimeout: d.Config.Session.AbsoluteTimeout,
+				LockTimeout:     d.Config.Session.LockTimeout,
 				CleanupInterval: d.Config.Session.CleanupInterval,
 				CleanupMaxAge:   d.Config.Session.CleanupMaxAge,
 				Pattern:         d.Pattern,
 				IgnoreURLPrefix: d.Config.Session.IgnoreURLPrefix,
+				CookieName:      d.Config.Session.CookieName,
+				CookieVersion:   d.Config.Session.CookieVersion,
+				Domain:          d.Config.Session.Domain,
+				CookiePath:      d.Config.Session.Path,
+				Secure:          d.Config.Session.Secure,
+				HttpOnly:        strconv.FormatBool(d.Config.Session.HttpOnly),
+				SameSite:        d.Config.Session.SameSite,
+			}
+
+			if d.Config.Session.Codec != "" {
+				if codec, ok := context.GetCodec(d.Config.Session.Codec); ok {
+					smw.Codec = codec
+				} else {
+					panic(fmt.Sprintf("Unknown session codec '%s'", d.Config.Session.Codec))
+				}
+			}
+
+			switch d.Config.Session.Store {
+			case "redis":
+				rs := context.NewRedisStore(d.Config.Session.RedisNetwork,
+					d.Config.Session.RedisAddress, d.Config.Session.RedisMaxIdle)
+
+				rs.Password = d.Config.Session.RedisPassword
+				rs.DB = d.Config.Session.RedisDB
+				rs.Prefix = d.Config.Session.RedisPrefix
+				if maxAge, err := time.ParseDuration(d.Config.Session.MaxAge); err == nil && maxAge > 0 {
+					rs.MaxAge = maxAge
+				}
+
+				smw.Store = rs
+			case "cookie":
+				smw.SessionGenerator = context.NewCookieSession
+				smw.CleanupInterval = ""
+			}
+
+			d.RegisterMiddleware(smw)
+		case "ETag":
+			d.RegisterMiddleware(ETag{MaxSize: d.Config.ETag.MaxSize})
+		case "Cache":
+			d.RegisterMiddleware(Cache{
+				TTL:                  d.Config.Cache.TTL,
+				StaleWhileRevalidate: d.Config.Cache.StaleWhileRevalidate,
+				MaxSize:              d.Config.Cache.MaxSize,
+				VaryHeaders:          d.Config.Cache.VaryHeaders,
+				Language:             d.Config.Cache.Language,
+			})
+		case "CORS":
+			d.RegisterMiddleware(CORS{
+				AllowedOrigins:   d.Config.CORS.AllowedOrigins,
+				AllowedMethods:   d.Config.CORS.AllowedMethods,
+				AllowedHeaders:   d.Config.CORS.AllowedHeaders,
+				ExposedHeaders:   d.Config.CORS.ExposedHeaders,
+				AllowCredentials: d.Config.CORS.AllowCredentials,
+				MaxAge:           d.Config.CORS.MaxAge,
+			})
+		case "CSRF":
+			d.RegisterMiddleware(CSRF{
+				Pattern:         d.Pattern,
+				FieldName:       d.Config.CSRF.FieldName,
+				HeaderName:      d.Config.CSRF.HeaderName,
+				CookieName:      d.Config.CSRF.CookieName,
+				CookiePath:      d.Config.CSRF.Path,
+				Domain:          d.Config.CSRF.Domain,
+				Secure:          d.Config.CSRF.Secure,
+				ExemptRoutes:    d.Config.CSRF.ExemptRoutes,
+				ExemptURLPrefix: d.Config.CSRF.ExemptURLPrefix,
 			})
 		case "I18N":
 			d.RegisterMiddleware(I18N{
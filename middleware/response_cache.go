@@ -0,0 +1,284 @@
+package middleware
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urandom/webfw/context"
+)
+
+// ResponseCache is a size bounded, in-process store of responses, used by
+// the Cache middleware. The least recently used responses are evicted once
+// its size is exceeded. It is safe for concurrent use.
+type ResponseCache struct {
+	mutex   sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	varies  map[string][]string
+	calls   map[string]*cacheCall
+
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	route   string
+	tags    []string
+	created time.Time
+	expires time.Time
+	stale   time.Time
+	size    int64
+}
+
+// cacheCall is a response that is currently being produced, for which
+// other requests with the same key wait. The entry is set once, before the
+// done channel is closed, and is nil if the response isn't stored.
+type cacheCall struct {
+	done     chan struct{}
+	entry    *cacheEntry
+	released bool
+}
+
+// DefaultCacheMaxSize is the size of a ResponseCache, in bytes, created by
+// the Cache middleware if it doesn't specify its own.
+const DefaultCacheMaxSize = 32 << 20
+
+// NewResponseCache creates an empty cache, which will hold at most maxSize
+// bytes of responses.
+func NewResponseCache(maxSize int64) *ResponseCache {
+	return &ResponseCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		varies:  map[string][]string{},
+		calls:   map[string]*cacheCall{},
+		now:     time.Now,
+	}
+}
+
+// GetResponseCache returns the store of the Cache middleware, if it has
+// been registered.
+func GetResponseCache(c context.Context) (*ResponseCache, bool) {
+	if val, ok := c.GetGlobal(context.BaseCtxKey("responseCache")); ok {
+		return val.(*ResponseCache), true
+	}
+
+	return nil, false
+}
+
+// CacheTags tags the response of the current request. A cached response
+// may then be invalidated using any of its tags.
+func CacheTags(c context.Context, r *http.Request, tags ...string) {
+	var existing []string
+	if val, ok := c.Get(r, context.BaseCtxKey("cacheTags")); ok {
+		existing = val.([]string)
+	}
+
+	c.Set(r, context.BaseCtxKey("cacheTags"), append(existing, tags...))
+}
+
+// InvalidateRoute removes all responses produced by the named route, and
+// returns their number.
+func (rc *ResponseCache) InvalidateRoute(name string) int {
+	return rc.invalidate(func(e *cacheEntry) bool {
+		return e.route == name
+	})
+}
+
+// InvalidateTag removes all responses with the given tag, and returns their
+// number.
+func (rc *ResponseCache) InvalidateTag(tag string) int {
+	return rc.invalidate(func(e *cacheEntry) bool {
+		for _, t := range e.tags {
+			if t == tag {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// Purge removes all responses.
+func (rc *ResponseCache) Purge() {
+	rc.invalidate(func(e *cacheEntry) bool { return true })
+}
+
+// Len returns the number of cached responses.
+func (rc *ResponseCache) Len() int {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	return rc.lru.Len()
+}
+
+// Size returns the size of all cached responses, in bytes.
+func (rc *ResponseCache) Size() int64 {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	return rc.size
+}
+
+func (rc *ResponseCache) invalidate(match func(e *cacheEntry) bool) int {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	removed := 0
+	for el := rc.lru.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*cacheEntry)) {
+			rc.remove(el)
+			removed++
+		}
+		el = next
+	}
+
+	return removed
+}
+
+// key returns the full key of a request, made out of its primary key and
+// the values of the request headers, by which the responses vary.
+func (rc *ResponseCache) key(primary string, r *http.Request, vary []string) string {
+	rc.mutex.Lock()
+	stored := rc.varies[primary]
+	rc.mutex.Unlock()
+
+	return varyKey(primary, r, mergeVary(vary, stored))
+}
+
+// get returns the response for the key, unless it has gone stale.
+func (rc *ResponseCache) get(key string) *cacheEntry {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	el, ok := rc.entries[key]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*cacheEntry)
+	if rc.now().After(e.stale) {
+		rc.remove(el)
+		return nil
+	}
+
+	rc.lru.MoveToFront(el)
+
+	return e
+}
+
+// begin registers a call for the key, unless one is already in progress.
+// The returned flag is true if the caller is responsible for producing the
+// response.
+func (rc *ResponseCache) begin(key string) (*cacheCall, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if call, ok := rc.calls[key]; ok {
+		return call, false
+	}
+
+	call := &cacheCall{done: make(chan struct{})}
+	rc.calls[key] = call
+
+	return call, true
+}
+
+// release lets the requests waiting for the call produce the response
+// themselves, once it is known that it won't be stored.
+func (rc *ResponseCache) release(key string, call *cacheCall) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	rc.releaseCall(key, call, nil)
+}
+
+// finish stores the response, if any, and releases the requests waiting
+// for the call, unless they already have been.
+func (rc *ResponseCache) finish(key string, call *cacheCall, primary string, vary []string, e *cacheEntry) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if e != nil && e.size > rc.maxSize {
+		e = nil
+	}
+
+	rc.releaseCall(key, call, e)
+
+	if e == nil {
+		return
+	}
+
+	rc.varies[primary] = vary
+
+	if el, ok := rc.entries[e.key]; ok {
+		rc.remove(el)
+	}
+
+	rc.entries[e.key] = rc.lru.PushFront(e)
+	rc.size += e.size
+
+	for rc.size > rc.maxSize {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// releaseCall publishes the entry to the requests waiting for the call. The
+// mutex has to be held by the caller.
+func (rc *ResponseCache) releaseCall(key string, call *cacheCall, e *cacheEntry) {
+	if call.released {
+		return
+	}
+	call.released = true
+
+	if rc.calls[key] == call {
+		delete(rc.calls, key)
+	}
+
+	call.entry = e
+	close(call.done)
+}
+
+func (rc *ResponseCache) remove(el *list.Element) {
+	e := rc.lru.Remove(el).(*cacheEntry)
+	delete(rc.entries, e.key)
+	rc.size -= e.size
+}
+
+func varyKey(primary string, r *http.Request, vary []string) string {
+	key := primary
+	for _, h := range vary {
+		key += "\x00" + h + "=" + strings.Join(r.Header[h], ",")
+	}
+
+	return key
+}
+
+// mergeVary returns the sorted, canonical union of the header names.
+func mergeVary(lists ...[]string) []string {
+	seen := map[string]bool{}
+	var merged []string
+
+	for _, l := range lists {
+		for _, h := range l {
+			h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+			if h != "" && !seen[h] {
+				seen[h] = true
+				merged = append(merged, h)
+			}
+		}
+	}
+	sort.Strings(merged)
+
+	return merged
+}
@@ -1,10 +1,13 @@
 package middleware
 
 import (
+	"fmt"
+	"html/template"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,29 +27,139 @@ itself. "max-age", "cleanup-interval" and "cleanup-max-age" use the
 time.Duration string format. The "cleanup-interval" setting specifies a
 time.Ticker duration. On each tick, any file system session data will be
 removed, if its older than "cleanup-max-age". If the later setting is empty,
-all session data will be deleted.
+all session data will be deleted. If the store reports its cleanup
+statistics, the number of scanned and removed sessions is logged as well.
+
+The session data is stored in the filesystem by default. The "store"
+setting may be set to "redis", in which case the data will be stored in a
+server speaking the Redis protocol, allowing multiple server instances to
+share the sessions. Such a store is configured with the "redis-network",
+"redis-address", "redis-password", "redis-db", "redis-prefix" and
+"redis-max-idle" settings. Finally, if the "store" setting is "cookie", no
+data will be stored on the server. Instead, it will be encrypted with
+AES-GCM, using the "cipher" or a key derived from the "secret", and stored
+in the session cookies themselves. Such sessions have to be small, since
+browsers limit the size of cookies.
+
+In order to rotate the session keys without invalidating existing
+sessions, the previous secrets and ciphers may be listed using the
+"old-secret" and "old-cipher" settings. The current "secret" and "cipher"
+are always used when writing the session cookie, while the old ones are
+only used to verify it.
+
+By default, the session cookie contains the session name and the date of
+its last use in plain text, along with their signature. If the
+"cookie-version" setting is set to 2, the whole cookie will be encrypted
+and authenticated using AES-GCM instead. Cookies of the previous version
+are still accepted, so that existing sessions may be migrated. Since the
+default "secret" is public, the middleware will refuse to start with it,
+unless the server is in devel mode.
+
+The session data is loaded from the store only when it is first accessed
+during a request, and written back only if it has been modified. Otherwise,
+only when the session cookie becomes older than the "refresh-interval"
+duration, it will be refreshed, along with the stored data, thus extending
+the life of the session. If the interval is empty, the session is written
+on each request.
+
+A session expires when it hasn't been used for longer than the
+"idle-timeout" duration, which defaults to "max-age". Since the timeout is
+measured from the last write of the session cookie, it slides forward with
+each refresh. Regardless of its use, a session also expires once it has
+been created longer than the "absolute-timeout" duration ago, if that is
+set. An expired session loses all its values, forcing the user to log in
+again. The 'OnExpire' struct field may be set to a context.ExpiryHandler
+function, in order to be notified of such sessions.
+
+The session values are encoded using encoding/gob by default. The "codec"
+setting may be set to "json" or "msgpack" instead, in which case any custom
+value types have to be registered using context.RegisterType. Data written
+with a different codec is still read, and rewritten using the configured
+one, so that the codec may be changed without losing the existing sessions.
+
+Concurrent requests using the same session, such as parallel AJAX calls,
+may overwrite each other's changes. If the "lock-timeout" setting is set,
+and the session store supports locking, each request will lock its session
+until the session is written, waiting at most for the given duration for
+other requests to finish. If the lock can't be acquired in time, the
+request fails with a "503 Service Unavailable" status, without calling the
+next handler. The file store only locks sessions
+within the current process, while the redis store locks them across all
+servers.
+
+The session cookie may be configured using the "cookie-name", "domain",
+"path", "secure", "http-only" and "same-site" settings. If the path is
+empty, the dispatcher pattern will be used. The "secure" setting may be
+either "true", "false", or "auto", in which case the cookie will be secure
+only when the request was made over HTTPS, either directly, or as reported
+by a proxy via the X-Forwarded-Proto header. The "http-only" setting
+defaults to "true", and the "same-site" one may be one of "lax", "strict"
+or "none", defaulting to "lax".
+
+Since the session is written just before the response headers are sent,
+any handler may call the Regenerate method of a context.RegenerableSession,
+such as after a login, or its Destroy method, when logging out. The session
+cookie will be updated or expired accordingly. Changes made after the
+handler has started writing the response body are still stored, though the
+cookie can no longer be updated.
+
+Flash messages, added using the AddFlash method of a context.FlashSession,
+may be rendered with the "flashes" template function. It receives the
+session, the current language and any categories, such as "success" or
+"error", and returns the pending messages of those categories, removing
+them from the session. Each returned item has a Category and a Message
+field. If the message has a translation in the given language, as used by
+the I18N middleware's "__" function, it will be translated, otherwise it
+will be evaluated with its arguments. Arguments, which aren't template.HTML,
+are escaped, so that user input may be safely passed. The "hasFlashes" function receives the
+session and any categories, and reports whether such messages are pending.
+For example:
+    {{ range flashes .base.session .base.lang }}
+      <p class="{{ .Category }}">{{ .Message }}</p>
+    {{ end }}
+
+The background refreshes of stale responses, made by the Cache middleware,
+don't receive a session, since they aren't made on behalf of any client.
 
 If the session middleware is initialized and registered to a dispatcher
 manually, it is possible to set the 'SessionGenerator' struct field, so that
 a different session implementation may be used. If that is not set,
-session.NewSession will be used.
+session.NewSession will be used. Similarly, the 'Store' struct field may be
+set to any context.SessionStore implementation.
 */
 type Session struct {
 	Path            string
 	Secret          []byte
 	Cipher          []byte
+	OldSecrets      [][]byte
+	OldCiphers      [][]byte
 	MaxAge          string
+	RefreshInterval string
+	IdleTimeout     string
+	AbsoluteTimeout string
+	LockTimeout     string
 	CleanupInterval string
 	CleanupMaxAge   string
 	Pattern         string
 	IgnoreURLPrefix []string
+	CookieName      string
+	CookieVersion   int
+	Domain          string
+	CookiePath      string
+	Secure          string
+	HttpOnly        string
+	SameSite        string
 
 	SessionGenerator context.SessionGenerator
+	Store            context.SessionStore
+	OnExpire         context.ExpiryHandler
+	Codec            context.Codec
 }
 
 func (smw Session) Handler(ph http.Handler, c context.Context) http.Handler {
 	var abspath string
-	var maxAge, cleanupInterval, cleanupMaxAge time.Duration
+	var maxAge, refreshInterval, idleTimeout, absoluteTimeout time.Duration
+	var lockTimeout, cleanupInterval, cleanupMaxAge time.Duration
 
 	if filepath.IsAbs(smw.Path) {
 		abspath = smw.Path
@@ -68,8 +181,54 @@ func (smw Session) Handler(ph http.Handler, c context.Context) http.Handler {
 		}
 	}
 
+	if smw.RefreshInterval != "" {
+		var err error
+		refreshInterval, err = time.ParseDuration(smw.RefreshInterval)
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if smw.IdleTimeout != "" {
+		var err error
+		idleTimeout, err = time.ParseDuration(smw.IdleTimeout)
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if smw.AbsoluteTimeout != "" {
+		var err error
+		absoluteTimeout, err = time.ParseDuration(smw.AbsoluteTimeout)
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if smw.LockTimeout != "" {
+		var err error
+		lockTimeout, err = time.ParseDuration(smw.LockTimeout)
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	opts, secureAuto := smw.cookieOptions()
+
+	cookieName := smw.CookieName
+	if cookieName == "" {
+		cookieName = "session"
+	}
+	c.SetGlobal(context.BaseCtxKey("sessionCookieName"), cookieName)
+
 	logger := webfw.GetLogger(c)
 
+	webfw.GetRenderer(c).Funcs(smw.TemplateFuncMap())
+
 	if smw.CleanupInterval != "" {
 		var err error
 		cleanupInterval, err = time.ParseDuration(smw.CleanupInterval)
@@ -84,11 +243,24 @@ func (smw Session) Handler(ph http.Handler, c context.Context) http.Handler {
 			panic(err)
 		}
 
+		store := smw.Store
+		if store == nil {
+			store = context.NewFileStore(abspath)
+		}
+
 		go func() {
 			for _ = range time.Tick(cleanupInterval) {
 				logger.Print("Cleaning up old sessions")
 
-				if err := context.CleanupSessions(abspath, cleanupMaxAge); err != nil {
+				if cleaner, ok := store.(context.SessionCleaner); ok {
+					stats, err := cleaner.CleanupWithStats(cleanupMaxAge)
+					if err != nil {
+						logger.Printf("Failed to clean up sessions: %v", err)
+					}
+
+					logger.Printf("Removed %d of %d sessions in %v",
+						stats.Removed, stats.Scanned, stats.Duration)
+				} else if err := store.Cleanup(cleanupMaxAge); err != nil {
 					logger.Printf("Failed to clean up sessions: %v", err)
 				}
 			}
@@ -118,6 +290,11 @@ func (smw Session) Handler(ph http.Handler, c context.Context) http.Handler {
 			}
 		}
 
+		// Background refreshes of the Cache middleware are anonymous
+		if _, ok := c.Get(r, context.BaseCtxKey("cacheRevalidation")); ok {
+			ignore = true
+		}
+
 		if ignore {
 			ph.ServeHTTP(w, r)
 			return
@@ -132,6 +309,43 @@ func (smw Session) Handler(ph http.Handler, c context.Context) http.Handler {
 			sess = smw.SessionGenerator(smw.Secret, smw.Cipher, abspath)
 		}
 		sess.SetMaxAge(maxAge)
+		if smw.CookieName != "" {
+			sess.SetCookieName(smw.CookieName)
+		}
+
+		if ss, ok := sess.(context.StoreSession); ok {
+			ss.SetRefreshThreshold(refreshInterval)
+			ss.SetLazyLoad(true)
+			if smw.Store != nil {
+				ss.SetStore(smw.Store)
+			}
+			if smw.Codec != nil {
+				ss.SetCodec(smw.Codec)
+			}
+		}
+
+		if ts, ok := sess.(context.TimeoutSession); ok {
+			ts.SetIdleTimeout(idleTimeout)
+			ts.SetAbsoluteTimeout(absoluteTimeout)
+			if smw.OnExpire != nil {
+				ts.SetExpiryHandler(smw.OnExpire)
+			}
+		}
+
+		if cs, ok := sess.(context.CookieOptionsSession); ok {
+			if smw.CookieVersion > 0 {
+				cs.SetCookieVersion(smw.CookieVersion)
+			}
+
+			cookieOpts := opts
+			if secureAuto {
+				cookieOpts.Secure = r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+			}
+			cs.SetCookieOptions(cookieOpts)
+			if len(smw.OldSecrets) > 0 || len(smw.OldCiphers) > 0 {
+				cs.SetOldKeys(smw.OldSecrets, smw.OldCiphers)
+			}
+		}
 
 		err := sess.Read(r, c)
 
@@ -147,23 +361,178 @@ func (smw Session) Handler(ph http.Handler, c context.Context) http.Handler {
 		c.Set(r, context.BaseCtxKey("session"), sess)
 		c.Set(r, context.BaseCtxKey("firstTimer"), firstTimer)
 
-		rec := util.NewRecorderHijacker(w)
+		store, _ := sess.(context.StoreSession)
+
+		if lockTimeout > 0 && !firstTimer && store != nil {
+			if locker, ok := store.Store().(context.SessionLocker); ok {
+				unlock, err := locker.Lock(sess.Name(), lockTimeout)
+				if err != nil {
+					// Continuing without the lock could lose the
+					// changes of the other requests
+					logger.Printf("Unable to lock session: %v", err)
+
+					code := http.StatusInternalServerError
+					if err == context.ErrLockTimeout {
+						code = http.StatusServiceUnavailable
+					}
+					http.Error(w, http.StatusText(code), code)
+					return
+				}
+				defer unlock()
+			}
+		}
+
+		writeSession := func(rw util.ResponseWriter) {
+			// Sessions, which don't track their modifications, are
+			// always written
+			if store == nil || store.Modified() {
+				if err := sess.Write(rw); err != nil {
+					logger.Printf("Unable to write session: %v", err)
+				}
+			}
+		}
+
+		rw := util.NewResponseWriter(w)
+		rw.Before(writeSession)
 
-		ph.ServeHTTP(rec, r)
+		ph.ServeHTTP(rw, r)
 
-		for k, v := range rec.Header() {
-			w.Header()[k] = v
+		if !rw.Written() {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			// Changes made after the headers were sent can't update
+			// the cookie, but are still stored
+			writeSession(rw)
 		}
+	}
+
+	return http.HandlerFunc(handler)
+}
+
+// TemplateFuncMap returns the flash message template functions. The
+// "flashes" function receives the session and the current language, along
+// with any categories, and returns the pending flash messages of those
+// categories, removing them from the session. The "hasFlashes" function
+// receives the session and any categories, and reports whether there are
+// pending messages, without removing them. Sessions, which don't implement
+// context.FlashSession, never have any pending messages.
+func (smw Session) TemplateFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"flashes": func(sess context.Session, lang string, categories ...string) ([]renderedFlash, error) {
+			fs, ok := sess.(context.FlashSession)
+			if !ok {
+				return nil, nil
+			}
+
+			messages := fs.Flashes(flashCategories(categories)...)
+			rendered := make([]renderedFlash, len(messages))
+
+			for i, m := range messages {
+				text, err := flashText(m, lang)
+				if err != nil {
+					return nil, err
+				}
 
-		if sess != nil {
-			if err := sess.Write(w); err != nil {
-				logger.Printf("Unable to write session: %v", err)
+				rendered[i] = renderedFlash{Category: m.Category, Message: text}
 			}
+
+			return rendered, nil
+		},
+		"hasFlashes": func(sess context.Session, categories ...string) bool {
+			fs, ok := sess.(context.FlashSession)
+
+			return ok && len(fs.PeekFlashes(flashCategories(categories)...)) > 0
+		},
+	}
+}
+
+func (smw Session) cookieOptions() (context.CookieOptions, bool) {
+	opts := context.CookieOptions{
+		Domain:   smw.Domain,
+		Path:     smw.CookiePath,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if opts.Path == "" {
+		opts.Path = smw.Pattern
+	}
+
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+
+	secureAuto := false
+	switch smw.Secure {
+	case "", "false":
+	case "true":
+		opts.Secure = true
+	case "auto":
+		secureAuto = true
+	default:
+		panic(fmt.Sprintf("Invalid session secure value '%s'", smw.Secure))
+	}
+
+	if smw.HttpOnly != "" {
+		var err error
+		if opts.HttpOnly, err = strconv.ParseBool(smw.HttpOnly); err != nil {
+			panic(err)
 		}
+	}
 
-		w.WriteHeader(rec.GetCode())
-		w.Write(rec.GetBody().Bytes())
+	switch strings.ToLower(smw.SameSite) {
+	case "", "lax":
+	case "strict":
+		opts.SameSite = http.SameSiteStrictMode
+	case "none":
+		opts.SameSite = http.SameSiteNoneMode
+	default:
+		panic(fmt.Sprintf("Invalid session same-site value '%s'", smw.SameSite))
 	}
 
-	return http.HandlerFunc(handler)
+	return opts, secureAuto
+}
+
+// renderedFlash is a flash message, whose message has been translated, or
+// evaluated with its arguments.
+type renderedFlash struct {
+	Category context.FlashCategory
+	Message  template.HTML
+}
+
+func flashCategories(categories []string) []context.FlashCategory {
+	fc := make([]context.FlashCategory, len(categories))
+	for i := range categories {
+		fc[i] = context.FlashCategory(categories[i])
+	}
+
+	return fc
+}
+
+// flashText translates the flash message to the given language, if it has
+// a translation. Since the message may contain data supplied by the user,
+// every argument, which isn't already template.HTML, is escaped.
+func flashText(m context.FlashMessage, lang string) (template.HTML, error) {
+	count, hasCount, dataMap, err := messageData(m.Args)
+	if err != nil {
+		return "", err
+	}
+
+	if s, ok := count.(string); ok {
+		count = template.HTMLEscapeString(s)
+	}
+
+	for k, v := range dataMap {
+		if _, ok := v.(template.HTML); !ok {
+			dataMap[k] = template.HTMLEscapeString(fmt.Sprint(v))
+		}
+	}
+
+	if lang != "" {
+		if text, err := translate(m.Message, lang, lang, count, hasCount, dataMap); err == nil {
+			return text, nil
+		}
+	}
+
+	return evalMessage(m.Message, dataMap)
 }
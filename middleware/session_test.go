@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"html/template"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -9,7 +10,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/urandom/webfw"
 	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/renderer"
+
+	"github.com/nicksnyder/go-i18n/i18n"
 )
 
 var secret = []byte("test")
@@ -80,3 +85,313 @@ func TestSessionHandler(t *testing.T) {
 	}
 
 }
+
+func TestSessionCookieOptions(t *testing.T) {
+	c := context.NewContext()
+	mw := Session{
+		Path:       path.Join(os.TempDir(), "session"),
+		Secret:     secret,
+		Pattern:    "/app/",
+		CookieName: "sid",
+		Domain:     "example.com",
+		Secure:     "auto",
+		SameSite:   "strict",
+	}
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/app/url", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a session cookie, got %v\n", cookies)
+	}
+
+	cookie := cookies[0]
+	if cookie.Name != "sid" || cookie.Path != "/app/" || cookie.Domain != "example.com" {
+		t.Fatalf("Unexpected session cookie attributes %v\n", cookie)
+	}
+
+	if !cookie.HttpOnly || cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("Unexpected session cookie flags %v\n", cookie)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/app/url", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || !cookies[0].Secure {
+		t.Fatalf("Expected a secure session cookie, got %v\n", cookies)
+	}
+}
+
+func TestSessionHandlerUnmodified(t *testing.T) {
+	c := context.NewContext()
+	mw := Session{
+		Path:            path.Join(os.TempDir(), "session"),
+		Secret:          secret,
+		RefreshInterval: "1h",
+	}
+
+	set := true
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if set {
+			webfw.GetSession(c, r).Set("foo", "bar")
+		}
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	cookie := rec.Header().Get("Set-Cookie")
+	if cookie == "" {
+		t.Fatalf("Expected a session cookie\n")
+	}
+
+	set = false
+	r, _ = http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("Expected an unmodified session to not be written\n")
+	}
+}
+
+// coreSession only implements the context.Session interface, hiding any of
+// the optional ones of the embedded session.
+type coreSession struct {
+	context.Session
+}
+
+func TestSessionHandlerCoreSession(t *testing.T) {
+	c := context.NewContext()
+	mw := Session{
+		Path:          path.Join(os.TempDir(), "session"),
+		Secret:        secret,
+		CookieVersion: 2,
+		LockTimeout:   "1s",
+		SessionGenerator: func(secret, cipher []byte, path string) context.Session {
+			return coreSession{context.NewSession(secret, cipher, path)}
+		},
+	}
+
+	var value interface{}
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := webfw.GetSession(c, r)
+		if _, ok := sess.(context.StoreSession); ok {
+			t.Fatalf("Expected a session without optional capabilities\n")
+		}
+
+		value, _ = sess.Get("foo")
+		sess.Set("foo", "bar")
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	cookie := rec.Header().Get("Set-Cookie")
+	if cookie == "" {
+		t.Fatalf("Expected a session cookie\n")
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if value != "bar" {
+		t.Fatalf("Expected the stored value 'bar', got '%v'\n", value)
+	}
+}
+
+func TestSessionHandlerStreaming(t *testing.T) {
+	c := context.NewContext()
+	mw := Session{
+		Path:   path.Join(os.TempDir(), "session"),
+		Secret: secret,
+	}
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := webfw.GetSession(c, r)
+		sess.Set("foo", "bar")
+
+		w.Write([]byte("body"))
+		w.(http.Flusher).Flush()
+
+		sess.Set("late", "value")
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	cookie := rec.Header().Get("Set-Cookie")
+	if cookie == "" || rec.Body.String() != "body" {
+		t.Fatalf("Expected a session cookie and the body, got '%s', '%s'\n", cookie, rec.Body.String())
+	}
+
+	var values []interface{}
+	h = mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := webfw.GetSession(c, r)
+		for _, key := range []string{"foo", "late"} {
+			v, _ := sess.Get(key)
+			values = append(values, v)
+		}
+	}), c)
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+	r.Header.Set("Cookie", cookie[:strings.Index(cookie, ";")])
+
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(values) != 2 || values[0] != "bar" || values[1] != "value" {
+		t.Fatalf("Expected the values set before and after writing the body, got %v\n", values)
+	}
+}
+
+func TestSessionHandlerLock(t *testing.T) {
+	c := context.NewContext()
+	mw := Session{
+		Path:        path.Join(os.TempDir(), "session"),
+		Secret:      secret,
+		LockTimeout: "5s",
+	}
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := webfw.GetSession(c, r)
+
+		count, _ := sess.Get("count")
+		if count == nil {
+			count = 0
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		sess.Set("count", count.(int)+1)
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	cookie := rec.Header().Get("Set-Cookie")
+	cookie = cookie[:strings.Index(cookie, ";")]
+
+	done := make(chan bool)
+	for i := 0; i < 5; i++ {
+		go func() {
+			r, _ := http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+			r.Header.Set("Cookie", cookie)
+
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			done <- true
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+	r.Header.Set("Cookie", cookie)
+
+	sess := context.NewSession(secret, nil, mw.Path)
+	if err := sess.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, _ := sess.Get("count"); count != 6 {
+		t.Fatalf("Expected the count to be 6, got %v\n", count)
+	}
+
+	unlock, err := context.NewFileStore(mw.Path).Lock(sess.Name(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	mw.LockTimeout = "20ms"
+	called := false
+	h = mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		webfw.GetSession(c, r).Set("count", 0)
+	}), c)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusServiceUnavailable || called {
+		t.Fatalf("Expected the request to fail without the lock, got %d\n", rec.Code)
+	}
+
+	if err := sess.Read(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, _ := sess.Get("count"); count != 6 {
+		t.Fatalf("Expected the count to stay 6, got %v\n", count)
+	}
+}
+
+func TestSessionFlashes(t *testing.T) {
+	if err := i18n.LoadTranslationFile("testdata/en.all.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := context.NewContext()
+	ren := renderer.NewRenderer("testdata", "test.tmpl")
+	c.SetGlobal(context.BaseCtxKey("renderer"), ren)
+
+	mw := Session{
+		Path:   path.Join(os.TempDir(), "session"),
+		Secret: secret,
+	}
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := webfw.GetSession(c, r).(context.FlashSession)
+		sess.AddFlash(context.FlashSuccess, "flash_saved", "Name", "<b>foo</b>")
+		sess.AddFlash(context.FlashError, "Failed {{.Count}} times", "Count", 3)
+		sess.AddFlash(context.FlashInfo, "{{.Field}} {{.Value}}", "Field", template.HTML("<em>name</em>"), "Value", []string{"<script>"})
+
+		c.Set(r, context.BaseCtxKey("lang"), "en")
+		if err := ren.Render(w, nil, c.GetAll(r), "test_flash.tmpl"); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(sess.Flashes()) != 0 {
+			t.Fatalf("Expected the rendered flash messages to be consumed\n")
+		}
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/some/url", nil)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"has errors",
+		`<p class="success">Saved &lt;b&gt;foo&lt;/b&gt;</p>`,
+		`<p class="error">Failed 3 times</p>`,
+		`<p class="info"><em>name</em> [&lt;script&gt;]</p>`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Expected body '%s' to contain '%s'\n", body, expected)
+		}
+	}
+}
@@ -1,21 +1,23 @@
 package middleware
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"time"
 
+	"github.com/urandom/webfw"
 	"github.com/urandom/webfw/context"
-	"github.com/urandom/webfw/fs"
+	"github.com/urandom/webfw/renderer"
+	"github.com/urandom/webfw/static"
 	"github.com/urandom/webfw/util"
-
-	"sort"
-	"strings"
 )
 
 /*
@@ -36,6 +38,34 @@ The following server configuration variables may be set:
     - "file-list" is a boolean flag, which will cause the middleware to
       show the directory listing if the request is for a directory, and
       it doesn't contain an index file.
+    - "file-list-template" is the name of a renderer template, used for
+      the directory listing instead of the default one. The static.Listing
+      is available in it under the "listing" key.
+    - "fingerprint" is a boolean flag, which will cause the middleware to
+      hash the contents of all static files on startup, and to also serve
+      each file under a fingerprinted path, such as "/app.3f9a1c2b.js" for
+      "/app.js". Such responses may be cached indefinitely. Files changed
+      after startup keep their old fingerprint until the server restarts.
+    - "manifest" is the name of a file, to which the JSON manifest of the
+      fingerprinted paths will be written on startup.
+    - "content-etag" is a boolean flag, which will cause the ETag of a file
+      to be a hash of its contents, rather than of its path and
+      modification time. The hash is cached until the file changes.
+
+The "asset" template function, registered on the base renderer template,
+returns the url of a static file, given its path relative to the static
+directory. If fingerprinting is enabled, the fingerprinted url is returned:
+    - {{ asset "app.js" }} -> /app.3f9a1c2b.js
+
+If a file has precompressed siblings, with the same name and a ".br" or
+".gz" suffix, the one most preferred by the Accept-Encoding header of the
+request is served instead, with the Content-Type of the original file.
+Range requests apply to the served, compressed representation.
+
+The files themselves are served by a static.FileServer. The
+webfw.StaticController may be used instead of this middleware, to serve
+files from a prefix before any routing takes place, or from multiple
+directories.
 */
 type Static struct {
 	Path     string
@@ -43,28 +73,16 @@ type Static struct {
 	Index    string
 	Expires  string
 	FileList bool
-}
-
-var staticTmpl *template.Template
 
-type FileStats []os.FileInfo
+	FileListTemplate string
 
-type fileList struct {
-	CurDir string
-	Stats  FileStats
+	Fingerprint bool
+	Manifest    string
+	ContentETag bool
 }
 
-func (fs FileStats) Len() int           { return len(fs) }
-func (fs FileStats) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
-func (fs FileStats) Less(i, j int) bool { return fs[i].Name() < fs[j].Name() }
-
-func init() {
-	staticTmpl = template.Must(template.New("filelist").Funcs(template.FuncMap{
-		"formatdate": func(t time.Time) string {
-			return t.Format(dateFormat)
-		},
-	}).Parse(fileListTemplate))
-}
+// FileStats sorts file stats by name.
+type FileStats = static.FileStats
 
 func (mw Static) Handler(ph http.Handler, c context.Context) http.Handler {
 	var expires time.Duration
@@ -78,120 +96,109 @@ func (mw Static) Handler(ph http.Handler, c context.Context) http.Handler {
 		}
 	}
 
+	var assets AssetManifest
+	var fingerprinted map[string]string
+
+	if mw.Fingerprint {
+		var err error
+		if assets, err = FingerprintAssets(mw.Path); err != nil {
+			panic(err)
+		}
+
+		if mw.Manifest != "" {
+			if err := assets.WriteFile(mw.Manifest); err != nil {
+				panic(err)
+			}
+		}
+
+		fingerprinted = assets.originals()
+	}
+
+	server := &static.FileServer{
+		Roots:       []string{mw.Path},
+		Index:       mw.Index,
+		FileList:    mw.FileList,
+		Expires:     expires,
+		ContentETag: mw.ContentETag,
+		ETag:        generateEtag,
+	}
+
+	if mw.FileListTemplate != "" {
+		server.RenderList = func(w http.ResponseWriter, r *http.Request, l static.Listing) error {
+			return webfw.GetRenderCtx(c, r)(w, renderer.RenderData{"listing": l}, mw.FileListTemplate)
+		}
+	}
+
+	webfw.GetRenderer(c).Funcs(template.FuncMap{
+		"asset": func(name string) string {
+			return path.Join("/", mw.Prefix, assets.Path(name))
+		},
+	})
+
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		rec := util.NewRecorderHijacker(w)
+		nw := &notFoundWriter{ResponseWriter: util.NewResponseWriter(w), header: http.Header{}}
 
-		ph.ServeHTTP(rec, r)
+		ph.ServeHTTP(nw, r)
 
-		if rec.GetCode() != http.StatusNotFound {
-			copyRecorder(rec, w)
+		if !nw.notFound {
+			if !nw.Written() {
+				nw.commit()
+			}
 
 			return
 		}
+		defer util.BufferPool.Put(nw.body)
 
-		uriParts := strings.SplitN(r.RequestURI, "?", 2)
-		if uriParts[0] == "" {
-			uriParts[0] = r.URL.Path
+		if mw.serve(w, r, server, fingerprinted) {
+			return
 		}
-		for {
-			if r.Method != "GET" && r.Method != "HEAD" {
-				break
-			}
-			rpath := uriParts[0]
 
-			if mw.Prefix != "" {
-				if !strings.HasPrefix(rpath, mw.Prefix) {
-					break
-				}
+		nw.commit()
+		w.WriteHeader(http.StatusNotFound)
+		nw.body.WriteTo(w)
+	}
 
-				rpath = rpath[len(mw.Prefix):]
-				if rpath != "" && rpath[0] != '/' {
-					break
-				}
-			}
+	return http.HandlerFunc(handler)
+}
 
-			file, err := fs.DefaultFS.OpenRoot(mw.Path, rpath)
-			if err != nil {
-				break
-			}
-			defer file.Close()
+// serve serves the static file for the request, returning false if there
+// is none.
+func (mw Static) serve(w http.ResponseWriter, r *http.Request, server *static.FileServer, fingerprinted map[string]string) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
 
-			stat, err := file.Stat()
-			if err != nil {
-				break
-			}
+	rpath := strings.SplitN(r.RequestURI, "?", 2)[0]
+	if rpath == "" {
+		rpath = r.URL.Path
+	}
 
-			if stat.IsDir() {
-				if !strings.HasSuffix(uriParts[0], "/") {
-					http.Redirect(w, r, uriParts[0]+"/", http.StatusFound)
-					return
-				}
-
-				index := "index.html"
-				if mw.Index != "" {
-					index = mw.Index
-				}
-
-				ipath := path.Join(rpath, index)
-
-				file, err = fs.DefaultFS.OpenRoot(mw.Path, ipath)
-				if err == nil {
-					defer file.Close()
-					stat, err = file.Stat()
-				}
-
-				if err != nil || stat.IsDir() {
-					if mw.FileList {
-						file, err := fs.DefaultFS.OpenRoot(mw.Path, rpath)
-						if err != nil {
-							break
-						}
-
-						stats, err := file.Readdir(1000)
-						if err != nil {
-							break
-						}
-
-						sort.Sort(FileStats(stats))
-						fileList := &fileList{CurDir: path.Base(rpath), Stats: stats}
-
-						buf := util.BufferPool.GetBuffer()
-						defer util.BufferPool.Put(buf)
-
-						if err := staticTmpl.Execute(buf, fileList); err != nil {
-							break
-						}
-
-						if _, err := buf.WriteTo(w); err != nil {
-							break
-						}
-
-						return
-					} else {
-						break
-					}
-				} else {
-					rpath = ipath
-				}
-			}
+	if mw.Prefix != "" {
+		if !strings.HasPrefix(rpath, mw.Prefix) {
+			return false
+		}
 
-			etag := generateEtag(rpath, stat)
+		rpath = rpath[len(mw.Prefix):]
+		if rpath != "" && rpath[0] != '/' {
+			return false
+		}
+	}
 
-			w.Header().Set("ETag", etag)
+	if name, ok := fingerprinted[strings.TrimPrefix(rpath, "/")]; ok {
+		if file, stat, root, err := server.Open(name); err == nil {
+			defer file.Close()
 
-			if expires != 0 {
-				w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%.0f", expires.Seconds()))
-				w.Header().Set("Expires", time.Now().Add(expires).Format(http.TimeFormat))
-			}
+			if !stat.IsDir() {
+				w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+				w.Header().Set("Expires", time.Now().AddDate(1, 0, 0).Format(http.TimeFormat))
 
-			http.ServeContent(w, r, rpath, stat.ModTime(), file)
-			return
+				server.ServeFile(w, r, root, "/"+name, file, stat)
+				return true
+			}
 		}
-
-		copyRecorder(rec, w)
 	}
 
-	return http.HandlerFunc(handler)
+	return server.ServePath(w, r, rpath)
 }
 
 func generateEtag(rpath string, stat os.FileInfo) string {
@@ -200,44 +207,66 @@ func generateEtag(rpath string, stat os.FileInfo) string {
 	return base64.URLEncoding.EncodeToString(hash[:])
 }
 
-func copyRecorder(rec util.RecorderHijacker, w http.ResponseWriter) {
-	for k, v := range rec.Header() {
-		w.Header()[k] = v
+// notFoundWriter passes the response through, unless its status is
+// http.StatusNotFound. Such a response is held back instead, so that it may
+// be replaced by a static file.
+type notFoundWriter struct {
+	util.ResponseWriter
+	header   http.Header
+	notFound bool
+	body     *bytes.Buffer
+}
+
+func (nw *notFoundWriter) Header() http.Header {
+	return nw.header
+}
+
+func (nw *notFoundWriter) WriteHeader(code int) {
+	if nw.notFound || nw.Written() {
+		return
+	}
+
+	if code == http.StatusNotFound {
+		nw.notFound = true
+		nw.body = util.BufferPool.GetBuffer()
+		return
 	}
-	w.WriteHeader(rec.GetCode())
-	w.Write(rec.GetBody().Bytes())
+
+	nw.commit()
+	nw.ResponseWriter.WriteHeader(code)
 }
 
-const fileListTemplate = `
-<!doctype html>
-<html>
-	<head>
-		<title>{{ .CurDir }}</title>
-	</head>
-	<body>
-		<table>
-			<tbody>
-				<tr>
-					<td><a href="../">../</a></td>
-					<td colspan="2"></td>
-				</tr>
-				{{ range .Stats }}
-					<tr>
-						<td>
-							{{ if .IsDir }}
-								<a href="{{ .Name }}/">{{ .Name }}/</a>
-							{{ else }}
-								<a href="{{ .Name }}">{{ .Name }}</a>
-							{{ end }}
-						</td>
-						<td>
-							{{ .ModTime | formatdate }}
-						</td>
-						<td>
-							{{ .Size }}
-						</td>
-					</tr>
-				{{ end }}
-	</body>
-</html>
-`
+func (nw *notFoundWriter) Write(b []byte) (int, error) {
+	nw.WriteHeader(http.StatusOK)
+
+	if nw.notFound {
+		return nw.body.Write(b)
+	}
+
+	return nw.ResponseWriter.Write(b)
+}
+
+func (nw *notFoundWriter) ReadFrom(r io.Reader) (int64, error) {
+	nw.WriteHeader(http.StatusOK)
+
+	if nw.notFound {
+		return nw.body.ReadFrom(r)
+	}
+
+	return nw.ResponseWriter.ReadFrom(r)
+}
+
+func (nw *notFoundWriter) Flush() {
+	nw.WriteHeader(http.StatusOK)
+
+	if !nw.notFound {
+		nw.ResponseWriter.Flush()
+	}
+}
+
+// commit copies the headers, set by the handler, to the wrapped writer.
+func (nw *notFoundWriter) commit() {
+	for k, v := range nw.header {
+		nw.ResponseWriter.Header()[k] = v
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/fs"
 )
 
 func TestStaticHandler(t *testing.T) {
@@ -239,3 +241,204 @@ func TestStaticHandler(t *testing.T) {
 		t.Fatalf("Expected file list to contain '%s', got '%s'\n", expectedStr, rec.Body.String())
 	}
 }
+
+func TestStaticHandlerNotFound(t *testing.T) {
+	c := context.NewContext()
+	mw := Static{Path: "testdata"}
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	}), c)
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/missing.json", nil)
+	r.RequestURI = "/missing.json"
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "not found" || rec.Header().Get("Content-Type") != "text/html" {
+		t.Fatalf("Expected the original 404 response, got %d, %v, '%s'\n", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/en.all.json", nil)
+	r.RequestURI = "/en.all.json"
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") == "text/html" {
+		t.Fatalf("Expected the static file without the 404 headers, got %d, %v\n", rec.Code, rec.Header())
+	}
+}
+
+func TestStaticHandlerPrecompressed(t *testing.T) {
+	c := context.NewContext()
+
+	dir, err := ioutil.TempDir("", "webfw-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"app.js":     "var app = 'uncompressed';",
+		"app.js.br":  "brotli compressed app",
+		"app.js.gz":  "gzip compressed app",
+		"style.css":  "body {}",
+		"index.html": "<html></html>",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := Static{Path: dir}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}), c)
+
+	for _, test := range []struct {
+		uri, accept, encoding, body string
+	}{
+		{"/app.js", "gzip, deflate, br", "br", files["app.js.br"]},
+		{"/app.js", "gzip", "gzip", files["app.js.gz"]},
+		{"/app.js", "br;q=0.5, gzip", "gzip", files["app.js.gz"]},
+		{"/app.js", "", "", files["app.js"]},
+		{"/style.css", "br", "", files["style.css"]},
+	} {
+		r, _ := http.NewRequest("GET", "http://localhost:8080"+test.uri, nil)
+		r.RequestURI = test.uri
+		r.Header.Set("Accept-Encoding", test.accept)
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, r)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected code %d for %+v, got %d\n", http.StatusOK, test, rec.Code)
+		}
+
+		if e := rec.Header().Get("Content-Encoding"); e != test.encoding {
+			t.Fatalf("Expected encoding '%s' for %+v, got '%s'\n", test.encoding, test, e)
+		}
+
+		if rec.Body.String() != test.body {
+			t.Fatalf("Expected body '%s' for %+v, got '%s'\n", test.body, test, rec.Body.String())
+		}
+
+		if ct := rec.Header().Get("Content-Type"); ct != mime.TypeByExtension(path.Ext(test.uri)) {
+			t.Fatalf("Expected the content type of the original file for %+v, got '%s'\n", test, ct)
+		}
+
+		vary := rec.Header().Get("Vary")
+		if test.uri == "/app.js" && vary != "Accept-Encoding" {
+			t.Fatalf("Expected a Vary header for %+v, got '%s'\n", test, vary)
+		} else if test.uri != "/app.js" && vary != "" {
+			t.Fatalf("Expected no Vary header for %+v, got '%s'\n", test, vary)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/app.js", nil)
+	r.RequestURI = "/app.js"
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Range", "bytes=0-3")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("Expected code %d, got %d\n", http.StatusPartialContent, rec.Code)
+	}
+
+	if rec.Body.String() != "gzip" {
+		t.Fatalf("Expected the range of the compressed file, got '%s'\n", rec.Body.String())
+	}
+
+	expectedStr := fmt.Sprintf("bytes 0-3/%d", len(files["app.js.gz"]))
+	if cr := rec.Header().Get("Content-Range"); cr != expectedStr {
+		t.Fatalf("Expected Content-Range '%s', got '%s'\n", expectedStr, cr)
+	}
+
+	// Wrapped by the Gzip middleware, the precompressed file isn't
+	// compressed again
+	h = Gzip{}.Handler(h, c)
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/app.js", nil)
+	r.RequestURI = "/app.js"
+	r.Header.Set("Accept-Encoding", "br")
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Body.String() != files["app.js.br"] || rec.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("Expected the precompressed file, got '%s'\n", rec.Body.String())
+	}
+
+	if vary := rec.Header()["Vary"]; len(vary) != 1 {
+		t.Fatalf("Expected a single Vary header, got %v\n", vary)
+	}
+
+	// Embedded files
+	modTime := time.Now()
+	for name, content := range map[string]string{
+		"/webfw-embedded/lib.js":    "embedded",
+		"/webfw-embedded/lib.js.gz": "embedded gzip",
+	} {
+		fs.DefaultFS.Add(fs.NewFileListing(name, int64(len(content)), 0644, modTime, []byte(content)))
+	}
+
+	h = Static{Path: "/webfw-embedded"}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}), c)
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/lib.js", nil)
+	r.RequestURI = "/lib.js"
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Body.String() != "embedded gzip" || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected the embedded gzip file, got '%s'\n", rec.Body.String())
+	}
+}
+
+func TestStaticHandlerContentETag(t *testing.T) {
+	c := context.NewContext()
+
+	h := Static{Path: "testdata", ContentETag: true}.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}), c)
+
+	content, _ := ioutil.ReadFile(path.Join("testdata", "en.all.json"))
+	hash := sha256.Sum256(content)
+	expected := `"` + base64.RawURLEncoding.EncodeToString(hash[:]) + `"`
+
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("GET", "http://localhost:8080/en.all.json", nil)
+		r.RequestURI = "/en.all.json"
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, r)
+
+		if etag := rec.Header().Get("ETag"); etag != expected {
+			t.Fatalf("Expected ETag '%s', got '%s'\n", expected, etag)
+		}
+
+		if !bytes.Equal(rec.Body.Bytes(), content) {
+			t.Fatalf("Expected the file contents after hashing, got '%s'\n", rec.Body.Bytes())
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/en.all.json", nil)
+	r.RequestURI = "/en.all.json"
+	r.Header.Set("If-None-Match", expected)
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("Expected code %d, got %d\n", http.StatusNotModified, rec.Code)
+	}
+}
@@ -0,0 +1,185 @@
+package webfw
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/urandom/webfw/context"
+)
+
+/*
+The SessionAdminController provides a simple page for managing the sessions
+of users, through a context.SessionManager. It handles the following
+routes, relative to its pattern:
+ - GET /:user - lists the sessions of the user
+ - POST /:user - revokes all sessions of the user
+ - GET /:user/:name - shows the metadata of a single session
+ - POST /:user/:name - revokes a single session
+
+If the request accepts "application/json", the session metadata is written
+as JSON, instead of an HTML page. Since the controller exposes the sessions
+of every user, the Authorize function has to allow each request. If it is
+nil, all requests will be forbidden.
+
+The controller requires the CSRF middleware, and its routes must not be
+exempt from it. The revoke forms include the csrf token of the request,
+while other clients have to send it in the csrf header. Revoke requests are
+forbidden if the CSRF middleware isn't in use.
+*/
+type SessionAdminController struct {
+	Manager   context.SessionManager
+	Authorize func(r *http.Request) bool
+
+	pattern string
+}
+
+var sessionAdminTemplate = template.Must(template.New("sessions").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Sessions of {{ .User }}</title></head>
+<body>
+<h1>Sessions of {{ .User }}</h1>
+<table>
+<tr><th>Created</th><th>Last seen</th><th>IP</th><th>User agent</th><th></th></tr>
+{{ range .Sessions }}<tr>
+<td>{{ .Created.Format "2006-01-02 15:04:05" }}</td>
+<td>{{ .LastSeen.Format "2006-01-02 15:04:05" }}</td>
+<td>{{ .IP }}</td>
+<td>{{ .UserAgent }}</td>
+<td><form method="post" action="{{ $.Path }}/{{ .Name }}">{{ $.CSRFField }}<button type="submit">Revoke</button></form></td>
+</tr>
+{{ end }}</table>
+<form method="post" action="{{ .Path }}">{{ .CSRFField }}<button type="submit">Revoke all</button></form>
+</body>
+</html>
+`))
+
+// NewSessionAdminController creates a session administration controller,
+// handling requests under the given pattern.
+func NewSessionAdminController(pattern string, manager context.SessionManager, authorize func(r *http.Request) bool) SessionAdminController {
+	return SessionAdminController{
+		Manager:   manager,
+		Authorize: authorize,
+		pattern:   strings.TrimSuffix(pattern, "/"),
+	}
+}
+
+func (con SessionAdminController) Patterns() []MethodIdentifierTuple {
+	return []MethodIdentifierTuple{
+		MethodIdentifierTuple{con.pattern + "/:user", MethodGet, "list"},
+		MethodIdentifierTuple{con.pattern + "/:user", MethodPost, "revoke-user"},
+		MethodIdentifierTuple{con.pattern + "/:user/:name", MethodGet, "inspect"},
+		MethodIdentifierTuple{con.pattern + "/:user/:name", MethodPost, "revoke"},
+	}
+}
+
+func (con SessionAdminController) Handler(c context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if con.Authorize == nil || !con.Authorize(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		if r.Method == "POST" {
+			if _, ok := c.Get(r, context.BaseCtxKey("csrfToken")); !ok {
+				GetLogger(c).Print("Session administration requires the CSRF middleware")
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+
+		params := GetParams(c, r)
+		user := params["user"]
+
+		switch GetMultiPatternIdentifier(c, r) {
+		case "list":
+			sessions, err := con.Manager.List(user)
+			if err != nil {
+				con.error(w, c, err)
+				return
+			}
+
+			if acceptsJSON(r) {
+				writeJSON(w, sessions)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			err = sessionAdminTemplate.Execute(w, map[string]interface{}{
+				"User":     user,
+				"Sessions": sessions,
+				"Path":     r.URL.Path,
+
+				"CSRFField": csrfField(c, r),
+			})
+
+			if err != nil {
+				GetLogger(c).Print(err)
+			}
+		case "revoke-user":
+			if _, err := con.Manager.RevokeUser(user); err != nil {
+				con.error(w, c, err)
+				return
+			}
+
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		case "inspect":
+			meta, err := con.Manager.Inspect(params["name"])
+			if err == context.ErrNotExist || err == nil && meta.User != user {
+				http.NotFound(w, r)
+				return
+			} else if err != nil {
+				con.error(w, c, err)
+				return
+			}
+
+			writeJSON(w, meta)
+		case "revoke":
+			meta, err := con.Manager.Inspect(params["name"])
+			if err == nil && meta.User == user {
+				err = con.Manager.Revoke(meta.Name)
+			}
+
+			if err != nil && err != context.ErrNotExist {
+				con.error(w, c, err)
+				return
+			}
+
+			http.Redirect(w, r, path.Dir(r.URL.Path), http.StatusSeeOther)
+		}
+	})
+}
+
+func (con SessionAdminController) error(w http.ResponseWriter, c context.Context, err error) {
+	GetLogger(c).Printf("Session administration error: %v\n", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// csrfField returns a hidden form input, holding the csrf token of the
+// request, as set by the CSRF middleware.
+func csrfField(c context.Context, r *http.Request) template.HTML {
+	token, ok := c.Get(r, context.BaseCtxKey("csrfToken"))
+	if !ok {
+		return ""
+	}
+
+	name := "csrf_token"
+	if val, ok := c.GetGlobal(context.BaseCtxKey("csrfFieldName")); ok {
+		name = val.(string)
+	}
+
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+		template.HTMLEscapeString(name), template.HTMLEscapeString(token.(func() string)())))
+}
+
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,130 @@
+package webfw
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urandom/webfw/context"
+)
+
+// sessionAdminCSRF stands in for the CSRF middleware, which sets the csrf
+// token of each request.
+type sessionAdminCSRF struct {
+	enabled *bool
+}
+
+func (mw sessionAdminCSRF) Handler(ph http.Handler, c context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *mw.enabled {
+			c.Set(r, context.BaseCtxKey("csrfToken"), func() string { return "token" })
+		}
+		ph.ServeHTTP(w, r)
+	})
+}
+
+func TestSessionAdminController(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "/admin-sessions/")
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	store := context.NewFileStore(root)
+
+	for _, name := range []string{"admin1", "admin2"} {
+		s := context.NewSession([]byte("test"), nil, root)
+		s.SetName(name)
+		s.(context.UserSession).SetUser("john")
+
+		if err := s.Write(httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	authorized, csrf := false, false
+	d := NewDispatcher("/", Config{})
+	d.RegisterMiddleware(sessionAdminCSRF{&csrf})
+	d.Handle(NewSessionAdminController("/admin/sessions", context.NewSessionManager(store),
+		func(r *http.Request) bool { return authorized }))
+	d.Initialize()
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/admin/sessions/john", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected an unauthorized request to be forbidden, got %d\n", w.Code)
+	}
+
+	authorized = true
+
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+
+	var sessions []context.SessionMetadata
+	if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %v\n", sessions)
+	}
+
+	r, _ = http.NewRequest("POST", "http://localhost:8080/admin/sessions/john/admin1", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected a revoke request without the csrf middleware to be forbidden, got %d\n", w.Code)
+	}
+
+	if _, err := store.Get("admin1"); err != nil {
+		t.Fatalf("Expected the session to be kept, got '%v'\n", err)
+	}
+
+	csrf = true
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/admin/sessions/john", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+
+	if strings.Count(w.Body.String(), `<input type="hidden" name="csrf_token" value="token">`) != 3 {
+		t.Fatalf("Expected a csrf field in each revoke form, got '%s'\n", w.Body.String())
+	}
+
+	if !strings.Contains(w.Body.String(), `action="/admin/sessions/john/admin1"`) {
+		t.Fatalf("Expected a revoke form for 'admin1', got '%s'\n", w.Body.String())
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/admin/sessions/jane/admin1", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected sessions of other users to be hidden, got %d\n", w.Code)
+	}
+
+	r, _ = http.NewRequest("POST", "http://localhost:8080/admin/sessions/john/admin1", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/sessions/john" {
+		t.Fatalf("Expected a redirect to the session list, got %d '%s'\n", w.Code, w.Header().Get("Location"))
+	}
+
+	if _, err := store.Get("admin1"); err != context.ErrNotExist {
+		t.Fatalf("Expected the session to be revoked, got '%v'\n", err)
+	}
+
+	r, _ = http.NewRequest("POST", "http://localhost:8080/admin/sessions/john", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+
+	if _, err := store.Get("admin2"); err != context.ErrNotExist {
+		t.Fatalf("Expected all sessions to be revoked, got '%v'\n", err)
+	}
+}
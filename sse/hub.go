@@ -0,0 +1,145 @@
+package sse
+
+import (
+	"strconv"
+	"sync"
+)
+
+/*
+A Hub broadcasts events to all of its subscribers. Events without an ID are
+given one, in increasing order. The last few events are kept in a history,
+specified by the HistorySize, and are replayed to subscribers, resuming
+from a known event ID.
+
+Each subscriber has a buffer, specified by the BufferSize. If a subscriber
+is too slow to keep up with the published events, and its buffer fills up,
+it is unsubscribed, and its channel is closed. The client will then
+reconnect, and resume from the last event it has received.
+*/
+type Hub struct {
+	HistorySize int
+	BufferSize  int
+
+	mutex       sync.Mutex
+	subscribers map[*Subscriber]struct{}
+	history     []Event
+	lastID      uint64
+	closed      bool
+}
+
+// A Subscriber receives the events published to a Hub through its Events
+// channel. The channel is closed when the subscriber is removed from the
+// hub.
+type Subscriber struct {
+	Events <-chan Event
+
+	events chan Event
+}
+
+// NewHub creates a hub, keeping a history of the given number of events.
+func NewHub(historySize int) *Hub {
+	return &Hub{
+		HistorySize: historySize,
+		BufferSize:  16,
+		subscribers: map[*Subscriber]struct{}{},
+	}
+}
+
+// Subscribe adds a new subscriber. If the lastEventID is found in the
+// history, all subsequent events are queued for the subscriber.
+func (h *Hub) Subscribe(lastEventID string) *Subscriber {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var replay []Event
+	if lastEventID != "" {
+		for i, e := range h.history {
+			if e.ID == lastEventID {
+				replay = h.history[i+1:]
+				break
+			}
+		}
+	}
+
+	events := make(chan Event, h.BufferSize+len(replay))
+	s := &Subscriber{Events: events, events: events}
+
+	for _, e := range replay {
+		events <- e
+	}
+
+	if h.closed {
+		close(events)
+		return s
+	}
+
+	if h.subscribers == nil {
+		h.subscribers = map[*Subscriber]struct{}{}
+	}
+	h.subscribers[s] = struct{}{}
+
+	return s
+}
+
+// Unsubscribe removes the subscriber from the hub.
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.remove(s)
+}
+
+// Publish sends the event to all subscribers, returning it with its
+// assigned ID.
+func (h *Hub) Publish(e Event) Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lastID++
+	if e.ID == "" {
+		e.ID = strconv.FormatUint(h.lastID, 10)
+	}
+
+	if h.HistorySize > 0 {
+		h.history = append(h.history, e)
+		if len(h.history) > h.HistorySize {
+			h.history = append([]Event(nil), h.history[len(h.history)-h.HistorySize:]...)
+		}
+	}
+
+	for s := range h.subscribers {
+		select {
+		case s.events <- e:
+		default:
+			h.remove(s)
+		}
+	}
+
+	return e
+}
+
+// Len returns the number of subscribers.
+func (h *Hub) Len() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return len(h.subscribers)
+}
+
+// Close removes all subscribers, and closes any future ones right away.
+func (h *Hub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for s := range h.subscribers {
+		h.remove(s)
+	}
+	h.closed = true
+}
+
+func (h *Hub) remove(s *Subscriber) {
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
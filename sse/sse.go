@@ -0,0 +1,121 @@
+/*
+Package sse implements the server side of the Server-Sent Events protocol,
+as used by the browser EventSource API.
+
+A Writer streams events to a single client, while a Hub broadcasts the
+published events to all of its subscribers, keeping a short history, so
+that reconnecting clients may resume from the last event they have seen.
+*/
+package sse
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Event is a single message of the event stream. The ID, if not empty,
+// is remembered by the client and sent back as the Last-Event-ID header
+// when reconnecting. The Event is the event type, which defaults to
+// "message" on the client side. The Data may span multiple lines.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// ErrNotFlusher is returned by NewWriter, if the response writer is unable
+// to flush the written events to the client.
+var ErrNotFlusher = errors.New("The ResponseWriter is not a Flusher")
+
+// Writer writes events to a client. It is safe for concurrent use.
+type Writer struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	mutex   sync.Mutex
+}
+
+// NewWriter starts an event stream, sending the response headers to the
+// client.
+func NewWriter(w http.ResponseWriter) (*Writer, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, ErrNotFlusher
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &Writer{w: w, flusher: flusher}, nil
+}
+
+// Send writes the event and flushes it to the client.
+func (sw *Writer) Send(e Event) error {
+	var buf strings.Builder
+
+	if e.ID != "" {
+		buf.WriteString("id: " + sanitize(e.ID) + "\n")
+	}
+
+	if e.Event != "" {
+		buf.WriteString("event: " + sanitize(e.Event) + "\n")
+	}
+
+	// Each of "\r\n", "\r" and "\n" ends a line for the client
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(e.Data)
+	for _, line := range strings.Split(data, "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+
+	return sw.write(buf.String())
+}
+
+// Retry tells the client how long to wait, before reconnecting after the
+// stream has been closed.
+func (sw *Writer) Retry(d time.Duration) error {
+	return sw.write(fmt.Sprintf("retry: %d\n\n", d/time.Millisecond))
+}
+
+// Comment writes a comment, which is ignored by the client. An empty
+// comment may be sent periodically, to keep the connection from being
+// closed by proxies.
+func (sw *Writer) Comment(text string) error {
+	return sw.write(": " + sanitize(text) + "\n\n")
+}
+
+func (sw *Writer) write(s string) error {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if _, err := sw.w.Write([]byte(s)); err != nil {
+		return err
+	}
+
+	sw.flusher.Flush()
+
+	return nil
+}
+
+// LastEventID returns the ID of the last event, received by a reconnecting
+// client, or the empty string. Since the EventSource API doesn't allow
+// setting custom headers, the "lastEventId" query parameter is also
+// checked, for clients that wish to resume a stream on their own.
+func LastEventID(r *http.Request) string {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+
+	return r.URL.Query().Get("lastEventId")
+}
+
+// sanitize removes any line breaks, which would otherwise end the field.
+func sanitize(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
@@ -0,0 +1,110 @@
+package sse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func TestWriter(t *testing.T) {
+	if _, err := NewWriter(plainWriter{httptest.NewRecorder()}); err != ErrNotFlusher {
+		t.Fatalf("Expected ErrNotFlusher, got %v\n", err)
+	}
+
+	rec := httptest.NewRecorder()
+	sw, err := NewWriter(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream content type, got '%s'\n", ct)
+	}
+
+	sw.Retry(3 * time.Second)
+	sw.Send(Event{ID: "1", Event: "update", Data: "first\nsecond"})
+	sw.Send(Event{Data: "plain"})
+	sw.Send(Event{Data: "x\rid: 9\r\nevent: admin"})
+	sw.Comment("ping\n")
+
+	expected := "retry: 3000\n\n" +
+		"id: 1\nevent: update\ndata: first\ndata: second\n\n" +
+		"data: plain\n\n" +
+		"data: x\ndata: id: 9\ndata: event: admin\n\n" +
+		": ping\n\n"
+
+	if rec.Body.String() != expected {
+		t.Fatalf("Expected '%q', got '%q'\n", expected, rec.Body.String())
+	}
+
+	if !rec.Flushed {
+		t.Fatalf("Expected the events to be flushed\n")
+	}
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/events?lastEventId=4", nil)
+	if id := LastEventID(r); id != "4" {
+		t.Fatalf("Expected last event id '4', got '%s'\n", id)
+	}
+
+	r.Header.Set("Last-Event-ID", "5")
+	if id := LastEventID(r); id != "5" {
+		t.Fatalf("Expected last event id '5', got '%s'\n", id)
+	}
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub(2)
+	h.BufferSize = 2
+
+	s1 := h.Subscribe("")
+
+	for _, data := range []string{"a", "b", "c"} {
+		h.Publish(Event{Data: data})
+	}
+
+	// The third event didn't fit the buffer
+	for _, expected := range []string{"1", "2"} {
+		if e := <-s1.Events; e.ID != expected {
+			t.Fatalf("Expected event '%s', got '%s'\n", expected, e.ID)
+		}
+	}
+
+	if _, ok := <-s1.Events; ok {
+		t.Fatalf("Expected the slow subscriber to be removed\n")
+	}
+
+	s2 := h.Subscribe("2")
+	if e := <-s2.Events; e.ID != "3" || e.Data != "c" {
+		t.Fatalf("Expected the missed event to be replayed, got %+v\n", e)
+	}
+
+	s3 := h.Subscribe("1")
+	if h.Len() != 2 {
+		t.Fatalf("Expected 2 subscribers, got %d\n", h.Len())
+	}
+
+	h.Publish(Event{ID: "custom"})
+	if e := <-s3.Events; e.ID != "custom" {
+		t.Fatalf("Expected an event with the custom id, got %+v\n", e)
+	}
+
+	h.Unsubscribe(s3)
+	h.Close()
+
+	if _, ok := <-s2.Events; !ok {
+		t.Fatalf("Expected the pending event to be received\n")
+	}
+
+	if _, ok := <-s2.Events; ok {
+		t.Fatalf("Expected the subscriber to be closed\n")
+	}
+
+	if _, ok := <-h.Subscribe("").Events; ok {
+		t.Fatalf("Expected subscriptions to a closed hub to be closed\n")
+	}
+}
@@ -0,0 +1,78 @@
+package webfw
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/renderer"
+	"github.com/urandom/webfw/static"
+)
+
+/*
+The StaticController serves the files under its prefix using its embedded
+static.FileServer. Unlike the Static middleware, which only looks for a file
+once the whole chain has responded with "404 Not Found", the controller is
+matched like any other route, and may serve files from multiple roots,
+hide dotfiles, override MIME types and caching per extension, and fall back
+to a single file for single-page applications. For example:
+
+	assets := webfw.NewStaticController("/assets", "static", "vendor/static")
+	assets.HideDotfiles = true
+	assets.CacheControl = map[string]string{".js": "public, max-age=86400"}
+	dispatcher.Handle(assets)
+
+Files that aren't found result in a "404 Not Found" response, rendered
+using the "404.tmpl" template, as with unmatched routes. If ListTemplate is
+set, and FileList is enabled, directory listings are rendered using that
+template, with the static.Listing under the "listing" key.
+*/
+type StaticController struct {
+	*static.FileServer
+
+	ListTemplate string
+
+	prefix string
+}
+
+// NewStaticController creates a controller, serving GET and HEAD requests
+// under the prefix from the given roots, in order of precedence.
+func NewStaticController(prefix string, roots ...string) StaticController {
+	return StaticController{
+		FileServer: &static.FileServer{Roots: roots},
+		prefix:     strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+func (con StaticController) Patterns() []MethodIdentifierTuple {
+	method := MethodGet | MethodHead
+	patterns := []MethodIdentifierTuple{
+		{Pattern: con.prefix + "/", Method: method},
+		{Pattern: con.prefix + "/*filepath", Method: method},
+	}
+
+	if con.prefix != "" {
+		patterns = append(patterns, MethodIdentifierTuple{Pattern: con.prefix, Method: method})
+	}
+
+	return patterns
+}
+
+func (con StaticController) Handler(c context.Context) http.Handler {
+	if con.ListTemplate != "" && con.RenderList == nil {
+		con.RenderList = func(w http.ResponseWriter, r *http.Request, l static.Listing) error {
+			return GetRenderCtx(c, r)(w, renderer.RenderData{"listing": l}, con.ListTemplate)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if con.ServePath(w, r, GetParams(c, r)["filepath"]) {
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+		if err := GetRenderCtx(c, r)(w, nil, "404.tmpl"); err != nil {
+			GetLogger(c).Print(err)
+		}
+	})
+}
@@ -0,0 +1,360 @@
+/*
+Package static serves static files, either from disk or from the embedded
+file system of the fs package. It is used by both the Static middleware and
+the StaticController.
+*/
+package static
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urandom/webfw/fs"
+	"github.com/urandom/webfw/util"
+)
+
+/*
+A FileServer serves the files found in its Roots. A root is a directory on
+disk, or in the fs.DefaultFS. When a file exists in more than one root, the
+one from the earliest root is served, thus later roots may act as defaults,
+overlaid by the earlier ones. An empty list of roots serves the current
+working directory.
+
+The following fields may also be set:
+
+ * "Index" is the file that is served for a directory, "index.html" by
+   default. If it doesn't exist, and "FileList" is set, a listing of the
+   directory is shown instead. See Listing for its options. The listing
+   is split into pages of "ListPageSize" entries, and may be rendered by
+   "RenderList" instead of the default template.
+ * "HideDotfiles" hides all files and directories whose name starts with
+   a dot.
+ * "MIMETypes" maps file extensions, such as ".wasm", to the Content-Type
+   of such files, overriding the system defaults.
+ * "CacheControl" maps file extensions to the Cache-Control header of such
+   files. Files with other extensions are cached for "Expires", if it is
+   set.
+ * "Fallback" is the file that is served for any unknown path without a
+   file extension, such as the entry point of a single-page application.
+ * "ContentETag" makes the ETag of a file a hash of its contents, which is
+   cached until the file changes. Otherwise, "ETag" is used to generate it,
+   if set, or else the ETag is made out of the modification time and size.
+
+If a file has precompressed siblings, with the same name and a ".br" or
+".gz" suffix, the one most preferred by the Accept-Encoding header of the
+request is served instead, with the Content-Type of the original file.
+Range requests apply to the served, compressed representation.
+
+A FileServer must not be copied after first use.
+*/
+type FileServer struct {
+	Roots        []string
+	Index        string
+	FileList     bool
+	ListPageSize int
+	RenderList   func(w http.ResponseWriter, r *http.Request, l Listing) error
+	HideDotfiles bool
+	MIMETypes    map[string]string
+	CacheControl map[string]string
+	Expires      time.Duration
+	Fallback     string
+	ContentETag  bool
+	ETag         func(name string, stat os.FileInfo) string
+
+	hashes contentHashes
+}
+
+// ServeHTTP serves the file for the request path.
+func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.ServePath(w, r, r.URL.Path) {
+		http.NotFound(w, r)
+	}
+}
+
+// ServePath serves the named file, redirecting directory requests without a
+// trailing slash. It returns false if the file couldn't be found, in which
+// case nothing is written.
+func (s *FileServer) ServePath(w http.ResponseWriter, r *http.Request, name string) bool {
+	name = path.Clean("/" + name)
+
+	file, stat, root, err := s.Open(name)
+	if err == nil && stat.IsDir() {
+		uri := strings.SplitN(r.RequestURI, "?", 2)[0]
+		if uri == "" {
+			uri = r.URL.Path
+		}
+
+		if !strings.HasSuffix(uri, "/") {
+			file.Close()
+			http.Redirect(w, r, uri+"/", http.StatusFound)
+			return true
+		}
+
+		dir := file
+		index := path.Join(name, s.index())
+
+		file, stat, root, err = s.Open(index)
+		if err == nil && !stat.IsDir() {
+			dir.Close()
+			name = index
+		} else {
+			if err == nil {
+				file.Close()
+			}
+			defer dir.Close()
+
+			if s.FileList {
+				return s.serveList(w, r, name, dir)
+			}
+
+			err = os.ErrNotExist
+		}
+	}
+
+	if err != nil {
+		if s.Fallback == "" || path.Ext(name) != "" {
+			return false
+		}
+
+		name = path.Clean("/" + s.Fallback)
+		if file, stat, root, err = s.Open(name); err != nil {
+			return false
+		}
+
+		if stat.IsDir() {
+			file.Close()
+			return false
+		}
+	}
+	defer file.Close()
+
+	s.ServeFile(w, r, root, name, file, stat)
+
+	return true
+}
+
+// Open opens the named file from the first root that contains it, and
+// returns it along with its stat and the root.
+func (s *FileServer) Open(name string) (http.File, os.FileInfo, string, error) {
+	name = path.Clean("/" + name)
+	if s.HideDotfiles && hasDotfile(name) {
+		return nil, nil, "", os.ErrNotExist
+	}
+
+	roots := s.Roots
+	if len(roots) == 0 {
+		roots = []string{""}
+	}
+
+	for _, root := range roots {
+		file, err := fs.DefaultFS.OpenRoot(root, name)
+		if err != nil {
+			continue
+		}
+
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			continue
+		}
+
+		return file, stat, root, nil
+	}
+
+	return nil, nil, "", os.ErrNotExist
+}
+
+// ServeFile serves the regular file, opened from the root under the given
+// name, setting its Content-Type, ETag and caching headers. A Cache-Control
+// header, set before the call, is kept.
+func (s *FileServer) ServeFile(w http.ResponseWriter, r *http.Request, root, name string, file http.File, stat os.FileInfo) {
+	h := w.Header()
+	ext := strings.ToLower(path.Ext(name))
+
+	if ctype, ok := s.MIMETypes[ext]; ok && h.Get("Content-Type") == "" {
+		h.Set("Content-Type", ctype)
+	}
+
+	if variants := openPrecompressed(root, name); len(variants) > 0 {
+		util.AddVary(h, "Accept-Encoding")
+
+		if v, ok := negotiateVariant(r, variants); ok {
+			if h.Get("Content-Type") == "" {
+				h.Set("Content-Type", detectContentType(name, file))
+			}
+			h.Set("Content-Encoding", v.encoding)
+
+			file, stat, name = v.file, v.stat, name+v.ext
+		}
+
+		for _, v := range variants {
+			defer v.file.Close()
+		}
+	}
+
+	var etag string
+	if s.ETag != nil {
+		etag = s.ETag(name, stat)
+	} else {
+		etag = `"` + strconv.FormatInt(stat.ModTime().UnixNano(), 36) + "-" +
+			strconv.FormatInt(stat.Size(), 36) + `"`
+	}
+
+	if s.ContentETag {
+		if e, err := s.hashes.get(name, stat, file); err == nil {
+			etag = e
+		}
+	}
+
+	h.Set("ETag", etag)
+
+	if h.Get("Cache-Control") == "" {
+		if cc, ok := s.CacheControl[ext]; ok {
+			h.Set("Cache-Control", cc)
+		} else if s.Expires != 0 {
+			h.Set("Cache-Control", fmt.Sprintf("max-age=%.0f", s.Expires.Seconds()))
+			h.Set("Expires", time.Now().Add(s.Expires).Format(http.TimeFormat))
+		}
+	}
+
+	http.ServeContent(w, r, name, stat.ModTime(), file)
+}
+
+func (s *FileServer) index() string {
+	if s.Index == "" {
+		return "index.html"
+	}
+
+	return s.Index
+}
+
+func hasDotfile(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+type contentHash struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// contentHashes caches the content based ETags of static files.
+type contentHashes struct {
+	sync.Mutex
+	hashes map[string]contentHash
+}
+
+// get returns the content based ETag of the file, hashing it if it has
+// changed since the last call. The file is rewound afterwards.
+func (ch *contentHashes) get(name string, stat os.FileInfo, file http.File) (string, error) {
+	ch.Lock()
+	cached, ok := ch.hashes[name]
+	ch.Unlock()
+
+	if ok && cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size() {
+		return cached.etag, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	etag := `"` + base64.RawURLEncoding.EncodeToString(hash.Sum(nil)) + `"`
+
+	ch.Lock()
+	if ch.hashes == nil {
+		ch.hashes = map[string]contentHash{}
+	}
+	ch.hashes[name] = contentHash{modTime: stat.ModTime(), size: stat.Size(), etag: etag}
+	ch.Unlock()
+
+	return etag, nil
+}
+
+// precompressedExtensions maps the supported encodings of precompressed
+// files to their filename suffix, in order of preference.
+var precompressedExtensions = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+type precompressedVariant struct {
+	encoding string
+	ext      string
+	file     http.File
+	stat     os.FileInfo
+}
+
+// openPrecompressed opens all existing precompressed variants of the file.
+func openPrecompressed(root, name string) []precompressedVariant {
+	var variants []precompressedVariant
+
+	for _, p := range precompressedExtensions {
+		file, err := fs.DefaultFS.OpenRoot(root, name+p.ext)
+		if err != nil {
+			continue
+		}
+
+		stat, err := file.Stat()
+		if err != nil || stat.IsDir() {
+			file.Close()
+			continue
+		}
+
+		variants = append(variants, precompressedVariant{
+			encoding: p.encoding, ext: p.ext, file: file, stat: stat,
+		})
+	}
+
+	return variants
+}
+
+func negotiateVariant(r *http.Request, variants []precompressedVariant) (precompressedVariant, bool) {
+	encodings := make([]string, len(variants))
+	for i, v := range variants {
+		encodings[i] = v.encoding
+	}
+
+	encoding := util.NegotiateEncoding(r.Header.Get("Accept-Encoding"), encodings)
+	for _, v := range variants {
+		if v.encoding == encoding {
+			return v, true
+		}
+	}
+
+	return precompressedVariant{}, false
+}
+
+// detectContentType returns the content type of the uncompressed file,
+// based on its extension, or its contents.
+func detectContentType(name string, file http.File) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+
+	var buf [512]byte
+	n, _ := io.ReadFull(file, buf[:])
+
+	return http.DetectContentType(buf[:n])
+}
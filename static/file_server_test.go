@@ -0,0 +1,135 @@
+package static
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func tempRoots(t *testing.T, roots ...map[string]string) []string {
+	var dirs []string
+
+	for _, files := range roots {
+		dir, err := ioutil.TempDir("", "webfw-static")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, content := range files {
+			name = path.Join(dir, name)
+			os.MkdirAll(path.Dir(name), 0755)
+
+			if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dirs = append(dirs, dir)
+	}
+
+	return dirs
+}
+
+func get(s *FileServer, uri string, header http.Header) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "http://localhost:8080"+uri, nil)
+	r.RequestURI = uri
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+
+	s.ServeHTTP(rec, r)
+
+	return rec
+}
+
+func TestFileServer(t *testing.T) {
+	roots := tempRoots(t, map[string]string{
+		"app.js":      "overlay app",
+		"module.wasm": "wasm",
+		".env":        "secret",
+		"docs/a.txt":  "a",
+		"docs/.b.txt": "b",
+	}, map[string]string{
+		"app.js":        "default app",
+		"lib.js":        "default lib",
+		"lib.js.gz":     "gzip lib",
+		"index.html":    "<html>spa</html>",
+		"sub/page.html": "page",
+	})
+	for _, root := range roots {
+		defer os.RemoveAll(root)
+	}
+
+	s := &FileServer{
+		Roots:        roots,
+		HideDotfiles: true,
+		FileList:     true,
+		MIMETypes:    map[string]string{".wasm": "application/x-custom-wasm"},
+		CacheControl: map[string]string{".js": "public, max-age=60"},
+		Fallback:     "index.html",
+	}
+
+	for _, test := range []struct {
+		uri, body string
+		code      int
+	}{
+		{"/app.js", "overlay app", http.StatusOK},
+		{"/lib.js", "default lib", http.StatusOK},
+		{"/sub/page.html", "page", http.StatusOK},
+		{"/", "<html>spa</html>", http.StatusOK},
+		{"/.env", "404 page not found\n", http.StatusNotFound},
+		{"/missing.css", "404 page not found\n", http.StatusNotFound},
+		{"/some/client/route", "<html>spa</html>", http.StatusOK},
+		{"/.env/route", "<html>spa</html>", http.StatusOK},
+	} {
+		rec := get(s, test.uri, nil)
+
+		if rec.Code != test.code || rec.Body.String() != test.body {
+			t.Fatalf("Expected %d '%s' for '%s', got %d '%s'\n", test.code, test.body, test.uri, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := get(s, "/module.wasm", nil)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-custom-wasm" {
+		t.Fatalf("Expected the overridden MIME type, got '%s'\n", ct)
+	}
+
+	if cc := rec.Header().Get("Cache-Control"); cc != "" {
+		t.Fatalf("Expected no Cache-Control header, got '%s'\n", cc)
+	}
+
+	rec = get(s, "/lib.js", http.Header{"Accept-Encoding": {"gzip"}})
+	if rec.Body.String() != "gzip lib" || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected the precompressed file, got '%s'\n", rec.Body.String())
+	}
+
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Fatalf("Expected the Cache-Control override, got '%s'\n", cc)
+	}
+
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/javascript") &&
+		!strings.HasPrefix(rec.Header().Get("Content-Type"), "application/javascript") {
+		t.Fatalf("Expected the javascript content type, got '%s'\n", rec.Header().Get("Content-Type"))
+	}
+
+	rec = get(s, "/docs", nil)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/docs/" {
+		t.Fatalf("Expected a redirect to the directory, got %d %v\n", rec.Code, rec.Header())
+	}
+
+	rec = get(s, "/docs/", nil)
+	if !strings.Contains(rec.Body.String(), `<a href="a.txt">a.txt</a>`) || strings.Contains(rec.Body.String(), ".b.txt") {
+		t.Fatalf("Expected a listing without dotfiles, got '%s'\n", rec.Body.String())
+	}
+
+	etag := get(s, "/app.js", nil).Header().Get("ETag")
+	rec = get(s, "/app.js", http.Header{"If-None-Match": {etag}})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("Expected code %d for a matching ETag, got %d\n", http.StatusNotModified, rec.Code)
+	}
+}
@@ -0,0 +1,340 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urandom/webfw/util"
+)
+
+const dateFormat = "Jan 2, 2006 at 3:04pm (MST)"
+
+// DefaultListPageSize is the number of entries on a page of a directory
+// listing, if the FileServer doesn't specify its own.
+const DefaultListPageSize = 1000
+
+var listTmpl *template.Template
+
+// FileStats sorts file stats by name.
+type FileStats []os.FileInfo
+
+func (fs FileStats) Len() int           { return len(fs) }
+func (fs FileStats) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
+func (fs FileStats) Less(i, j int) bool { return fs[i].Name() < fs[j].Name() }
+
+/*
+A Listing is a page of a directory listing, passed to the list template.
+Its entries are sorted by the "sort" query parameter - "name", "size" or
+"date" - in the direction of the "order" one - "asc" or "desc" - with the
+directories always listed first. The "page" query parameter selects the
+page. When the request's Accept header contains "application/json", the
+listing is sent as a JSON object instead.
+*/
+type Listing struct {
+	Path        string       `json:"path"`
+	Name        string       `json:"name"`
+	Breadcrumbs []Breadcrumb `json:"breadcrumbs"`
+	Entries     []Entry      `json:"entries"`
+	Sort        string       `json:"sort"`
+	Order       string       `json:"order"`
+	Page        int          `json:"page"`
+	Pages       int          `json:"pages"`
+	Total       int          `json:"total"`
+}
+
+// An Entry is a file or directory in a Listing. Its URL is relative to the
+// listed directory.
+type Entry struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	IsDir   bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// A Breadcrumb links to the listed directory, or one of its parents.
+type Breadcrumb struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+func init() {
+	listTmpl = template.Must(template.New("filelist").Funcs(template.FuncMap{
+		"formatdate": func(t time.Time) string {
+			return t.Format(dateFormat)
+		},
+		"humanSize": HumanSize,
+		"inc":       func(i int) int { return i + 1 },
+		"dec":       func(i int) int { return i - 1 },
+	}).Parse(fileListTemplate))
+}
+
+// HumanSize formats the size in bytes using binary units, such as "1.5 KiB".
+// It is also available as the "humanSize" function of the list template.
+func HumanSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value, unit := float64(size), 0
+	for value >= 1024 && unit < 6 {
+		value /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[unit-1])
+}
+
+// PageURL returns the relative url of the given page of the listing.
+func (l Listing) PageURL(page int) string {
+	return l.query(l.Sort, l.Order, page)
+}
+
+// SortURL returns the relative url of the listing, sorted by the given
+// column. If it is already sorted by it, the order is reversed.
+func (l Listing) SortURL(column string) string {
+	order := "asc"
+	if l.Sort == column && l.Order == "asc" {
+		order = "desc"
+	}
+
+	return l.query(column, order, 1)
+}
+
+func (l Listing) query(column, order string, page int) string {
+	v := url.Values{}
+	v.Set("sort", column)
+	v.Set("order", order)
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+
+	return "?" + v.Encode()
+}
+
+// serveList writes the listing of the directory. It returns false if the
+// directory couldn't be read.
+func (s *FileServer) serveList(w http.ResponseWriter, r *http.Request, name string, dir http.File) bool {
+	stats, err := dir.Readdir(-1)
+	if err != nil {
+		return false
+	}
+
+	l := s.listing(r, name, stats)
+
+	// The representation depends on the Accept header
+	util.AddVary(w.Header(), "Accept")
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		b, err := json.Marshal(l)
+		if err != nil {
+			return false
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+
+		return true
+	}
+
+	if s.RenderList != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		return s.RenderList(w, r, l) == nil
+	}
+
+	buf := util.BufferPool.GetBuffer()
+	defer util.BufferPool.Put(buf)
+
+	if err := listTmpl.Execute(buf, l); err != nil {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+
+	return true
+}
+
+func (s *FileServer) listing(r *http.Request, name string, stats []os.FileInfo) Listing {
+	query := r.URL.Query()
+
+	l := Listing{
+		Path:  name,
+		Name:  path.Base(name),
+		Sort:  query.Get("sort"),
+		Order: query.Get("order"),
+	}
+
+	switch l.Sort {
+	case "name", "size", "date":
+	default:
+		l.Sort = "name"
+	}
+
+	if l.Order != "desc" {
+		l.Order = "asc"
+	}
+
+	entries := make([]Entry, 0, len(stats))
+	for _, stat := range stats {
+		if s.HideDotfiles && strings.HasPrefix(stat.Name(), ".") {
+			continue
+		}
+
+		e := Entry{
+			Name:    stat.Name(),
+			URL:     (&url.URL{Path: stat.Name()}).String(),
+			IsDir:   stat.IsDir(),
+			Size:    stat.Size(),
+			ModTime: stat.ModTime(),
+		}
+		if e.IsDir {
+			e.URL += "/"
+		}
+
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+
+		if l.Order == "desc" {
+			a, b = b, a
+		}
+
+		switch l.Sort {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "date":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+
+		return a.Name < b.Name
+	})
+
+	pageSize := s.ListPageSize
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+
+	l.Total = len(entries)
+	l.Pages = (l.Total + pageSize - 1) / pageSize
+	if l.Pages == 0 {
+		l.Pages = 1
+	}
+
+	l.Page, _ = strconv.Atoi(query.Get("page"))
+	if l.Page < 1 {
+		l.Page = 1
+	} else if l.Page > l.Pages {
+		l.Page = l.Pages
+	}
+
+	start := (l.Page - 1) * pageSize
+	end := start + pageSize
+	if end > l.Total {
+		end = l.Total
+	}
+	l.Entries = entries[start:end]
+
+	l.Breadcrumbs = breadcrumbs(r, name)
+
+	return l
+}
+
+// breadcrumbs links to each directory from the root of the file server to
+// the listed one, based on the request path.
+func breadcrumbs(r *http.Request, name string) []Breadcrumb {
+	uri := r.URL.Path
+	if !strings.HasSuffix(uri, "/") {
+		uri += "/"
+	}
+
+	rel := strings.TrimPrefix(name, "/")
+	if rel != "" {
+		rel += "/"
+	}
+
+	base := "/"
+	if strings.HasSuffix(uri, "/"+rel) {
+		base = uri[:len(uri)-len(rel)]
+	}
+
+	crumbs := []Breadcrumb{{Name: "/", URL: base}}
+	if rel == "" {
+		return crumbs
+	}
+
+	current := base
+	for _, part := range strings.Split(strings.TrimSuffix(rel, "/"), "/") {
+		current += part + "/"
+		crumbs = append(crumbs, Breadcrumb{Name: part, URL: current})
+	}
+
+	return crumbs
+}
+
+const fileListTemplate = `
+<!doctype html>
+<html>
+	<head>
+		<title>{{ .Name }}</title>
+	</head>
+	<body>
+		<nav>
+			{{ range $i, $crumb := .Breadcrumbs }}{{ if $i }} / {{ end }}<a href="{{ $crumb.URL }}">{{ $crumb.Name }}</a>{{ end }}
+		</nav>
+		<table>
+			<thead>
+				<tr>
+					<th><a href="{{ .SortURL "name" }}">Name</a></th>
+					<th><a href="{{ .SortURL "date" }}">Modified</a></th>
+					<th><a href="{{ .SortURL "size" }}">Size</a></th>
+				</tr>
+			</thead>
+			<tbody>
+				<tr>
+					<td><a href="../">../</a></td>
+					<td colspan="2"></td>
+				</tr>
+				{{ range .Entries }}
+					<tr>
+						<td>
+							<a href="{{ .URL }}">{{ .Name }}{{ if .IsDir }}/{{ end }}</a>
+						</td>
+						<td>
+							{{ .ModTime | formatdate }}
+						</td>
+						<td>
+							{{ if not .IsDir }}{{ .Size | humanSize }}{{ end }}
+						</td>
+					</tr>
+				{{ end }}
+			</tbody>
+		</table>
+		{{ if gt .Pages 1 }}
+			<nav>
+				{{ if gt .Page 1 }}<a href="{{ .PageURL (dec .Page) }}">Previous</a>{{ end }}
+				Page {{ .Page }} of {{ .Pages }}
+				{{ if lt .Page .Pages }}<a href="{{ .PageURL (inc .Page) }}">Next</a>{{ end }}
+			</nav>
+		{{ end }}
+	</body>
+</html>
+`
@@ -0,0 +1,144 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHumanSize(t *testing.T) {
+	for size, expected := range map[int64]string{
+		0:                   "0 B",
+		1023:                "1023 B",
+		1024:                "1.0 KiB",
+		1536:                "1.5 KiB",
+		5 * 1024 * 1024:     "5.0 MiB",
+		3 << 30:             "3.0 GiB",
+		1<<40 + 1<<39:       "1.5 TiB",
+		9223372036854775807: "8.0 EiB",
+	} {
+		if s := HumanSize(size); s != expected {
+			t.Fatalf("Expected '%s' for %d, got '%s'\n", expected, size, s)
+		}
+	}
+}
+
+func TestFileServerList(t *testing.T) {
+	files := map[string]string{
+		"b.txt":        strings.Repeat("b", 2048),
+		"a.txt":        "aaa",
+		"c.txt":        "c",
+		"sub/deep.txt": "deep",
+		".hidden":      "hidden",
+	}
+	roots := tempRoots(t, files)
+	defer os.RemoveAll(roots[0])
+
+	now := time.Now()
+	for i, name := range []string{"c.txt", "a.txt", "b.txt"} {
+		modTime := now.Add(time.Duration(i) * time.Hour)
+		os.Chtimes(path.Join(roots[0], name), modTime, modTime)
+	}
+
+	s := &FileServer{Roots: roots, FileList: true, HideDotfiles: true}
+
+	list := func(query string) Listing {
+		rec := get(s, "/"+query, http.Header{"Accept": {"application/json"}})
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Expected a JSON listing, got '%s'\n", ct)
+		}
+
+		if v := rec.Header().Get("Vary"); v != "Accept" {
+			t.Fatalf("Expected the listing to vary by Accept, got '%s'\n", v)
+		}
+
+		var l Listing
+		if err := json.Unmarshal(rec.Body.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+
+		return l
+	}
+
+	names := func(l Listing) string {
+		var n []string
+		for _, e := range l.Entries {
+			n = append(n, e.Name)
+		}
+		return strings.Join(n, ",")
+	}
+
+	for query, expected := range map[string]string{
+		"":                        "sub,a.txt,b.txt,c.txt",
+		"?sort=name&order=desc":   "sub,c.txt,b.txt,a.txt",
+		"?sort=size":              "sub,c.txt,a.txt,b.txt",
+		"?sort=size&order=desc":   "sub,b.txt,a.txt,c.txt",
+		"?sort=date":              "sub,c.txt,a.txt,b.txt",
+		"?sort=invalid&order=bad": "sub,a.txt,b.txt,c.txt",
+	} {
+		if n := names(list(query)); n != expected {
+			t.Fatalf("Expected '%s' for '%s', got '%s'\n", expected, query, n)
+		}
+	}
+
+	l := list("")
+	if l.Total != 4 || l.Pages != 1 || l.Page != 1 || l.Entries[0].URL != "sub/" || !l.Entries[0].IsDir {
+		t.Fatalf("Unexpected listing %+v\n", l)
+	}
+
+	s.ListPageSize = 3
+	if l = list("?page=2"); names(l) != "c.txt" || l.Pages != 2 || l.Total != 4 {
+		t.Fatalf("Expected the second page, got %+v\n", l)
+	}
+
+	if l = list("?page=10"); l.Page != 2 {
+		t.Fatalf("Expected the last page, got %d\n", l.Page)
+	}
+
+	rec := get(s, "/", nil)
+	if v := rec.Header().Get("Vary"); v != "Accept" {
+		t.Fatalf("Expected the listing to vary by Accept, got '%s'\n", v)
+	}
+
+	for _, expected := range []string{
+		`<a href="sub/">sub/</a>`,
+		`2.0 KiB`,
+		`<a href="?order=desc&amp;sort=name">Name</a>`,
+		`<a href="?order=asc&amp;page=2&amp;sort=name">Next</a>`,
+	} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Fatalf("Expected '%s' in '%s'\n", expected, rec.Body.String())
+		}
+	}
+
+	if strings.Contains(rec.Body.String(), ".hidden") {
+		t.Fatalf("Expected the dotfiles to be hidden\n")
+	}
+
+	s.RenderList = func(w http.ResponseWriter, r *http.Request, l Listing) error {
+		var crumbs []string
+		for _, c := range l.Breadcrumbs {
+			crumbs = append(crumbs, c.Name+"="+c.URL)
+		}
+
+		_, err := fmt.Fprintf(w, "custom %s %s", l.Name, strings.Join(crumbs, " "))
+		return err
+	}
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/files/sub/", nil)
+	r.RequestURI = "/files/sub/"
+	rec = get(s, "/sub/", nil)
+	rec.Body.Reset()
+	if !s.ServePath(rec, r, "/sub") {
+		t.Fatalf("Expected the listing to be served\n")
+	}
+
+	if expected := "custom sub /=/files/ sub=/files/sub/"; rec.Body.String() != expected {
+		t.Fatalf("Expected '%s', got '%s'\n", expected, rec.Body.String())
+	}
+}
@@ -0,0 +1,52 @@
+package webfw
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStaticController(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webfw-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(path.Join(dir, "css"), 0755)
+	ioutil.WriteFile(path.Join(dir, "css", "site.css"), []byte("body {}"), 0644)
+	ioutil.WriteFile(path.Join(dir, "index.html"), []byte("index"), 0644)
+
+	d := NewDispatcher("/", Config{})
+	d.Handle(NewStaticController("/assets", dir))
+	d.Initialize()
+
+	for _, test := range []struct {
+		method, uri, body string
+		code              int
+	}{
+		{"GET", "/assets/css/site.css", "body {}", http.StatusOK},
+		{"HEAD", "/assets/css/site.css", "", http.StatusOK},
+		{"GET", "/assets/", "index", http.StatusOK},
+		{"GET", "/assets", "", http.StatusFound},
+		{"GET", "/assets/missing.css", "", http.StatusNotFound},
+		{"POST", "/assets/css/site.css", "", http.StatusNotFound},
+	} {
+		r, _ := http.NewRequest(test.method, "http://localhost:8080"+test.uri, nil)
+		r.RequestURI = test.uri
+		rec := httptest.NewRecorder()
+
+		d.ServeHTTP(rec, r)
+
+		if rec.Code != test.code {
+			t.Fatalf("Expected code %d for %+v, got %d\n", test.code, test, rec.Code)
+		}
+
+		if test.body != "" && rec.Body.String() != test.body {
+			t.Fatalf("Expected body '%s' for %+v, got '%s'\n", test.body, test, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NegotiateEncoding returns the encoding, out of the given ones in order
+// of preference, that is most preferred by the Accept-Encoding header
+// value. The empty string is returned if none of them are acceptable.
+func NegotiateEncoding(header string, encodings []string) string {
+	if header == "" {
+		return ""
+	}
+
+	qvalues := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		qvalues[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, e := range encodings {
+		q, ok := qvalues[e]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+
+		if ok && q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+
+	return best
+}
+
+// AddVary adds the value to the Vary header, unless it's already present.
+func AddVary(h http.Header, value string) {
+	for _, v := range h["Vary"] {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return
+			}
+		}
+	}
+
+	h.Add("Vary", value)
+}
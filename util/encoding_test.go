@@ -0,0 +1,40 @@
+package util
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	encodings := []string{"br", "gzip", "deflate"}
+
+	for header, expected := range map[string]string{
+		"":                          "",
+		"gzip":                      "gzip",
+		"gzip, deflate, br":         "br",
+		"gzip;q=1.0, br;q=0.5":      "gzip",
+		"deflate, gzip;q=0":         "deflate",
+		"*":                         "br",
+		"*;q=0.5, gzip":             "gzip",
+		"br;q=0, *":                 "gzip",
+		"identity":                  "",
+		"GZIP;q=0.8, Deflate;q=0.9": "deflate",
+		"x-gzip":                    "gzip",
+	} {
+		if e := NegotiateEncoding(header, encodings); e != expected {
+			t.Fatalf("Expected '%s' for '%s', got '%s'\n", expected, header, e)
+		}
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	h := http.Header{}
+
+	AddVary(h, "Accept-Encoding")
+	AddVary(h, "accept-encoding")
+	AddVary(h, "Accept-Language")
+
+	if v := h["Vary"]; len(v) != 2 || v[0] != "Accept-Encoding" || v[1] != "Accept-Language" {
+		t.Fatalf("Expected each value once, got %v\n", v)
+	}
+}
@@ -9,6 +9,11 @@ import (
 	"net/http/httptest"
 )
 
+// RecorderHijacker records the whole response in memory, while still
+// allowing the connection to be hijacked.
+//
+// Deprecated: ResponseWriter should be used instead, since it doesn't
+// buffer the response.
 type RecorderHijacker interface {
 	http.ResponseWriter
 	http.Hijacker
@@ -0,0 +1,176 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+/*
+ResponseWriter wraps an http.ResponseWriter, passing the response through
+without buffering it, while keeping track of its status code, the number of
+written body bytes, and whether the headers have already been sent.
+
+Functions registered with the Before method are called just before the
+headers are sent, which is the last chance to modify them, such as when
+setting cookies, or changing the content encoding. They are called in the
+order of their registration.
+
+The optional interfaces of the wrapped writer - http.Flusher, http.Hijacker,
+http.CloseNotifier, http.Pusher and io.ReaderFrom - are all implemented.
+If the wrapped writer doesn't support one of them, Hijack and Push return
+an error, CloseNotify returns a channel that never receives, and Flush and
+ReadFrom still work, without flushing, or through a plain copy,
+respectively.
+*/
+type ResponseWriter interface {
+	http.ResponseWriter
+	http.Flusher
+	http.Hijacker
+	http.CloseNotifier
+	http.Pusher
+	io.ReaderFrom
+
+	// Status returns the response status code. It is http.StatusOK if
+	// the headers haven't been written yet.
+	Status() int
+	// Size returns the number of written body bytes.
+	Size() int64
+	// Written returns true if the headers have already been sent.
+	Written() bool
+	// Before registers a function, called just before the headers are
+	// sent.
+	Before(func(ResponseWriter))
+	// Unwrap returns the wrapped writer.
+	Unwrap() http.ResponseWriter
+}
+
+type responseWriter struct {
+	w       http.ResponseWriter
+	status  int
+	size    int64
+	written bool
+	before  []func(ResponseWriter)
+}
+
+// NewResponseWriter wraps the given writer.
+func NewResponseWriter(w http.ResponseWriter) ResponseWriter {
+	return &responseWriter{w: w, status: http.StatusOK}
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.written {
+		return
+	}
+
+	rw.status = code
+	rw.written = true
+
+	for _, f := range rw.before {
+		f(rw)
+	}
+
+	rw.w.WriteHeader(rw.status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.written {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	n, err := rw.w.Write(b)
+	rw.size += int64(n)
+
+	return n, err
+}
+
+func (rw *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !rw.written {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	var n int64
+	var err error
+
+	if rf, ok := rw.w.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(writerOnly{rw.w}, r)
+	}
+	rw.size += n
+
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	if !rw.written {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Original ResponseWriter is not a Hijacker")
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err == nil {
+		// The connection now belongs to the caller
+		rw.written = true
+	}
+
+	return conn, buf, err
+}
+
+func (rw *responseWriter) CloseNotify() <-chan bool {
+	if cn, ok := rw.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+
+	return make(chan bool)
+}
+
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := rw.w.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+
+	return http.ErrNotSupported
+}
+
+func (rw *responseWriter) Status() int {
+	return rw.status
+}
+
+func (rw *responseWriter) Size() int64 {
+	return rw.size
+}
+
+func (rw *responseWriter) Written() bool {
+	return rw.written
+}
+
+func (rw *responseWriter) Before(f func(ResponseWriter)) {
+	rw.before = append(rw.before, f)
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+// writerOnly hides any io.ReaderFrom implementation of the writer, so that
+// io.Copy doesn't call it recursively.
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := NewResponseWriter(rec)
+
+	if rw.Written() || rw.Status() != http.StatusOK {
+		t.Fatalf("Expected an unwritten response with status 200\n")
+	}
+
+	var order []string
+	rw.Before(func(w ResponseWriter) {
+		order = append(order, "first")
+		w.Header().Set("X-Status", http.StatusText(w.Status()))
+	})
+	rw.Before(func(w ResponseWriter) {
+		order = append(order, "second")
+	})
+
+	rw.WriteHeader(http.StatusCreated)
+	rw.WriteHeader(http.StatusInternalServerError)
+
+	if strings.Join(order, ",") != "first,second" {
+		t.Fatalf("Expected the hooks to be called once, in order, got %v\n", order)
+	}
+
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Status") != "Created" {
+		t.Fatalf("Expected code 201 with the hook header, got %d, %v\n", rec.Code, rec.Header())
+	}
+
+	rw.Write([]byte("foo"))
+	rw.ReadFrom(strings.NewReader("bar"))
+	rw.Flush()
+
+	if rw.Size() != 6 || rec.Body.String() != "foobar" || !rec.Flushed {
+		t.Fatalf("Expected 6 flushed bytes, got %d, '%s'\n", rw.Size(), rec.Body.String())
+	}
+
+	if _, _, err := rw.Hijack(); err == nil {
+		t.Fatalf("Expected an error when hijacking a recorder\n")
+	}
+
+	if err := rw.Push("/foo", nil); err != http.ErrNotSupported {
+		t.Fatalf("Expected ErrNotSupported, got %v\n", err)
+	}
+
+	if rw.Unwrap() != rec {
+		t.Fatalf("Expected the recorder to be unwrapped\n")
+	}
+
+	rec = httptest.NewRecorder()
+	rw = NewResponseWriter(NewResponseWriter(rec))
+	rw.Write([]byte("baz"))
+
+	if !rw.Written() || rw.Status() != http.StatusOK || rec.Body.String() != "baz" {
+		t.Fatalf("Expected an implicit status 200 and body 'baz', got %d, '%s'\n", rw.Status(), rec.Body.String())
+	}
+}
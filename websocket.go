@@ -0,0 +1,44 @@
+package webfw
+
+import (
+	"net/http"
+
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/websocket"
+)
+
+/*
+The WebSocketController upgrades GET requests for its pattern to WebSocket
+connections, using its Upgrader, and passes each connection to the Serve
+function. The upgrade request is passed along as well, thus the session and
+the route params may be obtained using GetSession and GetParams, as in any
+other controller. The connection is closed once Serve returns.
+*/
+type WebSocketController struct {
+	BasePatternController
+
+	Upgrader websocket.Upgrader
+	Serve    func(conn *websocket.Conn, r *http.Request, c context.Context)
+}
+
+// NewWebSocketController creates a WebSocket controller for the given
+// pattern and route name.
+func NewWebSocketController(pattern, name string, serve func(conn *websocket.Conn, r *http.Request, c context.Context)) WebSocketController {
+	return WebSocketController{
+		BasePatternController: NewBasePatternController(pattern, MethodGet, name),
+		Serve:                 serve,
+	}
+}
+
+func (con WebSocketController) Handler(c context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := con.Upgrader.Upgrade(w, r)
+		if err != nil {
+			GetLogger(c).Printf("Websocket upgrade failed: %v\n", err)
+			return
+		}
+		defer conn.Close(websocket.CloseNormalClosure, "")
+
+		con.Serve(conn, r, c)
+	})
+}
@@ -0,0 +1,419 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a data message.
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// Close codes, as defined in RFC 6455, section 7.4.1.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseInternalError    = 1011
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// MaxFrameSize is the maximum payload size of a single received frame,
+// enforced even if the message size is not limited. Larger messages have to
+// be fragmented by the peer.
+const MaxFrameSize = 16 << 20
+
+// The time to wait for the peer to answer a close frame.
+const closeTimeout = 5 * time.Second
+
+var (
+	ErrCloseSent      = errors.New("The websocket close frame has already been sent")
+	ErrMessageTooBig  = errors.New("The websocket message is too big")
+	ErrProtocol       = errors.New("Websocket protocol error")
+	ErrInvalidPayload = errors.New("Invalid websocket text message")
+)
+
+// A CloseError is returned by ReadMessage, when the peer has closed the
+// connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("Websocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+/*
+A Conn is a WebSocket connection. Messages are read using ReadMessage, which
+also answers any pings, and has to be called continuously, so that close
+frames are received. Only one goroutine may read at a time, while the write
+methods may be used concurrently.
+*/
+type Conn struct {
+	conn         net.Conn
+	br           *bufio.Reader
+	maxSize      int64
+	writeTimeout time.Duration
+	protocol     string
+
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+	closeSent  bool
+	closed     bool
+
+	pongHandler func(data []byte)
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, maxSize int64, writeTimeout time.Duration, protocol string) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+
+	return &Conn{
+		conn:         conn,
+		br:           br,
+		maxSize:      maxSize,
+		writeTimeout: writeTimeout,
+		protocol:     protocol,
+	}
+}
+
+// Subprotocol returns the negotiated application protocol.
+func (c *Conn) Subprotocol() string {
+	return c.protocol
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets the deadline for reading the next message.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetPongHandler sets a function, called with the data of each received
+// pong.
+func (c *Conn) SetPongHandler(f func(data []byte)) {
+	c.pongHandler = f
+}
+
+// ReadMessage reads the next data message. If the peer closes the
+// connection, a *CloseError is returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	var msgType MessageType
+	var msg []byte
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil && err != ErrCloseSent {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.pongHandler != nil {
+				c.pongHandler(payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(payload)
+		case opContinuation:
+			if msgType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+		case opText, opBinary:
+			if msgType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+			msgType = MessageType(opcode)
+		default:
+			return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+		}
+
+		if c.maxSize > 0 && int64(len(msg)+len(payload)) > c.maxSize {
+			return 0, nil, c.fail(CloseMessageTooBig, ErrMessageTooBig)
+		}
+		msg = append(msg, payload...)
+
+		if fin {
+			if msgType == TextMessage && !utf8.Valid(msg) {
+				return 0, nil, c.fail(CloseInvalidPayload, ErrInvalidPayload)
+			}
+
+			return msgType, msg, nil
+		}
+	}
+}
+
+// WriteMessage writes a single data message.
+func (c *Conn) WriteMessage(t MessageType, data []byte) error {
+	return c.writeFrame(byte(t), data)
+}
+
+// WriteText is a helper for writing a text message.
+func (c *Conn) WriteText(text string) error {
+	return c.WriteMessage(TextMessage, []byte(text))
+}
+
+// Ping sends a ping, which the peer answers with a pong, carrying the
+// same data.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return ErrMessageTooBig
+	}
+
+	return c.writeFrame(opPing, data)
+}
+
+// Close performs the closing handshake, sending a close frame with the
+// given code and reason, and waiting for the peer to answer it, before
+// closing the connection. If another goroutine is reading, it receives
+// the answer instead.
+func (c *Conn) Close(code int, reason string) error {
+	err := c.writeClose(code, reason)
+	if err == ErrCloseSent {
+		err = nil
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for !c.isClosed() {
+		_, opcode, _, rerr := c.readFrame()
+		if rerr != nil || opcode == opClose {
+			break
+		}
+	}
+
+	c.closeConn()
+
+	return err
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+
+	switch {
+	case len(payload) == 1:
+		c.fail(CloseProtocolError, ErrProtocol)
+		return closeErr
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+
+		if !validCloseCode(closeErr.Code) || !utf8.ValidString(closeErr.Reason) {
+			c.fail(CloseProtocolError, ErrProtocol)
+			return closeErr
+		}
+	}
+
+	code := closeErr.Code
+	if code == CloseNoStatusReceived {
+		code = CloseNormalClosure
+	}
+
+	c.writeClose(code, "")
+	c.closeConn()
+
+	return closeErr
+}
+
+// fail closes the connection with the given code, returning the error.
+func (c *Conn) fail(code int, err error) error {
+	c.writeClose(code, err.Error())
+	c.closeConn()
+
+	return err
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+
+	return c.writeFrame(opClose, payload)
+}
+
+func (c *Conn) writeFrame(opcode byte, data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+
+	switch n := len(data); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// readFrame reads a single frame, unmasking its payload.
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := int64(head[1] & 0x7f)
+
+	// No extensions are negotiated, and clients have to mask their frames
+	if head[0]&0x70 != 0 || !masked {
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+
+	control := opcode&0x8 != 0
+	if control && (!fin || length > 125) {
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(b[:]))
+
+		if length < 0 {
+			return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+		}
+	}
+
+	if length > MaxFrameSize || !control && c.maxSize > 0 && length > c.maxSize {
+		return false, 0, nil, c.fail(CloseMessageTooBig, ErrMessageTooBig)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	// The buffer grows as the payload arrives, instead of trusting the
+	// declared length
+	buf := bytes.NewBuffer(make([]byte, 0, minInt64(length, bytes.MinRead)))
+	if _, err := io.CopyN(buf, c.br, length); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, 0, nil, err
+	}
+	payload := buf.Bytes()
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (c *Conn) closeConn() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		c.conn.Close()
+	}
+}
+
+func (c *Conn) isClosed() bool {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	return c.closed
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,130 @@
+package websocket
+
+import "sync"
+
+// A Room is a group of connections, which receive the messages broadcast
+// to it. It is safe for concurrent use.
+type Room struct {
+	mutex sync.RWMutex
+	conns map[*Conn]struct{}
+}
+
+// NewRoom creates an empty room.
+func NewRoom() *Room {
+	return &Room{conns: map[*Conn]struct{}{}}
+}
+
+// Join adds the connection to the room.
+func (r *Room) Join(c *Conn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.conns[c] = struct{}{}
+}
+
+// Leave removes the connection from the room.
+func (r *Room) Leave(c *Conn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.conns, c)
+}
+
+// Len returns the number of connections in the room.
+func (r *Room) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.conns)
+}
+
+// Broadcast sends the message to all connections in the room, except for
+// the given ones, such as the sender of the message. Connections that fail
+// to receive the message leave the room, and are closed.
+func (r *Room) Broadcast(t MessageType, data []byte, except ...*Conn) {
+	r.mutex.RLock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mutex.RUnlock()
+
+outer:
+	for _, c := range conns {
+		for _, e := range except {
+			if c == e {
+				continue outer
+			}
+		}
+
+		if err := c.WriteMessage(t, data); err != nil {
+			r.Leave(c)
+			c.closeConn()
+		}
+	}
+}
+
+// Rooms holds named rooms, creating them on demand.
+type Rooms struct {
+	mutex sync.Mutex
+	rooms map[string]*Room
+}
+
+// NewRooms creates an empty set of rooms.
+func NewRooms() *Rooms {
+	return &Rooms{rooms: map[string]*Room{}}
+}
+
+// Join adds the connection to the named room, creating the room if it
+// doesn't exist, and returns it.
+func (rs *Rooms) Join(name string, c *Conn) *Room {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	room, ok := rs.rooms[name]
+	if !ok {
+		room = NewRoom()
+		rs.rooms[name] = room
+	}
+	room.Join(c)
+
+	return room
+}
+
+// Leave removes the connection from the named room. Rooms without any
+// connections are removed.
+func (rs *Rooms) Leave(name string, c *Conn) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if room, ok := rs.rooms[name]; ok {
+		room.Leave(c)
+
+		if room.Len() == 0 {
+			delete(rs.rooms, name)
+		}
+	}
+}
+
+// Get returns the named room, if it exists.
+func (rs *Rooms) Get(name string) (*Room, bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	room, ok := rs.rooms[name]
+
+	return room, ok
+}
+
+// Names returns the names of all rooms.
+func (rs *Rooms) Names() []string {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	names := make([]string, 0, len(rs.rooms))
+	for name := range rs.rooms {
+		names = append(names, name)
+	}
+
+	return names
+}
@@ -0,0 +1,192 @@
+/*
+Package websocket implements the server side of the WebSocket protocol, as
+described in RFC 6455.
+
+An Upgrader turns an HTTP request into a WebSocket connection. The
+resulting Conn reads and writes whole messages, transparently answering
+pings, and taking care of the closing handshake. A Room broadcasts messages
+to a group of connections.
+*/
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultMaxMessageSize is the maximum size of a received message, used if
+// the Upgrader doesn't specify one.
+const DefaultMaxMessageSize = 1 << 20
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	ErrBadHandshake = errors.New("Invalid websocket handshake")
+	ErrBadOrigin    = errors.New("Websocket origin not allowed")
+	ErrNotHijacker  = errors.New("The ResponseWriter is not a Hijacker")
+)
+
+/*
+An Upgrader upgrades HTTP requests to WebSocket connections.
+
+The MaxMessageSize limits the size of received messages. Connections
+receiving larger messages are closed with the CloseMessageTooBig code. If
+it is 0, DefaultMaxMessageSize is used, and if it is negative, the size is
+not limited. Regardless of it, a single frame may not be larger than
+MaxFrameSize.
+
+The WriteTimeout, if set, limits the time each message may take to be
+written. The CheckOrigin function decides whether the request is allowed,
+based on its Origin header. If it is nil, only requests without an Origin
+header, or with one matching the request host, are allowed. Finally, the
+Subprotocols are the supported application protocols, in order of
+preference.
+*/
+type Upgrader struct {
+	MaxMessageSize int64
+	WriteTimeout   time.Duration
+	CheckOrigin    func(r *http.Request) bool
+	Subprotocols   []string
+}
+
+// Upgrade performs the opening handshake, and returns the connection. If
+// the request is not a valid WebSocket handshake, an error response is
+// written, and the error is returned.
+func (u Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return nil, ErrBadHandshake
+	}
+
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, http.StatusText(http.StatusUpgradeRequired), http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+
+	if !checkOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, ErrNotHijacker
+	}
+
+	protocol := u.subprotocol(r)
+
+	netConn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+
+	if protocol != "" {
+		response += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	response += "\r\n"
+
+	if u.WriteTimeout > 0 {
+		netConn.SetWriteDeadline(time.Now().Add(u.WriteTimeout))
+	}
+
+	if _, err := netConn.Write([]byte(response)); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetWriteDeadline(time.Time{})
+
+	maxSize := u.MaxMessageSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+
+	return newConn(netConn, brw.Reader, maxSize, u.WriteTimeout, protocol), nil
+}
+
+// SameOrigin returns true if the request has no Origin header, or if its
+// host matches the request host.
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func (u Upgrader) subprotocol(r *http.Request) string {
+	requested := headerValues(r.Header, "Sec-WebSocket-Protocol")
+
+	for _, p := range u.Subprotocols {
+		for _, rp := range requested {
+			if p == rp {
+				return p
+			}
+		}
+	}
+
+	return ""
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerValues(h http.Header, name string) []string {
+	var values []string
+
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+
+	return values
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range headerValues(h, name) {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,333 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dial(t *testing.T, server *httptest.Server, header http.Header) (*testClient, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r, _ := http.NewRequest("GET", server.URL+"/ws", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for k, v := range header {
+		r.Header[k] = v
+	}
+
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testClient{t: t, conn: conn, br: br}, resp
+}
+
+func (tc *testClient) write(fin bool, opcode byte, payload []byte, masked bool) {
+	head := []byte{opcode, 0}
+	if fin {
+		head[0] |= 0x80
+	}
+
+	switch n := len(payload); {
+	case n <= 125:
+		head[1] = byte(n)
+	case n <= 0xffff:
+		head[1] = 126
+		head = append(head, 0, 0)
+		binary.BigEndian.PutUint16(head[2:], uint16(n))
+	default:
+		head[1] = 127
+		head = append(head, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(head[2:], uint64(n))
+	}
+
+	data := append([]byte(nil), payload...)
+	if masked {
+		head[1] |= 0x80
+		mask := []byte{1, 2, 3, 4}
+		head = append(head, mask...)
+
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+
+	if _, err := tc.conn.Write(append(head, data...)); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+func (tc *testClient) read() (byte, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(tc.br, head[:]); err != nil {
+		tc.t.Fatal(err)
+	}
+
+	length := int(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		io.ReadFull(tc.br, b[:])
+		length = int(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(tc.br, b[:])
+		length = int(binary.BigEndian.Uint64(b[:]))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(tc.br, payload); err != nil {
+		tc.t.Fatal(err)
+	}
+
+	return head[0] & 0x0f, payload
+}
+
+func (tc *testClient) expectClose(code int) {
+	opcode, payload := tc.read()
+	if opcode != opClose || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != code {
+		tc.t.Fatalf("Expected a close frame with code %d, got %d %v\n", code, opcode, payload)
+	}
+}
+
+func echoServer(t *testing.T, u Upgrader, errs chan error) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+
+		for {
+			t, msg, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			conn.WriteMessage(t, msg)
+		}
+	}))
+}
+
+func TestUpgrade(t *testing.T) {
+	errs := make(chan error, 1)
+	server := echoServer(t, Upgrader{Subprotocols: []string{"chat"}}, errs)
+	defer server.Close()
+
+	tc, resp := dial(t, server, http.Header{
+		"Origin":                 {server.URL},
+		"Sec-Websocket-Protocol": {"other, chat"},
+	})
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected code 101, got %d\n", resp.StatusCode)
+	}
+
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected the RFC example accept key, got '%s'\n", accept)
+	}
+
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "chat" {
+		t.Fatalf("Expected the chat subprotocol, got '%s'\n", p)
+	}
+
+	tc.conn.Close()
+
+	_, resp = dial(t, server, http.Header{"Origin": {"http://evil.example.com"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected code 403 for a foreign origin, got %d\n", resp.StatusCode)
+	}
+
+	_, resp = dial(t, server, http.Header{"Sec-Websocket-Version": {"8"}})
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("Expected code 426 for an unsupported version, got %d\n", resp.StatusCode)
+	}
+}
+
+func TestConn(t *testing.T) {
+	errs := make(chan error, 1)
+	server := echoServer(t, Upgrader{MaxMessageSize: 1000}, errs)
+	defer server.Close()
+
+	tc, _ := dial(t, server, nil)
+
+	tc.write(true, opText, []byte("hello"), true)
+	if opcode, payload := tc.read(); opcode != opText || string(payload) != "hello" {
+		t.Fatalf("Expected an echoed text message, got %d '%s'\n", opcode, payload)
+	}
+
+	// A fragmented message, with a ping in between
+	tc.write(false, opBinary, []byte{1, 2}, true)
+	tc.write(true, opPing, []byte("ping"), true)
+	tc.write(true, opContinuation, []byte{3}, true)
+
+	if opcode, payload := tc.read(); opcode != opPong || string(payload) != "ping" {
+		t.Fatalf("Expected a pong, got %d '%s'\n", opcode, payload)
+	}
+
+	if opcode, payload := tc.read(); opcode != opBinary || string(payload) != "\x01\x02\x03" {
+		t.Fatalf("Expected the reassembled message, got %d %v\n", opcode, payload)
+	}
+
+	tc.write(true, opText, []byte(strings.Repeat("a", 300)), true)
+	if _, payload := tc.read(); len(payload) != 300 {
+		t.Fatalf("Expected a 300 byte message, got %d\n", len(payload))
+	}
+
+	closePayload := []byte{0x03, 0xe8}
+	tc.write(true, opClose, append(closePayload, "bye"...), true)
+	tc.expectClose(CloseNormalClosure)
+
+	if ce, ok := (<-errs).(*CloseError); !ok || ce.Code != CloseNormalClosure || ce.Reason != "bye" {
+		t.Fatalf("Expected a close error with code 1000, got %v\n", ce)
+	}
+
+	for _, test := range []struct {
+		opcode  byte
+		payload []byte
+		masked  bool
+		code    int
+	}{
+		{opText, []byte(strings.Repeat("a", 1001)), true, CloseMessageTooBig},
+		{opText, []byte("unmasked"), false, CloseProtocolError},
+		{opText, []byte{0xff, 0xfe}, true, CloseInvalidPayload},
+		{opContinuation, []byte("orphan"), true, CloseProtocolError},
+		{0x3, []byte("reserved"), true, CloseProtocolError},
+	} {
+		tc, _ := dial(t, server, nil)
+		tc.write(true, test.opcode, test.payload, test.masked)
+		tc.expectClose(test.code)
+		<-errs
+		tc.conn.Close()
+	}
+}
+
+func TestConnFrameSize(t *testing.T) {
+	errs := make(chan error, 1)
+	server := echoServer(t, Upgrader{MaxMessageSize: -1}, errs)
+	defer server.Close()
+
+	tc, _ := dial(t, server, nil)
+	defer tc.conn.Close()
+
+	// Only the header of a huge frame is sent
+	header := []byte{0x80 | opBinary, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+	binary.BigEndian.PutUint64(header[2:10], 1<<62)
+	if _, err := tc.conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	tc.expectClose(CloseMessageTooBig)
+
+	if err := <-errs; err != ErrMessageTooBig {
+		t.Fatalf("Expected the frame to be rejected, got %v\n", err)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	done := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrader{}.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+
+		done <- conn.Close(CloseGoingAway, "shutdown")
+	}))
+	defer server.Close()
+
+	tc, _ := dial(t, server, nil)
+	tc.expectClose(CloseGoingAway)
+
+	tc.write(true, opClose, []byte{0x03, 0xe9}, true)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tc.br.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v\n", err)
+	}
+}
+
+func TestRoom(t *testing.T) {
+	rooms := NewRooms()
+	joined := make(chan *Conn, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrader{}.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer rooms.Leave("lobby", conn)
+
+		room := rooms.Join("lobby", conn)
+		joined <- conn
+
+		for {
+			t, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			room.Broadcast(t, msg, conn)
+		}
+	}))
+	defer server.Close()
+
+	tc1, _ := dial(t, server, nil)
+	<-joined
+	tc2, _ := dial(t, server, nil)
+	<-joined
+
+	if room, ok := rooms.Get("lobby"); !ok || room.Len() != 2 {
+		t.Fatalf("Expected a lobby with 2 connections\n")
+	}
+
+	tc1.write(true, opText, []byte("hi all"), true)
+	if _, payload := tc2.read(); string(payload) != "hi all" {
+		t.Fatalf("Expected the broadcast message, got '%s'\n", payload)
+	}
+
+	tc2.write(true, opClose, []byte{0x03, 0xe8}, true)
+	tc2.expectClose(CloseNormalClosure)
+
+	for {
+		if room, ok := rooms.Get("lobby"); ok && room.Len() == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tc1.write(true, opClose, []byte{0x03, 0xe8}, true)
+	tc1.expectClose(CloseNormalClosure)
+
+	for len(rooms.Names()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,75 @@
+package webfw
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urandom/webfw/context"
+	"github.com/urandom/webfw/websocket"
+)
+
+func TestWebSocketController(t *testing.T) {
+	d := NewDispatcher("/", Config{})
+	d.Handle(NewWebSocketController("/ws/:room", "ws", func(conn *websocket.Conn, r *http.Request, c context.Context) {
+		conn.WriteText("joined " + GetParams(c, r)["room"])
+	}))
+	d.Initialize()
+
+	server := httptest.NewServer(d)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r, _ := http.NewRequest("GET", server.URL+"/ws/lobby", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected code 101, got %d\n", resp.StatusCode)
+	}
+
+	// A single unmasked text frame, followed by the close frame
+	frame := make([]byte, 2+len("joined lobby"))
+	if _, err := io.ReadFull(br, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if frame[0] != 0x81 || string(frame[2:]) != "joined lobby" {
+		t.Fatalf("Expected the room name in a text frame, got %q\n", frame)
+	}
+
+	if b, err := br.ReadByte(); err != nil || b != 0x88 {
+		t.Fatalf("Expected a close frame, got %x, %v\n", b, err)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost:8080/ws/lobby", nil)
+	d.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected code %d for a plain request, got %d\n", http.StatusBadRequest, w.Code)
+	}
+}